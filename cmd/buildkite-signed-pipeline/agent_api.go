@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAgentEndpoint = `https://agent.buildkite.com/v3`
+	agentEndpointEnv     = `BUILDKITE_AGENT_ENDPOINT`
+	agentAccessTokenEnv  = `BUILDKITE_AGENT_ACCESS_TOKEN`
+	buildkiteJobIDEnv    = `BUILDKITE_JOB_ID`
+)
+
+// agentAPIClient fetches job details from the Buildkite Agent API
+type agentAPIClient struct {
+	Endpoint   string
+	Token      string
+	HTTPClient *http.Client
+}
+
+func newAgentAPIClientFromEnv() (*agentAPIClient, error) {
+	token := os.Getenv(agentAccessTokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s must be set to use the agent API", agentAccessTokenEnv)
+	}
+
+	endpoint := os.Getenv(agentEndpointEnv)
+	if endpoint == "" {
+		endpoint = defaultAgentEndpoint
+	}
+
+	return &agentAPIClient{
+		Endpoint:   endpoint,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+type agentJob struct {
+	ID  string            `json:"id"`
+	Env map[string]string `json:"env"`
+}
+
+// GetJob fetches the job along with the environment the agent was given for it
+func (c *agentAPIClient) GetJob(jobID string) (*agentJob, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/jobs/%s", strings.TrimSuffix(c.Endpoint, "/"), jobID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Agent API returned %s fetching job %s", resp.Status, jobID)
+	}
+
+	var job agentJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("Unable to decode job %s from the agent API: %v", jobID, err)
+	}
+	return &job, nil
+}
+
+// fillFromAgentAPI fills in a command or plugins that are missing from the
+// environment with the values the agent API has for the job
+func fillFromAgentAPI(client *agentAPIClient, jobID string, command string, pluginJSON string) (string, string, error) {
+	if command != "" && pluginJSON != "" {
+		return command, pluginJSON, nil
+	}
+	if jobID == "" {
+		return "", "", errors.New("No job id to fetch from the agent API")
+	}
+
+	log.Printf("Fetching job %s from the agent API", jobID)
+	job, err := client.GetJob(jobID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if command == "" {
+		command = job.Env[buildkiteCommandEnv]
+	}
+	if pluginJSON == "" {
+		pluginJSON = job.Env[buildkitePluginsEnv]
+	}
+	return command, pluginJSON, nil
+}
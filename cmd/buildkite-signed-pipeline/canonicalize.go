@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type canonicalizeCommand struct {
+	Signer *SharedSecretSigner
+	File   string
+}
+
+func (c *canonicalizeCommand) run(ctx *kingpin.ParseContext) error {
+	pipeline, err := readPipelineFile(c.File)
+	if err != nil {
+		return err
+	}
+
+	steps, err := canonicalizePipeline(c.Signer, pipeline)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(steps)
+}
+
+// canonicalStep is the exact content that is signed for a step, which allows
+// signatures to be produced by an external service
+type canonicalStep struct {
+	Step    string            `json:"step"`
+	Command string            `json:"command"`
+	Plugins string            `json:"plugins"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func canonicalizePipeline(signer *SharedSecretSigner, pipeline interface{}) ([]canonicalStep, error) {
+	steps := []canonicalStep{}
+
+	var err error
+	walkSteps(pipeline, func(step map[string]interface{}) {
+		if err != nil || !isCommandStep(step) {
+			return
+		}
+
+		content, hasContent, stepErr := signer.extractStepContent(step)
+		if stepErr != nil {
+			err = stepErr
+			return
+		}
+		if !hasContent {
+			return
+		}
+
+		steps = append(steps, canonicalStep{
+			Step:    stepName(step),
+			Command: canonicalCommand(content.Command),
+			Plugins: content.PluginJSON,
+			Fields:  content.Fields,
+		})
+	})
+
+	return steps, err
+}
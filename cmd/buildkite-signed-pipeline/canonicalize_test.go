@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeMatchesSignedContent(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[
+		{"key":"test","commands":["make deps","make test"],"plugins":{"seek-oss/aws-sm#v2.3.1":null,"docker#v3.8.0":{"image":"golang"}}},
+		"wait",
+		{"group":"Deploy","steps":[{"key":"deploy","command":"./deploy.sh\n\n./notify.sh\n"}]}
+	]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	steps, err := canonicalizePipeline(signer, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed []stepContent
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		signed = append(signed, content)
+		return Signature("llamas"), nil
+	}
+	if _, err := signer.Sign(pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []canonicalStep{
+		{
+			Step:    "test",
+			Command: "make deps\nmake test",
+			Plugins: `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}},{"github.com/seek-oss/aws-sm-buildkite-plugin#v2.3.1":null}]`,
+		},
+		{
+			Step:    "deploy",
+			Command: "./deploy.sh\n\n./notify.sh",
+		},
+	}, steps)
+
+	if assert.Len(t, signed, len(steps)) {
+		for i, step := range steps {
+			assert.Equal(t, canonicalCommand(signed[i].Command), step.Command)
+			assert.Equal(t, signed[i].PluginJSON, step.Plugins)
+		}
+	}
+}
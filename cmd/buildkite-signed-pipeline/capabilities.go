@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type capabilitiesCommand struct {
+	Signer *SharedSecretSigner
+}
+
+func (c *capabilitiesCommand) run(ctx *kingpin.ParseContext) error {
+	capabilities, err := c.Signer.Capabilities()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(capabilities)
+}
+
+// Capabilities describes what the signer covers, for reviewing its guarantees
+type Capabilities struct {
+	SignatureFormat  string            `json:"signature_format"`
+	SignedStepTypes  []string          `json:"signed_step_types"`
+	SkippedStepTypes []string          `json:"skipped_step_types"`
+	SignedProperties []string          `json:"signed_properties"`
+	OptInProperties  []optInCapability `json:"opt_in_properties"`
+	Salted           bool              `json:"salted"`
+}
+
+// optInCapability is a step property that is only signed when enabled
+type optInCapability struct {
+	Name            string `json:"name"`
+	VerifiedAgainst string `json:"verified_against"`
+	Enabled         bool   `json:"enabled"`
+}
+
+// capabilityProbes are an example of each type of step, which are signed to
+// find which types the signer covers
+var capabilityProbes = []struct {
+	StepType string
+	Step     interface{}
+}{
+	{"command", map[string]interface{}{"command": "true"}},
+	{"commands", map[string]interface{}{"commands": []interface{}{"true"}}},
+	{"plugins", map[string]interface{}{"plugins": []interface{}{"docker#v1.0.0"}}},
+	{"group", map[string]interface{}{"group": "Group", "steps": []interface{}{map[string]interface{}{"command": "true"}}}},
+	{"wait", "wait"},
+	{"block", map[string]interface{}{"block": "Release"}},
+	{"input", map[string]interface{}{"input": "Information"}},
+	{"trigger", map[string]interface{}{"trigger": "another-pipeline"}},
+}
+
+// Capabilities reports which step types and properties are signed, found by
+// signing an example of each type of step with the signer's options
+func (s SharedSecretSigner) Capabilities() (Capabilities, error) {
+	format := s.format
+	if format == "" {
+		format = signatureFormatHMAC
+	}
+	capabilities := Capabilities{
+		SignatureFormat:  format,
+		SignedStepTypes:  []string{},
+		SkippedStepTypes: []string{},
+		SignedProperties: append([]string{"command", "commands", "plugins"}, s.fieldNames()...),
+		Salted:           s.includeSalt,
+	}
+	if s.hashReferencedScripts {
+		capabilities.SignedProperties = append(capabilities.SignedProperties, scriptHashField)
+	}
+
+	// only the coverage of step types is of interest, not which steps are selected
+	// or the signatures themselves
+	probe := s
+	probe.signOnly = nil
+	probe.ignoredStepKeys = nil
+	probe.includeSalt = false
+	probe.requireBuildID = false
+	probe.signerFunc = func(content stepContent) (Signature, error) {
+		return "probe", nil
+	}
+
+	for _, p := range capabilityProbes {
+		_, report, err := probe.SignWithReport(map[string]interface{}{"steps": []interface{}{p.Step}})
+		if err != nil {
+			return Capabilities{}, err
+		}
+		if report.Signed > 0 {
+			capabilities.SignedStepTypes = append(capabilities.SignedStepTypes, p.StepType)
+		} else {
+			capabilities.SkippedStepTypes = append(capabilities.SkippedStepTypes, p.StepType)
+		}
+	}
+
+	enabled := s.fieldNames()
+	var available []string
+	for name := range stepFieldEnvs {
+		available = append(available, name)
+	}
+	available = append(available, "if", "branches")
+	for _, name := range enabled {
+		if !containsString(available, name) {
+			available = append(available, name)
+		}
+	}
+	sort.Strings(available)
+
+	for _, name := range available {
+		env, ok := s.fieldEnv(name)
+		if !ok && name == "if" {
+			env = stepIfEnv
+		}
+		if !ok && name == "branches" {
+			env = stepBranchesEnv
+		}
+		capabilities.OptInProperties = append(capabilities.OptInProperties, optInCapability{
+			Name:            name,
+			VerifiedAgainst: env,
+			Enabled:         containsString(enabled, name),
+		})
+	}
+
+	return capabilities, nil
+}
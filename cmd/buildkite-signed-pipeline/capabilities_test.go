@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	capabilities, err := NewSharedSecretSigner("").Capabilities()
+	assert.Nil(t, err)
+
+	assert.Equal(t, signatureFormatHMAC, capabilities.SignatureFormat)
+	assert.Equal(t, []string{"command", "commands", "plugins", "group"}, capabilities.SignedStepTypes)
+	assert.Equal(t, []string{"wait", "block", "input", "trigger"}, capabilities.SkippedStepTypes)
+	assert.Equal(t, []string{"command", "commands", "plugins"}, capabilities.SignedProperties)
+	assert.False(t, capabilities.Salted)
+	assert.Equal(t, []optInCapability{
+		{Name: "branches", VerifiedAgainst: stepBranchesEnv},
+		{Name: "concurrency", VerifiedAgainst: "BUILDKITE_CONCURRENCY"},
+		{Name: "concurrency_group", VerifiedAgainst: "BUILDKITE_CONCURRENCY_GROUP"},
+		{Name: "if", VerifiedAgainst: stepIfEnv},
+		{Name: "key", VerifiedAgainst: "BUILDKITE_STEP_KEY"},
+		{Name: "label", VerifiedAgainst: "BUILDKITE_LABEL"},
+		{Name: "parallelism", VerifiedAgainst: "BUILDKITE_PARALLEL_JOB_COUNT"},
+		{Name: "timeout_in_minutes", VerifiedAgainst: "BUILDKITE_TIMEOUT"},
+	}, capabilities.OptInProperties)
+}
+
+func TestCapabilitiesWithOptions(t *testing.T) {
+	signer := NewSharedSecretSigner("")
+	signer.format = signatureFormatPaseto
+	signer.signedFields = []string{"key", "soft_fail"}
+	signer.signedFieldEnvs = map[string]string{"soft_fail": "STEP_SOFT_FAIL"}
+	signer.signedEnv = []string{"DEPLOY_ENV"}
+	signer.includeSalt = true
+	signer.ignoredStepKeys = []string{"key"}
+
+	capabilities, err := signer.Capabilities()
+	assert.Nil(t, err)
+
+	assert.Equal(t, signatureFormatPaseto, capabilities.SignatureFormat)
+	assert.Equal(t, []string{"command", "commands", "plugins", "key", "soft_fail", "env.DEPLOY_ENV"}, capabilities.SignedProperties)
+	assert.True(t, capabilities.Salted)
+	assert.Contains(t, capabilities.OptInProperties, optInCapability{Name: "key", VerifiedAgainst: "BUILDKITE_STEP_KEY", Enabled: true})
+	assert.Contains(t, capabilities.OptInProperties, optInCapability{Name: "soft_fail", VerifiedAgainst: "STEP_SOFT_FAIL", Enabled: true})
+	assert.Contains(t, capabilities.OptInProperties, optInCapability{Name: "env.DEPLOY_ENV", VerifiedAgainst: "DEPLOY_ENV", Enabled: true})
+	assert.Contains(t, capabilities.OptInProperties, optInCapability{Name: "label", VerifiedAgainst: "BUILDKITE_LABEL"})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+type checkCommand struct {
+	Signer *SharedSecretSigner
+	File   string
+}
+
+func (c *checkCommand) run(ctx *kingpin.ParseContext) error {
+	pipeline, err := readPipelineFile(c.File)
+	if err != nil {
+		return err
+	}
+
+	results, err := checkPipeline(c.Signer, pipeline)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			warnf("🚨 %s: %v", result.Name, result.Err)
+		} else {
+			log.Printf("✅ %s", result.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d signed steps would fail verification", failed, len(results))
+	}
+	log.Printf("All %d signed steps would verify", len(results))
+
+	return nil
+}
+
+// readPipelineFile parses a YAML or JSON pipeline without interpolating it
+func readPipelineFile(path string) (interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipeline interface{}
+	if err := yaml.Unmarshal(b, &pipeline); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	return pipeline, nil
+}
+
+type stepCheckResult struct {
+	Name string
+	Err  error
+}
+
+// checkPipeline signs a pipeline and then verifies each signed step as it would
+// be presented to an agent, checking signing and verification agree
+func checkPipeline(signer *SharedSecretSigner, pipeline interface{}) ([]stepCheckResult, error) {
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign pipeline: %v", err)
+	}
+
+	var results []stepCheckResult
+	walkSteps(signed, func(step map[string]interface{}) {
+		sig, ok := stepSignature(step)
+		if !ok {
+			return
+		}
+		results = append(results, stepCheckResult{
+			Name: stepName(step),
+			Err:  verifyStepLocally(*signer, step, sig),
+		})
+	})
+
+	return results, nil
+}
+
+// verifyStepLocally verifies a signed step using the command, plugins and
+// environment an agent would present for it
+func verifyStepLocally(verifier SharedSecretSigner, step map[string]interface{}, sig Signature) error {
+	command := ""
+	if rawCommand, ok := step["command"]; ok {
+		var err error
+		if command, err = verifier.extractCommand(rawCommand); err != nil {
+			return err
+		}
+	} else if rawCommand, ok := step["commands"]; ok {
+		var err error
+		if command, err = verifier.extractCommand(rawCommand); err != nil {
+			return err
+		}
+	}
+
+	pluginJSON := ""
+	if plugins, ok := step["plugins"]; ok {
+		var err error
+		if pluginJSON, err = verifier.extractPlugins(plugins); err != nil {
+			return err
+		}
+	}
+
+	fields, err := verifier.extractStepFields(step)
+	if err != nil {
+		return err
+	}
+	env := make(map[string]string)
+	for name, value := range fields {
+		if envName, ok := verifier.fieldEnv(name); ok {
+			env[envName] = value
+		}
+	}
+	env[stepSignatureSaltEnv], _ = stepEnvValue(step, stepSignatureSaltEnv)
+	verifier.getenv = func(key string) string {
+		if value, ok := env[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+
+	return verifier.Verify(command, pluginJSON, sig)
+}
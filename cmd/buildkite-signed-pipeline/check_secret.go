@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type checkSecretCommand struct {
+	Config   secretConfig
+	KmsKeyID string
+}
+
+func (c *checkSecretCommand) run(ctx *kingpin.ParseContext) error {
+	result, err := checkSecret(c.Config, c.KmsKeyID)
+	if err != nil {
+		return err
+	}
+	log.Println(result)
+	return nil
+}
+
+// checkSecret confirms the configured secret can be resolved to a usable value,
+// describing the outcome without including the secret
+func checkSecret(config secretConfig, kmsKeyID string) (string, error) {
+	if kmsKeyID != "" {
+		return fmt.Sprintf("✅ Steps are signed with KMS key %s, no shared secret is required", kmsKeyID), nil
+	}
+
+	if !config.isSet() {
+		return "", errors.New("🚨 No shared secret is configured, one of --shared-secret, --secret-source, --secret-map-file or --aws-sm-shared-secret-id must be provided")
+	}
+
+	source := "--shared-secret"
+	if config.Source != "" {
+		source = config.Source
+	}
+	if config.MapFile != "" {
+		source = config.MapFile
+	}
+
+	secret, err := config.resolve()
+	if err != nil {
+		return "", fmt.Errorf("🚨 Unable to get the shared secret from %s: %v", source, err)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("🚨 The shared secret from %s is empty", source)
+	}
+	if len(secret) < minSecretLength {
+		return fmt.Sprintf("⚠️ The shared secret from %s is available but only %d bytes, consider gen-secret for a stronger one", source, len(secret)), nil
+	}
+
+	return fmt.Sprintf("✅ The shared secret from %s is available (%d bytes)", source, len(secret)), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSecretProvider struct {
+	err error
+}
+
+func (p failingSecretProvider) Fetch(ctx context.Context) (string, error) {
+	return "", p.err
+}
+
+// registerTestSecretProvider registers a provider for the test scheme, removing it
+// once the test completes
+func registerTestSecretProvider(t *testing.T, provider SecretProvider) {
+	RegisterSecretProvider("test", func(ref string, options secretProviderOptions) (SecretProvider, error) {
+		return provider, nil
+	})
+	t.Cleanup(func() {
+		delete(secretProviders, "test")
+	})
+}
+
+func TestCheckSecretAvailable(t *testing.T) {
+	registerTestSecretProvider(t, staticSecretProvider("a-secret-that-is-long-enough"))
+
+	result, err := checkSecret(secretConfig{Source: "test://secret"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "✅ The shared secret from test://secret is available (28 bytes)", result)
+	assert.NotContains(t, result, "a-secret-that-is-long-enough")
+}
+
+func TestCheckSecretPermissionDenied(t *testing.T) {
+	registerTestSecretProvider(t, failingSecretProvider{
+		err: awserr.New("AccessDeniedException", "User is not authorized to perform: secretsmanager:GetSecretValue", nil),
+	})
+
+	_, err := checkSecret(secretConfig{Source: "test://secret"}, "")
+	assert.EqualError(t, err, "🚨 Unable to get the shared secret from test://secret: "+
+		"AccessDeniedException: User is not authorized to perform: secretsmanager:GetSecretValue")
+}
+
+func TestCheckSecretEmpty(t *testing.T) {
+	registerTestSecretProvider(t, staticSecretProvider(""))
+
+	_, err := checkSecret(secretConfig{Source: "test://secret"}, "")
+	assert.EqualError(t, err, "🚨 Unable to get the shared secret from test://secret: The secret from test://secret is empty")
+}
+
+func TestCheckSecretWeak(t *testing.T) {
+	result, err := checkSecret(secretConfig{SharedSecret: "llamas"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "⚠️ The shared secret from --shared-secret is available but only 6 bytes, consider gen-secret for a stronger one", result)
+}
+
+func TestCheckSecretNotConfigured(t *testing.T) {
+	_, err := checkSecret(secretConfig{}, "")
+	assert.NotNil(t, err)
+
+	result, err := checkSecret(secretConfig{}, "alias/signed-pipeline")
+	assert.Nil(t, err)
+	assert.Equal(t, "✅ Steps are signed with KMS key alias/signed-pipeline, no shared secret is required", result)
+}
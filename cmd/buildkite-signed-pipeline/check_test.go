@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePipelineFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "pipeline.yml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckPipelineRoundTrips(t *testing.T) {
+	path := writePipelineFile(t, `
+steps:
+  - label: Tests
+    commands:
+      - make deps
+      - make test
+    plugins:
+      - docker#v3.8.0:
+          image: golang:1.17
+          environment: [CI]
+      - seek-oss/aws-sm#v2.3.1:
+          env:
+            SECRET: my-secret
+  - wait
+  - block: Deploy?
+  - group: Deploy
+    steps:
+      - key: deploy
+        command: ./deploy.sh
+        concurrency: 1
+        concurrency_group: deploy
+`)
+
+	pipeline, err := readPipelineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"concurrency", "concurrency_group"}
+
+	results, err := checkPipeline(signer, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		assert.Nil(t, result.Err, result.Name)
+	}
+	assert.Equal(t, "Tests", results[0].Name)
+	assert.Equal(t, "deploy", results[1].Name)
+}
+
+func TestCheckPipelineWithUnsupportedConstruct(t *testing.T) {
+	path := writePipelineFile(t, `
+steps:
+  - label: Deploy
+    command:
+      run: ./deploy.sh
+`)
+
+	pipeline, err := readPipelineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = checkPipeline(NewSharedSecretSigner("secret-llamas"), pipeline)
+	assert.EqualError(t, err, `Unable to sign pipeline: Step "Deploy": Unexpected command object with keys run, commands must be a string or a list of strings`)
+}
+
+func TestAnchoredPluginsVerifyAsExpanded(t *testing.T) {
+	// pipelines signed without the agent must expand anchors and aliases, so
+	// steps match the BUILDKITE_PLUGINS the agent expands them to
+	path := writePipelineFile(t, `
+x-docker: &docker
+  docker#v3.8.0: &docker-settings
+    image: golang:1.17
+    environment: [CI]
+
+steps:
+  - key: test
+    command: make test
+    plugins:
+      - *docker
+  - key: lint
+    command: make lint
+    plugins:
+      - docker#v3.8.0:
+          <<: *docker-settings
+          image: golangci/golangci-lint
+`)
+	pipeline, err := readPipelineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plugins of each job as expanded by the agent
+	agentPlugins := map[string]string{
+		"test": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"environment":["CI"],"image":"golang:1.17"}}]`,
+		"lint": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"environment":["CI"],"image":"golangci/golangci-lint"}}]`,
+	}
+
+	verified := 0
+	walkSteps(signed, func(step map[string]interface{}) {
+		sig, ok := stepSignature(step)
+		if !assert.True(t, ok) {
+			return
+		}
+		key := step["key"].(string)
+		assert.Nil(t, signer.Verify(step["command"].(string), agentPlugins[key], sig), key)
+		verified++
+	})
+	assert.Equal(t, 2, verified)
+}
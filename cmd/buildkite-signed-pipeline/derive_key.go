@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	buildkitePipelineSlugEnv = `BUILDKITE_PIPELINE_SLUG`
+
+	derivedKeyLength = 32
+)
+
+// deriveKey derives a signing key for a pipeline from a master secret with HKDF,
+// so a leaked pipeline key doesn't reveal the keys of other pipelines
+func deriveKey(masterSecret string, pipelineSlug string) ([]byte, error) {
+	key := make([]byte, derivedKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(masterSecret), nil, []byte(pipelineSlug)), key); err != nil {
+		return nil, fmt.Errorf("Unable to derive a key for pipeline %s: %v", pipelineSlug, err)
+	}
+	return key, nil
+}
+
+// signingKey returns the key steps are signed with, which is the shared secret
+// unless keys are derived for each pipeline
+func (s SharedSecretSigner) signingKey() ([]byte, error) {
+	if !s.deriveKey {
+		return []byte(s.secret), nil
+	}
+
+	slug := s.jobEnv(buildkitePipelineSlugEnv)
+	if slug == "" {
+		return nil, fmt.Errorf("🚨 %s must be set to derive the signing key of the pipeline", buildkitePipelineSlugEnv)
+	}
+	return deriveKey(s.secret, slug)
+}
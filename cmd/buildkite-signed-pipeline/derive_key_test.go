@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDerivedKeySigner() *SharedSecretSigner {
+	signer := NewSharedSecretSigner("master-secret-llamas")
+	signer.deriveKey = true
+	return signer
+}
+
+func TestDerivedKeysDifferByPipeline(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := newDerivedKeySigner()
+
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	appSignature := signedStepSignature(t, signer, `{"command":"echo hello"}`)
+	t.Setenv(buildkitePipelineSlugEnv, "infra")
+	infraSignature := signedStepSignature(t, signer, `{"command":"echo hello"}`)
+	assert.NotEqual(t, appSignature, infraSignature)
+
+	// nor are derived keys the master secret
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	assert.NotEqual(t, appSignature, signedStepSignature(t, NewSharedSecretSigner("master-secret-llamas"), `{"command":"echo hello"}`))
+}
+
+func TestVerifyDerivedKey(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	signer := newDerivedKeySigner()
+	signature := signedStepSignature(t, signer, `{"command":"echo hello"}`)
+
+	assert.Nil(t, signer.Verify("echo hello", "", signature))
+
+	// a signature from another pipeline doesn't verify
+	t.Setenv(buildkitePipelineSlugEnv, "infra")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", "", signature))
+
+	// nor without a pipeline to derive the key for
+	t.Setenv(buildkitePipelineSlugEnv, "")
+	assert.EqualError(t, signer.Verify("echo hello", "", signature), "🚨 BUILDKITE_PIPELINE_SLUG must be set to derive the signing key of the pipeline")
+}
+
+func TestVerifyDerivedKeyPaseto(t *testing.T) {
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	signer := newDerivedKeySigner()
+	signer.format = signatureFormatPaseto
+
+	signature, err := signer.signPaseto(stepContent{Command: "echo hello"})
+	assert.Nil(t, err)
+	assert.Nil(t, signer.Verify("echo hello", "", signature))
+
+	t.Setenv(buildkitePipelineSlugEnv, "infra")
+	assert.NotNil(t, signer.Verify("echo hello", "", signature))
+}
+
+func TestDeriveKeyIsDeterministic(t *testing.T) {
+	key, err := deriveKey("master-secret-llamas", "app")
+	assert.Nil(t, err)
+	assert.Len(t, key, derivedKeyLength)
+
+	again, err := deriveKey("master-secret-llamas", "app")
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// secrets shorter than this are too easily brute forced
+const minSecretLength = 16
+
+type genSecretCommand struct {
+	Length int
+	Out    string
+}
+
+func (g *genSecretCommand) run(c *kingpin.ParseContext) error {
+	secret, err := generateSecret(g.Length)
+	if err != nil {
+		return err
+	}
+
+	if g.Out == "" {
+		fmt.Println(secret)
+		return nil
+	}
+
+	if err := os.WriteFile(g.Out, []byte(secret), 0600); err != nil {
+		return err
+	}
+	log.Printf("Wrote secret to %s", g.Out)
+
+	return nil
+}
+
+// generateSecret returns length bytes from a cryptographically secure source
+// encoded as base64
+func generateSecret(length int) (string, error) {
+	if length < minSecretLength {
+		return "", fmt.Errorf("Secrets must be at least %d bytes", minSecretLength)
+	}
+
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := generateSecret(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, decoded, 32)
+
+	other, err := generateSecret(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, secret, other)
+}
+
+func TestGenerateSecretRejectsShortLength(t *testing.T) {
+	_, err := generateSecret(8)
+	assert.NotNil(t, err)
+}
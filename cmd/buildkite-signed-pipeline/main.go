@@ -4,87 +4,820 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/kms"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	Version string = "1.9.0"
 )
 
+const (
+	outputFormatJSON = `json`
+	outputFormatYAML = `yaml`
+)
+
 func main() {
 	app := kingpin.New("buildkite-signed-pipeline", "Signed pipeline uploads for Buildkite")
 	app.Version(Version)
 
 	var (
+		warningsFile      string
 		sharedSecret      string
+		sharedSecretStdin bool
 		awsSharedSecretId string
+		secretSource      string
+		secretMapFile     string
+		commandTransforms []string
+		signatureFormat   string
+		maxAge            time.Duration
+		signConcurrency   bool
+		signKey           bool
+		signLabel         bool
+		signTimeout       bool
+		signIf            bool
+		signBranches      bool
+		secretEncoding    string
+		awsSmMaxAttempts  int
+		awsAssumeRoleArn  string
+		debugPlugins      bool
+		signEnv           []string
+		signFields        []string
+		rejectDuplicates  bool
+		requireStepKeys   bool
+		requireBuildID    bool
+		strictTopLevel    bool
+		signPipeline      bool
+		includeSalt       bool
+		ignoreStepKeys    []string
+		deriveKey         bool
+		matchUnversioned  bool
+		signPluginOrder   bool
+		hashScripts       bool
+		logFingerprint    bool
+		flattenObjects    bool
+		excludeSettings   []string
+		kmsKeyID          string
+		kmsAlgorithm      string
 	)
 	app.
 		Flag("shared-secret", "A shared secret to use for signing").
 		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SECRET`).
 		StringVar(&sharedSecret)
 
+	app.
+		Flag("shared-secret-stdin", "Read the shared secret from stdin, a pipeline to upload must then be given as a file or --url").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SECRET_STDIN`).
+		BoolVar(&sharedSecretStdin)
+
 	app.
 		Flag("aws-sm-shared-secret-id", "A shared secret to use for signing").
 		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_AWS_SM_SECRET_ID`).
 		StringVar(&awsSharedSecretId)
 
+	app.
+		Flag("secret-source", "Where to fetch the shared secret from, one of awssm://id, vault://path?field=name, file:///path or env://NAME").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SECRET_SOURCE`).
+		StringVar(&secretSource)
+
+	app.
+		Flag("secret-map-file", "A JSON or YAML file mapping pipeline slugs to secrets, the secret of the pipeline in "+buildkitePipelineSlugEnv+" is used").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SECRET_MAP_FILE`).
+		StringVar(&secretMapFile)
+
+	app.
+		Flag("aws-sm-max-attempts", "The number of attempts made to fetch the secret from AWS SM when throttled or on transient errors").
+		Default("5").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_AWS_SM_MAX_ATTEMPTS`).
+		SetValue(&positiveIntValue{&awsSmMaxAttempts})
+
+	app.
+		Flag("aws-assume-role-arn", "A role to assume to fetch the secret from AWS SM, e.g. a role in the account holding the secret").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_AWS_ASSUME_ROLE_ARN`).
+		StringVar(&awsAssumeRoleArn)
+
+	app.
+		Flag("secret-encoding", "How the shared secret is encoded, either raw or base64").
+		Default(secretEncodingRaw).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SECRET_ENCODING`).
+		EnumVar(&secretEncoding, secretEncodingRaw, secretEncodingBase64)
+
+	app.
+		Flag("kms-key-id", "An asymmetric AWS KMS key id or ARN to sign and verify with instead of a shared secret").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_KMS_KEY_ID`).
+		StringVar(&kmsKeyID)
+
+	app.
+		Flag("kms-signing-algorithm", "The signing algorithm of the KMS key").
+		Default(kms.SigningAlgorithmSpecEcdsaSha256).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_KMS_SIGNING_ALGORITHM`).
+		EnumVar(&kmsAlgorithm, kmsSigningAlgorithms...)
+
+	app.
+		Flag("derive-key", "Sign with a key derived from the shared secret for each pipeline with HKDF, using "+buildkitePipelineSlugEnv).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_DERIVE_KEY`).
+		BoolVar(&deriveKey)
+
+	app.
+		Flag("command-transform", "A regular expression whose matches are stripped from commands before signing and verifying, e.g. a prefix added by an agent hook").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_COMMAND_TRANSFORM`).
+		StringsVar(&commandTransforms)
+
+	app.
+		Flag("signature-format", "The format of step signatures, either hmac or paseto").
+		Default(signatureFormatHMAC).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNATURE_FORMAT`).
+		EnumVar(&signatureFormat, signatureFormatHMAC, signatureFormatPaseto)
+
+	app.
+		Flag("max-age", "Timestamp signatures and reject those issued longer ago than this duration, e.g. 30m").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_MAX_AGE`).
+		DurationVar(&maxAge)
+
+	app.
+		Flag("sign-concurrency", "Include the concurrency and concurrency_group of steps in their signatures, checked for consistency against BUILDKITE_CONCURRENCY and BUILDKITE_CONCURRENCY_GROUP which a hook must provide").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_CONCURRENCY`).
+		BoolVar(&signConcurrency)
+
+	app.
+		Flag("sign-key", "Include the key of steps in their signatures").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_KEY`).
+		BoolVar(&signKey)
+
+	app.
+		Flag("sign-label", "Include the label of steps in their signatures").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_LABEL`).
+		BoolVar(&signLabel)
+
+	app.
+		Flag("sign-timeout", "Include the timeout_in_minutes of steps in their signatures, verified against BUILDKITE_TIMEOUT").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_TIMEOUT`).
+		BoolVar(&signTimeout)
+
+	app.
+		Flag("sign-if", "Include the if condition of steps in their signatures, checked for consistency against "+stepIfEnv+" which a hook must provide").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_IF`).
+		BoolVar(&signIf)
+
+	app.
+		Flag("sign-branches", "Include the branches filter of steps in their signatures, checked for consistency against "+stepBranchesEnv+" which a hook must provide").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_BRANCHES`).
+		BoolVar(&signBranches)
+
+	app.
+		Flag("sign-fields", "A comma separated list of step properties to include in signatures, as name or name=ENV where ENV is the job env the property is verified against. Properties given as name=ENV are only checked for consistency, as the step env can set ENV").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_FIELDS`).
+		StringsVar(&signFields)
+
+	app.
+		Flag("sign-env", "A step env key whose value is included in the signature, verified against the job env").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_ENV`).
+		StringsVar(&signEnv)
+
+	app.
+		Flag("reject-duplicate-plugins", "Fail to sign steps that reference the same plugin more than once, rather than warning").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_REJECT_DUPLICATE_PLUGINS`).
+		BoolVar(&rejectDuplicates)
+
+	app.
+		Flag("require-step-keys", "Fail to sign pipelines with a command step that has no key, so every signed step can be traced").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_REQUIRE_STEP_KEYS`).
+		BoolVar(&requireStepKeys)
+
+	app.
+		Flag("require-build-id", "Fail to sign or verify signatures when "+buildkiteBuildIDEnv+" isn't set, rather than binding them to an empty build").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_REQUIRE_BUILD_ID`).
+		BoolVar(&requireBuildID)
+
+	app.
+		Flag("sign-pipeline", "Also sign the set of signed steps of the pipeline, stored in its top level env as "+pipelineSignatureEnv).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_PIPELINE`).
+		BoolVar(&signPipeline)
+
+	app.
+		Flag("strict-top-level", "Fail to sign pipelines with a top level key other than agents, env, image, notify or steps").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_STRICT_TOP_LEVEL`).
+		BoolVar(&strictTopLevel)
+
+	app.
+		Flag("ignore-step-key", "The key of a step that is left unsigned and allowed to run unsigned, can be repeated. Must be the same when signing and verifying").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_IGNORE_STEP_KEY`).
+		StringsVar(&ignoreStepKeys)
+
+	app.
+		Flag("include-salt", "Fold a random salt into each signature, stored alongside it in the step as "+stepSignatureSaltEnv).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_INCLUDE_SALT`).
+		BoolVar(&includeSalt)
+
+	app.
+		Flag("match-unversioned-plugins", "When verifying, also match plugins with a version against the same plugins signed without a version").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_MATCH_UNVERSIONED_PLUGINS`).
+		BoolVar(&matchUnversioned)
+
+	app.
+		Flag("hash-referenced-scripts", "Fold the contents of the local script a command runs, such as ./deploy.sh, into its signature. The script must exist when signing and verifying").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_HASH_REFERENCED_SCRIPTS`).
+		BoolVar(&hashScripts)
+
+	app.
+		Flag("flatten-object-commands", "Sign and upload a command given as an object of the form {run: ./deploy.sh, args: [prod]} as the run command followed by its quoted args").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_FLATTEN_OBJECT_COMMANDS`).
+		BoolVar(&flattenObjects)
+
+	app.
+		Flag("preserve-plugin-order", "Sign the order plugins are listed in rather than sorting them, so reordering them invalidates the signature. Must be the same when signing and verifying").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_PRESERVE_PLUGIN_ORDER`).
+		BoolVar(&signPluginOrder)
+
+	app.
+		Flag("exclude-plugin-setting", "A plugin setting left out of signatures as the agent rewrites it at runtime, as plugin.setting e.g. docker.mount-buildkite-agent. Can be repeated and must be the same when signing and verifying").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_EXCLUDE_PLUGIN_SETTING`).
+		StringsVar(&excludeSettings)
+
+	app.
+		Flag("debug-plugins", "Log how each plugin reference is normalised before signing").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_DEBUG_PLUGINS`).
+		BoolVar(&debugPlugins)
+
+	app.
+		Flag("log-secret-fingerprint", "Log a short fingerprint of the shared secret that can't be used to recover it, to compare the secret across agents").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_LOG_SECRET_FINGERPRINT`).
+		BoolVar(&logFingerprint)
+
+	app.
+		Flag("warnings-file", "Also write security relevant warnings, such as unsigned commands being allowed, to this file or file descriptor, e.g. /dev/fd/3").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_WARNINGS_FILE`).
+		StringVar(&warningsFile)
+
 	uploadCommand := &uploadCommand{}
-	uploadCommandClause := app.Command("upload", "Upload a pipeline.yml with signatures").Action(uploadCommand.run)
+	verifyCommand := &verifyCommand{}
+	checkCommand := &checkCommand{}
+	auditBuildCommand := &auditBuildCommand{}
+	serveCommand := &serveCommand{}
+	verifyPipelineCommand := &verifyPipelineCommand{}
+
+	// newSigner creates a signer with the configured signing options
+	newSigner := func(secret string) (*SharedSecretSigner, error) {
+		signer := NewSharedSecretSigner(secret)
+		signer.buildID = os.Getenv(buildkiteBuildIDEnv)
+		signer.format = signatureFormat
+		signer.maxAge = maxAge
+		signer.debugPlugins = debugPlugins
+		fields, fieldEnvs, err := parseSignFields(signFields)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --sign-fields: %v", err)
+		}
+		for _, field := range fields {
+			if !containsString(signer.signedFields, field) {
+				signer.signedFields = append(signer.signedFields, field)
+			}
+		}
+		if signIf && !containsString(signer.signedFields, "if") {
+			signer.signedFields = append(signer.signedFields, "if")
+			if _, ok := fieldEnvs["if"]; !ok {
+				fieldEnvs["if"] = stepIfEnv
+			}
+		}
+		if signBranches && !containsString(signer.signedFields, "branches") {
+			signer.signedFields = append(signer.signedFields, "branches")
+			if _, ok := fieldEnvs["branches"]; !ok {
+				fieldEnvs["branches"] = stepBranchesEnv
+			}
+		}
+		signer.signedFieldEnvs = fieldEnvs
+		signer.signedEnv = signEnv
+		signer.rejectDuplicatePlugins = rejectDuplicates
+		signer.requireStepKeys = requireStepKeys
+		signer.requireBuildID = requireBuildID
+		signer.strictTopLevel = strictTopLevel
+		signer.signPipeline = signPipeline
+		signer.includeSalt = includeSalt
+		signer.ignoredStepKeys = ignoreStepKeys
+		signer.deriveKey = deriveKey
+		signer.matchUnversionedPlugins = matchUnversioned
+		signer.preservePluginOrder = signPluginOrder
+		signer.hashReferencedScripts = hashScripts
+		if flattenObjects {
+			signer.objectCommandExtractors = append(signer.objectCommandExtractors, runArgsCommand)
+		}
+		if signer.excludedPluginSettings, err = parseExcludedPluginSettings(excludeSettings); err != nil {
+			return nil, fmt.Errorf("Invalid --exclude-plugin-setting: %v", err)
+		}
+		if signConcurrency {
+			signer.signedFields = append(signer.signedFields, "concurrency", "concurrency_group")
+		}
+		if signKey {
+			signer.signedFields = append(signer.signedFields, "key")
+		}
+		if signLabel {
+			signer.signedFields = append(signer.signedFields, "label")
+		}
+		if signTimeout && !containsString(signer.signedFields, "timeout_in_minutes") {
+			signer.signedFields = append(signer.signedFields, "timeout_in_minutes")
+		}
+		for _, transform := range commandTransforms {
+			re, err := regexp.Compile(transform)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid --command-transform %q: %v", transform, err)
+			}
+			signer.commandTransforms = append(signer.commandTransforms, re)
+		}
+		return signer, nil
+	}
+
+	// newSecretConfig returns where the shared secret is configured to come from
+	newSecretConfig := func() secretConfig {
+		// --aws-sm-shared-secret-id is an alias of an awssm:// secret source
+		source := secretSource
+		if source == "" && awsSharedSecretId != "" {
+			source = secretSchemeAwsSm + "://" + awsSharedSecretId
+		}
+		return secretConfig{
+			SharedSecret: sharedSecret,
+			Source:       source,
+			MapFile:      secretMapFile,
+			Encoding:     secretEncoding,
+			Options:      secretProviderOptions{AwsSmMaxAttempts: awsSmMaxAttempts, AwsAssumeRoleArn: awsAssumeRoleArn},
+		}
+	}
+
+	// newKmsSigner creates a signer that signs with the KMS key, no secret is
+	// required as KMS holds the key material
+	newKmsSigner := func() (*SharedSecretSigner, error) {
+		if signatureFormat != signatureFormatHMAC {
+			return nil, errors.New("--signature-format can't be used with --kms-key-id")
+		}
+		if maxAge > 0 {
+			return nil, errors.New("--max-age can't be used with --kms-key-id")
+		}
+		if deriveKey {
+			return nil, errors.New("--derive-key can't be used with --kms-key-id")
+		}
+		if sharedSecret != "" || secretSource != "" || awsSharedSecretId != "" || secretMapFile != "" {
+			warnf("⚠️ Ignoring the shared secret, steps are signed with KMS key %s", kmsKeyID)
+		}
+
+		signer, err := newSigner("")
+		if err != nil {
+			return nil, err
+		}
+		signer.format = signatureFormatKMS
+		signer.kmsKeyID = kmsKeyID
+		signer.kmsSigningAlgorithm = kmsAlgorithm
+		if signer.kms, err = NewKmsClient(kmsKeyID); err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+
+	// This happens after parse, we need to create a signer object for all of our
+	// commands that sign or verify.
+	configureSigner := func(c *kingpin.ParseContext) error {
+		// the signer service holds the secret
+		if uploadCommand.SignerURL != "" {
+			return nil
+		}
+
+		if kmsKeyID != "" {
+			signer, err := newKmsSigner()
+			if err != nil {
+				return err
+			}
+			if logFingerprint {
+				log.Printf("Steps are signed with KMS key %s, there's no shared secret to fingerprint", kmsKeyID)
+			}
+			uploadCommand.Signer = signer
+			verifyCommand.Signer = signer
+			checkCommand.Signer = signer
+			auditBuildCommand.Signer = signer
+			serveCommand.Signer = signer
+			verifyPipelineCommand.Signer = signer
+			return nil
+		}
+
+		if sharedSecretStdin {
+			if sharedSecret != "" || secretSource != "" || awsSharedSecretId != "" || secretMapFile != "" {
+				return errors.New("--shared-secret-stdin can't be used with --shared-secret, --secret-source, --secret-map-file or --aws-sm-shared-secret-id")
+			}
+			secret, err := readStdinSecret(os.Stdin)
+			if err != nil {
+				return err
+			}
+			sharedSecret = secret
+			uploadCommand.SecretFromStdin = true
+		}
+
+		if secretMapFile != "" && (sharedSecret != "" || secretSource != "" || awsSharedSecretId != "") {
+			return errors.New("--secret-map-file can't be used with --shared-secret, --secret-source or --aws-sm-shared-secret-id")
+		}
+
+		config := newSecretConfig()
+		if !config.isSet() {
+			return errors.New("One of --shared-secret, --shared-secret-stdin, --secret-source, --secret-map-file, --aws-sm-shared-secret-id or --kms-key-id must be provided")
+		}
+		if err := config.checkCommand(c.SelectedCommand.FullCommand()); err != nil {
+			return err
+		}
+
+		signingSecret, err := config.resolve()
+		if err != nil {
+			return err
+		}
+		if logFingerprint {
+			log.Printf("Shared secret fingerprint is %s", secretFingerprint(signingSecret))
+		}
+
+		signer, err := newSigner(signingSecret)
+		if err != nil {
+			return err
+		}
+
+		uploadCommand.Signer = signer
+		verifyCommand.Signer = signer
+		checkCommand.Signer = signer
+		auditBuildCommand.Signer = signer
+		serveCommand.Signer = signer
+		verifyPipelineCommand.Signer = signer
+		return nil
+	}
+
+	uploadCommandClause := app.Command("upload", "Upload a pipeline.yml with signatures").
+		PreAction(configureSigner).
+		Action(uploadCommand.run)
 	uploadCommandClause.
 		Arg("file", "The pipeline.yml to process").
 		FileVar(&uploadCommand.File)
 
+	uploadCommandClause.
+		Flag("url", "Download the pipeline to process from a URL rather than a file").
+		StringVar(&uploadCommand.URL)
+
+	uploadCommandClause.
+		Flag("header", "A header to send when downloading the pipeline from --url, e.g. \"Authorization: Bearer token\"").
+		StringsVar(&uploadCommand.Headers)
+
+	uploadCommandClause.
+		Flag("sign-only", "Only sign steps with a key or label matching this regular expression, e.g. when gradually adopting signing").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGN_ONLY`).
+		RegexpVar(&uploadCommand.SignOnly)
+
+	uploadCommandClause.
+		Flag("validate", "Check the signed pipeline against the parts of the pipeline schema signing could affect before it's uploaded, e.g. the form of each step's env").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VALIDATE`).
+		BoolVar(&uploadCommand.Validate)
+
+	uploadCommandClause.
+		Flag("only-keys", "Only upload the steps with these comma separated keys, along with the wait steps between them, e.g. to run just the steps for changed files").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_ONLY_KEYS`).
+		StringsVar(&uploadCommand.OnlyKeys)
+
+	uploadCommandClause.
+		Flag("signer-url", "Have the signer service at this URL, run with serve, sign the pipeline rather than signing it with a local secret").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNER_URL`).
+		StringVar(&uploadCommand.SignerURL)
+
+	uploadCommandClause.
+		Flag("signer-token", "The bearer token to present to the signer service").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNER_TOKEN`).
+		StringVar(&uploadCommand.SignerToken)
+
+	uploadCommandClause.
+		Flag("signer-ca-cert", "A CA certificate to trust for the signer service, rather than the system roots").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNER_CA_CERT`).
+		StringVar(&uploadCommand.SignerCACert)
+
+	uploadCommandClause.
+		Flag("signer-client-cert", "A client certificate to present to the signer service, for mTLS").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNER_CLIENT_CERT`).
+		StringVar(&uploadCommand.SignerClientCert)
+
+	uploadCommandClause.
+		Flag("signer-client-key", "The private key of --signer-client-cert").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNER_CLIENT_KEY`).
+		StringVar(&uploadCommand.SignerClientKey)
+
 	uploadCommandClause.
 		Flag("dry-run", "Just show the pipeline that will be uploaded").
 		BoolVar(&uploadCommand.DryRun)
 
+	uploadCommandClause.
+		Flag("output", "The format the signed pipeline is shown in with --dry-run, either json or yaml. With yaml the pipeline is printed rather than passed to the agent").
+		Default(outputFormatJSON).
+		EnumVar(&uploadCommand.Output, outputFormatJSON, outputFormatYAML)
+
+	uploadCommandClause.
+		Flag("format", "The format of the pipeline to process, either pipeline for a YAML or JSON pipeline, or ndjson for steps given as one JSON object per line").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_FORMAT`).
+		Default(inputFormatPipeline).
+		EnumVar(&uploadCommand.Format, inputFormatPipeline, inputFormatNDJSON)
+
+	uploadCommandClause.
+		Flag("save-signed", "Also write the signed pipeline to this path before it's uploaded, e.g. to keep it as a build artifact").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SAVE_SIGNED`).
+		StringVar(&uploadCommand.SaveSigned)
+
+	uploadCommandClause.
+		Flag("preserve-order", "Keep the top level keys of the signed pipeline in the order of the original, rather than sorted").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_PRESERVE_ORDER`).
+		BoolVar(&uploadCommand.PreserveOrder)
+
 	uploadCommandClause.
 		Flag("replace", "Replace the rest of the existing pipeline with the steps uploaded.").
 		BoolVar(&uploadCommand.Replace)
 
-	verifyCommand := &verifyCommand{}
-	app.Command("verify", "Verify a job contains a signature").Action(verifyCommand.run)
+	uploadCommandClause.
+		Flag("replace-requires-signatures", "Fail a --replace upload if any command step in it would be unsigned").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_REPLACE_REQUIRES_SIGNATURES`).
+		BoolVar(&uploadCommand.ReplaceRequiresSignatures)
 
-	app.PreAction(func(c *kingpin.ParseContext) error {
-		if sharedSecret == "" && awsSharedSecretId == "" {
-			return errors.New("One of --shared-secret or --aws-sm-shared-secret-id must be provided")
-		}
-		return nil
-	})
+	uploadCommandClause.
+		Flag("summary", "Log how many steps were signed once uploaded").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_UPLOAD_SUMMARY`).
+		BoolVar(&uploadCommand.Summary)
 
-	// This happens after parse, we need to create a signer object for all of our
-	// commands.
-	app.Action(func(c *kingpin.ParseContext) error {
-		signingSecret := sharedSecret
+	verifyCommandClause := app.Command("verify", "Verify a job contains a signature").
+		PreAction(configureSigner).
+		Action(verifyCommand.run)
+
+	verifyCommandClause.
+		Flag("signature-env-fallback", "Additional env vars to read the signature from if STEP_SIGNATURE isn't set, e.g. when migrating env names").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SIGNATURE_ENV_FALLBACK`).
+		StringsVar(&verifyCommand.SignatureEnvFallbacks)
+
+	verifyCommandClause.
+		Flag("allow-unsigned-command", "A command that is allowed to run without a signature, must match exactly").
+		StringsVar(&verifyCommand.AllowedUnsignedCommands)
+
+	verifyCommandClause.
+		Flag("unsigned-allowlist-file", "A file of glob patterns, one per line, of commands that are allowed to run without a signature, e.g. scripts/bootstrap-*.sh").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_UNSIGNED_ALLOWLIST_FILE`).
+		ExistingFileVar(&verifyCommand.UnsignedAllowlistFile)
+
+	verifyCommandClause.
+		Flag("use-agent-api", "Fetch the command and plugins from the agent API using BUILDKITE_AGENT_ACCESS_TOKEN when they're missing from the environment").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_USE_AGENT_API`).
+		BoolVar(&verifyCommand.UseAgentAPI)
+
+	verifyCommandClause.
+		Flag("verify-only", "Only verify steps with a key or label matching this regular expression, e.g. when gradually adopting signing").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VERIFY_ONLY`).
+		RegexpVar(&verifyCommand.VerifyOnly)
+
+	verifyCommandClause.
+		Flag("verify-env-file", "Read the job being verified from a JSON or KEY=value file rather than the environment, e.g. to reproduce a verification offline").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VERIFY_ENV_FILE`).
+		ExistingFileVar(&verifyCommand.EnvFile)
+
+	verifyCommandClause.
+		Flag("summary", "Log a single PASS or FAIL summary line for the job, e.g. when verifying from a container entrypoint").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VERIFY_SUMMARY`).
+		BoolVar(&verifyCommand.Summary)
+
+	verifyCommandClause.
+		Flag("allow-signature-list", "Accept a comma separated list of signatures precomputed when signing, any of which may match, e.g. for known agent rewrites of the command").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_ALLOW_SIGNATURE_LIST`).
+		BoolVar(&verifyCommand.AllowSignatureList)
+
+	verifyCommandClause.
+		Flag("accept-legacy", "Also accept signatures made by older versions that didn't bind them to the build, logging a deprecation warning, e.g. while upgrading a fleet of agents").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_ACCEPT_LEGACY`).
+		BoolVar(&verifyCommand.AcceptLegacy)
+
+	verifyCommandClause.
+		Flag("read-command-file", "Read the command from BUILDKITE_COMMAND_FILE when BUILDKITE_COMMAND is missing or truncated, e.g. where a hook writes commands too large for the env").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_READ_COMMAND_FILE`).
+		BoolVar(&verifyCommand.ReadCommandFile)
+
+	verifyCommandClause.
+		Flag("explain", "Log a checklist of likely causes tailored to the job when verification fails").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VERIFY_EXPLAIN`).
+		BoolVar(&verifyCommand.Explain)
 
-		if awsSharedSecretId != "" {
-			log.Printf("Using secret from AWS SM %s", awsSharedSecretId)
+	verifyCommandClause.
+		Flag("debug", "Log which decision verification took and why, e.g. when diagnosing why a job passed or failed").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_VERIFY_DEBUG`).
+		BoolVar(&verifyCommand.Debug)
+
+	app.Command("check", "Check that the steps of a pipeline.yml would verify once signed").
+		PreAction(configureSigner).
+		Action(checkCommand.run).
+		Arg("file", "The pipeline.yml to check").
+		Default(".buildkite/pipeline.yml").
+		StringVar(&checkCommand.File)
+
+	app.Command("verify-pipeline", "Verify the signature over the set of steps of a pipeline signed with --sign-pipeline").
+		PreAction(configureSigner).
+		Action(verifyPipelineCommand.run).
+		Arg("file", "The signed pipeline, as JSON or YAML").
+		Required().
+		StringVar(&verifyPipelineCommand.File)
+
+	auditBuildCommandClause := app.Command("audit-build", "Verify the signatures of every command job of a completed build using the REST API").
+		PreAction(configureSigner).
+		Action(auditBuildCommand.run)
+
+	auditBuildCommandClause.
+		Flag("api-token", "A Buildkite REST API token with the read_builds and read_job_env scopes").
+		OverrideDefaultFromEnvar(buildkiteAPITokenEnv).
+		StringVar(&auditBuildCommand.APIToken)
+
+	auditBuildCommandClause.
+		Flag("api-endpoint", "The Buildkite REST API endpoint").
+		Default(defaultRESTEndpoint).
+		Hidden().
+		StringVar(&auditBuildCommand.Endpoint)
+
+	auditBuildCommandClause.
+		Arg("org", "The slug of the organization").
+		Required().
+		StringVar(&auditBuildCommand.Org)
+
+	auditBuildCommandClause.
+		Arg("pipeline", "The slug of the pipeline").
+		Required().
+		StringVar(&auditBuildCommand.Pipeline)
+
+	auditBuildCommandClause.
+		Arg("build", "The number of the build").
+		Required().
+		StringVar(&auditBuildCommand.Build)
+
+	serveCommandClause := app.Command("serve", "Serve a HTTP API that signs pipelines, so the secret can be kept off agents").
+		PreAction(configureSigner).
+		Action(serveCommand.run)
+
+	serveCommandClause.
+		Flag("listen", "The address to listen on, only localhost by default").
+		Default(defaultServeListen).
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SERVE_LISTEN`).
+		StringVar(&serveCommand.Listen)
+
+	serveCommandClause.
+		Flag("token", "A bearer token callers must present").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SERVE_TOKEN`).
+		StringVar(&serveCommand.Token)
+
+	serveCommandClause.
+		Flag("tls-cert", "A certificate to serve TLS with").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SERVE_TLS_CERT`).
+		StringVar(&serveCommand.TLSCert)
+
+	serveCommandClause.
+		Flag("tls-key", "The private key of --tls-cert").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SERVE_TLS_KEY`).
+		StringVar(&serveCommand.TLSKey)
+
+	serveCommandClause.
+		Flag("tls-client-ca", "A CA that callers must present a certificate issued by, for mTLS").
+		OverrideDefaultFromEnvar(`SIGNED_PIPELINE_SERVE_TLS_CLIENT_CA`).
+		StringVar(&serveCommand.TLSClientCA)
+
+	canonicalizeCommand := &canonicalizeCommand{}
+	app.Command("canonicalize", "Print the canonical command and plugins of each step in a pipeline.yml that would be signed").
+		PreAction(func(c *kingpin.ParseContext) error {
+			// canonical content doesn't depend on the secret
 			var err error
-			signingSecret, err = GetAwsSmSecret(awsSharedSecretId)
-			if err != nil {
-				log.Fatal(err)
+			canonicalizeCommand.Signer, err = newSigner("")
+			return err
+		}).
+		Action(canonicalizeCommand.run).
+		Arg("file", "The pipeline.yml to process").
+		Default(".buildkite/pipeline.yml").
+		StringVar(&canonicalizeCommand.File)
+
+	pluginsCommand := &pluginsCommand{}
+	app.Command("plugins", "Print each plugin of a pipeline.yml along with the repository it's normalised to when signed as JSON").
+		Action(pluginsCommand.run).
+		Arg("file", "The pipeline.yml to list the plugins of").
+		Default(".buildkite/pipeline.yml").
+		StringVar(&pluginsCommand.File)
+
+	capabilitiesCommand := &capabilitiesCommand{}
+	app.Command("capabilities", "Print which step types and properties are signed with the current options as JSON").
+		PreAction(func(c *kingpin.ParseContext) error {
+			// coverage doesn't depend on the secret
+			var err error
+			if capabilitiesCommand.Signer, err = newSigner(""); err != nil {
+				return err
 			}
-		}
+			if kmsKeyID != "" {
+				capabilitiesCommand.Signer.format = signatureFormatKMS
+			}
+			return nil
+		}).
+		Action(capabilitiesCommand.run)
 
-		uploadCommand.Signer = NewSharedSecretSigner(signingSecret)
-		verifyCommand.Signer = NewSharedSecretSigner(signingSecret)
-		return nil
+	pubkeyCommand := &pubkeyCommand{}
+	app.Command("pubkey", "Print the PEM encoded public key of a private key file or the KMS key, for distributing to agents").
+		PreAction(func(c *kingpin.ParseContext) error {
+			pubkeyCommand.KmsKeyID = kmsKeyID
+			return nil
+		}).
+		Action(pubkeyCommand.run).
+		Flag("private-key-file", "A PEM encoded RSA, ECDSA or Ed25519 private key").
+		StringVar(&pubkeyCommand.PrivateKeyFile)
+
+	checkSecretCommand := &checkSecretCommand{}
+	app.Command("check-secret", "Check the shared secret can be fetched and decoded, without printing it").
+		PreAction(func(c *kingpin.ParseContext) error {
+			checkSecretCommand.Config = newSecretConfig()
+			checkSecretCommand.KmsKeyID = kmsKeyID
+			return nil
+		}).
+		Action(checkSecretCommand.run)
+
+	whichSecretCommand := &whichSecretCommand{}
+	whichSecretCommandClause := app.Command("which-secret", "Find which of a set of candidate secrets produced a signature, without printing them").
+		PreAction(func(c *kingpin.ParseContext) error {
+			// candidates are fetched and decoded like the configured secret
+			whichSecretCommand.Config = newSecretConfig()
+			var err error
+			whichSecretCommand.Signer, err = newSigner("")
+			return err
+		}).
+		Action(whichSecretCommand.run)
+
+	whichSecretCommandClause.
+		Flag("candidate", "A secret source that may have produced the signature, e.g. env://OLD_SECRET, can be repeated").
+		Required().
+		StringsVar(&whichSecretCommand.Candidates)
+
+	whichSecretCommandClause.
+		Flag("command", "The command of the signed job").
+		OverrideDefaultFromEnvar(buildkiteCommandEnv).
+		StringVar(&whichSecretCommand.Command)
+
+	whichSecretCommandClause.
+		Flag("plugins", "The plugin JSON of the signed job").
+		OverrideDefaultFromEnvar(buildkitePluginsEnv).
+		StringVar(&whichSecretCommand.PluginJSON)
+
+	whichSecretCommandClause.
+		Flag("build-id", "The build the job was signed for").
+		OverrideDefaultFromEnvar(buildkiteBuildIDEnv).
+		StringVar(&whichSecretCommand.BuildID)
+
+	whichSecretCommandClause.
+		Flag("signature", "The signature of the job").
+		OverrideDefaultFromEnvar(stepSignatureEnv).
+		StringVar(&whichSecretCommand.Signature)
+
+	genSecretCommand := &genSecretCommand{}
+	genSecretCommandClause := app.Command("gen-secret", "Generate a strong random shared secret").Action(genSecretCommand.run)
+	genSecretCommandClause.
+		Flag("length", "The number of random bytes in the secret").
+		Default("32").
+		IntVar(&genSecretCommand.Length)
+
+	genSecretCommandClause.
+		Flag("out", "Write the secret to a file rather than stdout").
+		StringVar(&genSecretCommand.Out)
+
+	app.PreAction(func(c *kingpin.ParseContext) error {
+		if warningsFile == "" {
+			return nil
+		}
+		return openWarningsFile(warningsFile)
 	})
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 }
 
 type uploadCommand struct {
-	Signer  *SharedSecretSigner
-	File    *os.File
-	DryRun  bool
-	Replace bool
+	Signer                    *SharedSecretSigner
+	File                      *os.File
+	URL                       string
+	Headers                   []string
+	DryRun                    bool
+	Replace                   bool
+	ReplaceRequiresSignatures bool
+	Summary                   bool
+	SignOnly                  *regexp.Regexp
+	OnlyKeys                  []string
+	Validate                  bool
+	Output                    string
+	PreserveOrder             bool
+	Format                    string
+	SaveSigned                string
+	SecretFromStdin           bool
+	SignerURL                 string
+	SignerToken               string
+	SignerCACert              string
+	SignerClientCert          string
+	SignerClientKey           string
 }
 
 func (l *uploadCommand) run(c *kingpin.ParseContext) error {
@@ -92,21 +825,108 @@ func (l *uploadCommand) run(c *kingpin.ParseContext) error {
 	// Sign output
 	// Exec `buildkite-agent pipeline upload with stdin`
 
-	parsed, err := getPipelineFromBuildkiteAgent(l.File)
+	if l.Output == outputFormatYAML && !l.DryRun {
+		log.Fatal("--output yaml can only be used with --dry-run, the agent is always given JSON")
+	}
+
+	// the agent reads a pipeline from stdin when it isn't given a file
+	if l.SecretFromStdin && l.File == nil && l.URL == "" {
+		log.Fatal("The pipeline must be given as a file or with --url when the secret is read from stdin")
+	}
+
+	if l.URL != "" {
+		if l.File != nil {
+			log.Fatal("Only one of a file or --url can be provided")
+		}
+		log.Printf("Downloading pipeline from %s", l.URL)
+		f, err := downloadPipeline(&http.Client{Timeout: 30 * time.Second}, l.URL, l.Headers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		l.File = f
+	}
+
+	if l.Format == inputFormatNDJSON {
+		var r io.Reader = os.Stdin
+		if l.File != nil {
+			r = l.File
+		}
+		f, err := ndjsonPipelineFile(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		l.File = f
+	}
+
+	parsed, err := getPipelineFromBuildkiteAgent(l.File, l.PreserveOrder)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	signed, err := l.Signer.Sign(parsed)
+	// steps are filtered after interpolation, so keys may come from variables
+	if keys := parseOnlyKeys(l.OnlyKeys); len(keys) > 0 {
+		if err := onlyStepKeys(parsed, keys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var signed interface{}
+	var report *SignReport
+	if l.SignerURL != "" {
+		signed, err = l.signRemotely(parsed)
+	} else {
+		l.Signer.signOnly = l.SignOnly
+		signed, report, err = l.Signer.SignWithReport(parsed)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	outputJSON, err := json.Marshal(signed)
+	if l.Replace {
+		if err := checkReplacement(signed, l.ReplaceRequiresSignatures); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if l.Validate {
+		outputJSON, err := marshalPipeline(signed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := validateSignedPipeline(outputJSON); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if l.Output == outputFormatYAML {
+		outputYAML, err := marshalPipelineYAML(signed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := l.saveSigned(outputYAML); err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(outputYAML)
+		if l.Summary {
+			l.logSummary(report)
+		}
+		return nil
+	}
+
+	outputJSON, err := marshalPipeline(signed)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// saved before uploading, so the pipeline is kept even if the upload fails
+	if err := l.saveSigned(outputJSON); err != nil {
+		log.Fatal(err)
+	}
+
 	// interpolation is disabled to avoid expanding variables twice
 	uploadArgs := []string{"pipeline", "upload", "--no-interpolation"}
 
@@ -127,34 +947,284 @@ func (l *uploadCommand) run(c *kingpin.ParseContext) error {
 		log.Fatal(err)
 	}
 
+	if l.Summary {
+		l.logSummary(report)
+	}
+
 	return nil
 }
 
+// saveSigned writes the exact bytes of the signed pipeline to --save-signed, so
+// they can be kept as a build artifact
+func (l *uploadCommand) saveSigned(signed []byte) error {
+	if l.SaveSigned == "" {
+		return nil
+	}
+	if err := os.WriteFile(l.SaveSigned, signed, 0644); err != nil {
+		return fmt.Errorf("Unable to save the signed pipeline: %v", err)
+	}
+	log.Printf("Saved the signed pipeline to %s", l.SaveSigned)
+	return nil
+}
+
+// signRemotely has the signer service sign the pipeline for the current build
+func (l *uploadCommand) signRemotely(parsed interface{}) (interface{}, error) {
+	if l.SignOnly != nil {
+		return nil, errors.New("--sign-only can't be used with --signer-url, the signer service decides which steps are signed")
+	}
+
+	client, err := newRemoteSignerClient(l.SignerCACert, l.SignerClientCert, l.SignerClientKey)
+	if err != nil {
+		return nil, err
+	}
+	remote := remoteSigner{URL: l.SignerURL, Token: l.SignerToken, HTTPClient: client}
+
+	pipelineJSON, err := marshalPipeline(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Signing the pipeline with the signer service at %s", l.SignerURL)
+	signedJSON, err := remote.Sign(pipelineJSON, os.Getenv(buildkiteBuildIDEnv), os.Getenv(buildkitePipelineSlugEnv))
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := parsePipeline(signedJSON, l.PreserveOrder)
+	if err != nil {
+		return nil, fmt.Errorf("🚨 The signer service returned a pipeline that isn't valid JSON: %v", err)
+	}
+	return signed, nil
+}
+
+// logSummary logs which steps were signed, steps signed by the signer service
+// are only reported by the service
+func (l *uploadCommand) logSummary(report *SignReport) {
+	if report == nil {
+		log.Printf("The pipeline was signed by the signer service at %s", l.SignerURL)
+		return
+	}
+	log.Println(report)
+}
+
 type verifyCommand struct {
-	Signer *SharedSecretSigner
+	Signer                  *SharedSecretSigner
+	EnvFile                 string
+	UnsignedAllowlistFile   string
+	SignatureEnvFallbacks   []string
+	AllowedUnsignedCommands []string
+	UseAgentAPI             bool
+	Summary                 bool
+	Debug                   bool
+	Explain                 bool
+	AllowSignatureList      bool
+	AcceptLegacy            bool
+	ReadCommandFile         bool
+	VerifyOnly              *regexp.Regexp
 }
 
 func (v *verifyCommand) run(c *kingpin.ParseContext) error {
-	command := os.Getenv(`BUILDKITE_COMMAND`)
-	pluginJSON := os.Getenv(`BUILDKITE_PLUGINS`)
-	sig := os.Getenv(stepSignatureEnv)
-
-	if command == "" && pluginJSON == "" {
-		log.Println("No command or plugins set")
-		return nil
+	env, err := v.readEnv()
+	if err != nil {
+		return err
+	}
+	v.Signer.allowedUnsignedCommands = v.AllowedUnsignedCommands
+	if v.UnsignedAllowlistFile != "" {
+		patterns, err := readUnsignedAllowlistFile(v.UnsignedAllowlistFile)
+		if err != nil {
+			return err
+		}
+		v.Signer.unsignedAllowlist = patterns
 	}
+	v.Signer.debugVerify = v.Debug
+	v.Signer.allowSignatureList = v.AllowSignatureList
+	v.Signer.acceptLegacy = v.AcceptLegacy
 
-	err := v.Signer.Verify(command, pluginJSON, Signature(sig))
+	result, err := v.verify(&env)
+	if v.Summary {
+		log.Println(verifySummary(env, result, err))
+	}
+	if err != nil && v.Explain {
+		log.Println(explainVerifyFailure(env, err))
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	log.Println("Signature matched")
+	log.Println(result)
+
+	return nil
+}
+
+// readEnv reads the job being verified, from --verify-env-file if it's given.
+// The signer then reads the job from the file too, including the build ID the
+// signature is bound to, which was otherwise read from the environment.
+func (v *verifyCommand) readEnv() (verifyEnv, error) {
+	if v.EnvFile == "" {
+		return readVerifyEnv(v.SignatureEnvFallbacks), nil
+	}
+	getenv, err := readVerifyEnvFile(v.EnvFile)
+	if err != nil {
+		return verifyEnv{}, err
+	}
+	env := readVerifyEnvWith(getenv, v.SignatureEnvFallbacks)
+	v.Signer.getenv = getenv
+	v.Signer.buildID = env.BuildID
+	return env, nil
+}
+
+// verify checks the signature of the job, returning a description of the outcome
+func (v *verifyCommand) verify(env *verifyEnv) (string, error) {
+	if env.CommandFile != "" && !v.ReadCommandFile {
+		warnf("⚠️ Ignoring %s, it's only read with --read-command-file", buildkiteCommandFileEnv)
+	} else if env.CommandFile != "" {
+		command, err := readCommandFile(env.CommandFile, env.Command)
+		if err != nil {
+			return "", err
+		}
+		env.Command = command
+	}
+
+	if v.UseAgentAPI {
+		client, err := newAgentAPIClientFromEnv()
+		if err != nil {
+			return "", err
+		}
+		env.Command, env.PluginJSON, err = fillFromAgentAPI(client, env.JobID, env.Command, env.PluginJSON)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if env.Command == "" && env.PluginJSON == "" {
+		return "No command or plugins set", nil
+	}
+
+	if v.VerifyOnly != nil && !identityMatches(v.VerifyOnly, env.StepKey, env.Label) {
+		return "Step key and label don't match --verify-only, skipping verification", nil
+	}
+
+	if env.Signature == "" && v.Signer.isIgnoredStepKey(env.StepKey) {
+		return fmt.Sprintf("⚠️ Step key %q is ignored by --ignore-step-key, allowing it to run unsigned", env.StepKey), nil
+	}
+
+	if err := v.Signer.Verify(env.Command, env.PluginJSON, env.Signature); err != nil {
+		return "", err
+	}
+
+	return "Signature matched", nil
+}
+
+// marshalPipeline encodes a signed pipeline as JSON, describing where in the
+// pipeline any value that can't be encoded is
+func marshalPipeline(pipeline interface{}) ([]byte, error) {
+	b, err := json.Marshal(pipeline)
+	if err == nil {
+		return b, nil
+	}
+	if path, value, found := findUnencodable(pipeline, ""); found {
+		return nil, fmt.Errorf("Unable to encode the signed pipeline, %s has a value of type %T that can't be encoded as JSON: %v", path, value, err)
+	}
+	return nil, fmt.Errorf("Unable to encode the signed pipeline: %v", err)
+}
+
+// marshalPipelineYAML encodes a signed pipeline as YAML, for reading or keeping
+// in git. It's encoded through JSON so it has the values the agent would see.
+func marshalPipelineYAML(pipeline interface{}) ([]byte, error) {
+	if _, err := marshalPipeline(pipeline); err != nil {
+		return nil, err
+	}
+
+	if ordered, ok := pipeline.(*orderedPipeline); ok {
+		node, err := ordered.yamlNode()
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(node)
+	}
+
+	normalised, err := normaliseJSON(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(normalised)
+}
+
+// findUnencodable returns the path of the first value in the pipeline that
+// can't be encoded as JSON
+func findUnencodable(value interface{}, path string) (string, interface{}, bool) {
+	switch v := value.(type) {
+	case *orderedPipeline:
+		return findUnencodable(v.Values, path)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if found, child, ok := findUnencodable(v[key], childPath); ok {
+				return found, child, true
+			}
+		}
+		return "", nil, false
+	case []interface{}:
+		for i, item := range v {
+			if found, child, ok := findUnencodable(item, fmt.Sprintf("%s[%d]", path, i)); ok {
+				return found, child, true
+			}
+		}
+		return "", nil, false
+	}
+
+	if _, err := json.Marshal(value); err != nil {
+		return path, value, true
+	}
+	return "", nil, false
+}
+
+// checkReplacement warns that the remaining steps of the build are being
+// replaced, optionally failing if any of the replacement steps are unsigned
+func checkReplacement(signed interface{}, requireSignatures bool) error {
+	warnf("⚠️ --replace will replace the remaining steps of this build with the uploaded steps")
+
+	unsigned := unsignedCommandSteps(signed)
+	if len(unsigned) == 0 {
+		return nil
+	}
 
+	if requireSignatures {
+		return fmt.Errorf("🚨 Refusing to replace the pipeline, %d steps would be unsigned: %s",
+			len(unsigned), strings.Join(unsigned, ", "))
+	}
+	warnf("⚠️ %d replacement steps are unsigned: %s", len(unsigned), strings.Join(unsigned, ", "))
 	return nil
 }
 
-func getPipelineFromBuildkiteAgent(f *os.File) (interface{}, error) {
+// lookupSignature returns the signature from STEP_SIGNATURE, or failing that the
+// first of the fallback env vars that is set
+func lookupSignature(fallbacks []string) Signature {
+	return lookupSignatureWith(os.Getenv, fallbacks)
+}
+
+// lookupSignatureWith is lookupSignature reading the environment with getenv
+func lookupSignatureWith(getenv func(string) string, fallbacks []string) Signature {
+	for _, env := range append([]string{stepSignatureEnv}, fallbacks...) {
+		if sig := strings.TrimSpace(getenv(env)); sig != "" {
+			if env != stepSignatureEnv {
+				log.Printf("Using signature from fallback env %s", env)
+			}
+			return Signature(sig)
+		}
+	}
+	return ""
+}
+
+func getPipelineFromBuildkiteAgent(f *os.File, preserveOrder bool) (interface{}, error) {
 	args := []string{"pipeline", "upload", "--dry-run"}
 
 	// handle an optional path to a pipeline.yml
@@ -176,10 +1246,27 @@ func getPipelineFromBuildkiteAgent(f *os.File) (interface{}, error) {
 		return nil, err
 	}
 
-	var parsed interface{}
-	if err := json.Unmarshal(out.Bytes(), &parsed); err != nil {
-		return nil, err
+	return parsePipeline(out.Bytes(), preserveOrder)
+}
+
+// positiveIntValue is a flag value that must be a whole number of at least 1,
+// such as a number of attempts
+type positiveIntValue struct {
+	value *int
+}
+
+func (v *positiveIntValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%q isn't a whole number", s)
+	}
+	if n < 1 {
+		return fmt.Errorf("must be at least 1, got %d", n)
 	}
+	*v.value = n
+	return nil
+}
 
-	return parsed, nil
+func (v *positiveIntValue) String() string {
+	return strconv.Itoa(*v.value)
 }
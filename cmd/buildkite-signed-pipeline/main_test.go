@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLookupSignatureFromFallbackEnv(t *testing.T) {
+	t.Setenv(stepSignatureEnv, "")
+	t.Setenv("OLD_STEP_SIGNATURE", "")
+	t.Setenv("NEW_STEP_SIGNATURE", "llamas")
+
+	sig := lookupSignature([]string{"OLD_STEP_SIGNATURE", "NEW_STEP_SIGNATURE"})
+	assert.Equal(t, Signature("llamas"), sig)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		return Signature("llamas"), nil
+	}
+	assert.Nil(t, signer.Verify("echo hello world", "", sig))
+}
+
+func TestLookupSignaturePrefersPrimaryEnv(t *testing.T) {
+	t.Setenv(stepSignatureEnv, "primary")
+	t.Setenv("OLD_STEP_SIGNATURE", "fallback")
+
+	assert.Equal(t, Signature("primary"), lookupSignature([]string{"OLD_STEP_SIGNATURE"}))
+}
+
+func TestLookupSignatureTrimsWhitespace(t *testing.T) {
+	t.Setenv(stepSignatureEnv, "llamas\n")
+	assert.Equal(t, Signature("llamas"), lookupSignature(nil))
+
+	// a signature that's only whitespace is missing
+	t.Setenv(stepSignatureEnv, "\n")
+	t.Setenv("OLD_STEP_SIGNATURE", "fallback")
+	assert.Equal(t, Signature("fallback"), lookupSignature([]string{"OLD_STEP_SIGNATURE"}))
+}
+
+func TestCheckReplacementRequiresSignatures(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[{"command":"echo hello"},"wait",{"block":"Deploy?"},{"key":"no-command","label":"I have no commands"}]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.EqualError(t, checkReplacement(signed, true), "🚨 Refusing to replace the pipeline, 1 steps would be unsigned: no-command")
+
+	// without the strict flag it's only a warning
+	assert.Nil(t, checkReplacement(signed, false))
+}
+
+func TestCheckReplacementAllSigned(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[{"command":"echo hello"},"wait",{"group":"Tests","steps":[{"command":"make test"}]}]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, checkReplacement(signed, true))
+}
+
+func TestMarshalPipelineDescribesUnencodableValues(t *testing.T) {
+	pipeline := map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"command": "echo hello"},
+			map[string]interface{}{
+				"command": "echo world",
+				"env":     map[string]interface{}{"BROKEN": make(chan int)},
+			},
+		},
+	}
+
+	_, err := marshalPipeline(pipeline)
+	assert.EqualError(t, err, "Unable to encode the signed pipeline, steps[1].env.BROKEN has a value of type chan int "+
+		"that can't be encoded as JSON: json: unsupported type: chan int")
+
+	b, err := marshalPipeline(map[string]interface{}{"steps": []interface{}{"wait"}})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"steps":["wait"]}`, string(b))
+}
+
+func TestMarshalPipelineYAMLRoundTrip(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	var pipeline interface{}
+	if err := yaml.Unmarshal([]byte(`
+env:
+  GLOBAL: "1"
+steps:
+  - label: Test
+    command: |
+      make deps
+      make test
+    env:
+      RETRIES: 3
+    plugins:
+      - docker#v3.8.0:
+          image: golang
+  - wait
+  - label: Deploy
+    commands:
+      - make deploy
+`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := marshalPipelineYAML(signed)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "STEP_SIGNATURE: ")
+
+	var parsed interface{}
+	if err := yaml.Unmarshal(b, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the YAML parses back to the same pipeline as the JSON given to the agent
+	var fromJSON interface{}
+	jsonBytes, err := marshalPipeline(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(jsonBytes, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fromJSON, parsed)
+
+	// and the signatures survive the round trip
+	verified := 0
+	walkSteps(parsed, func(step map[string]interface{}) {
+		if sig, ok := stepSignature(step); ok {
+			assert.Nil(t, verifyStepLocally(*signer, step, sig), stepName(step))
+			verified++
+		}
+	})
+	assert.Equal(t, 2, verified)
+}
+
+// fakeBuildkiteAgent puts a buildkite-agent on the PATH that outputs the given
+// pipeline file for a dry run, and otherwise writes what it's given on stdin
+// to the returned path
+func fakeBuildkiteAgent(t *testing.T) string {
+	dir := t.TempDir()
+	stdinPath := filepath.Join(dir, "stdin")
+	script := `#!/bin/sh
+if [ "$3" = "--dry-run" ]; then
+  cat "$4"
+  exit 0
+fi
+cat > "` + stdinPath + `"
+`
+	if err := os.WriteFile(filepath.Join(dir, "buildkite-agent"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return stdinPath
+}
+
+func TestUploadSavesSignedPipeline(t *testing.T) {
+	agentStdin := fakeBuildkiteAgent(t)
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	f, err := os.Open(writePipelineFile(t, `{"steps":[{"label":"test","command":"make test"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	savePath := filepath.Join(t.TempDir(), "signed.json")
+	upload := &uploadCommand{
+		Signer:     NewSharedSecretSigner("secret-llamas"),
+		File:       f,
+		Output:     outputFormatJSON,
+		SaveSigned: savePath,
+		Validate:   true,
+	}
+	assert.Nil(t, upload.run(nil))
+
+	uploaded, err := os.ReadFile(agentStdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uploaded, saved)
+	assert.Contains(t, string(saved), stepSignatureEnv)
+}
+
+func TestUploadOnlyKeys(t *testing.T) {
+	agentStdin := fakeBuildkiteAgent(t)
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	f, err := os.Open(writePipelineFile(t, `{"steps":[`+
+		`{"key":"lint","command":"make lint"},"wait",`+
+		`{"key":"test","command":"make test"},"wait",`+
+		`{"key":"deploy","command":"make deploy"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	upload := &uploadCommand{
+		Signer:   NewSharedSecretSigner("secret-llamas"),
+		File:     f,
+		Output:   outputFormatJSON,
+		OnlyKeys: []string{"lint,deploy"},
+	}
+	assert.Nil(t, upload.run(nil))
+
+	uploaded, err := os.ReadFile(agentStdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := parsePipeline(uploaded, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	walkSteps(pipeline, func(step map[string]interface{}) {
+		if key, ok := step["key"].(string); ok {
+			keys = append(keys, key)
+			_, signed := stepSignature(step)
+			assert.True(t, signed, key)
+		}
+	})
+	assert.Equal(t, []string{"lint", "deploy"}, keys)
+	assert.NotContains(t, string(uploaded), "make test")
+	assert.Len(t, stepSignatures(pipeline), 2)
+}
+
+func TestPositiveIntFlag(t *testing.T) {
+	var attempts int
+	app := kingpin.New("test", "")
+	app.Flag("attempts", "").Default("5").SetValue(&positiveIntValue{&attempts})
+
+	_, err := app.Parse(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, attempts)
+
+	_, err = app.Parse([]string{"--attempts", "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+
+	for _, value := range []string{"0", "-1", "many"} {
+		_, err = app.Parse([]string{"--attempts", value})
+		assert.NotNil(t, err, value)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	inputFormatPipeline = `pipeline`
+	inputFormatNDJSON   = `ndjson`
+)
+
+// ndjsonPipeline assembles a pipeline from newline-delimited JSON, one step
+// object per line, as emitted by some pipeline generators. Blank lines are
+// skipped and steps are kept exactly as given.
+func ndjsonPipeline(r io.Reader) ([]byte, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxSignRequestBytes)
+
+	var steps []json.RawMessage
+	for line := 1; scanner.Scan(); line++ {
+		step := bytes.TrimSpace(scanner.Bytes())
+		if len(step) == 0 {
+			continue
+		}
+		if step[0] != '{' || !json.Valid(step) {
+			return nil, fmt.Errorf("Line %d of the NDJSON steps isn't a JSON object", line)
+		}
+		steps = append(steps, append(json.RawMessage(nil), step...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read the NDJSON steps: %v", err)
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("No steps found in the NDJSON input")
+	}
+
+	return json.Marshal(map[string]interface{}{"steps": steps})
+}
+
+// ndjsonPipelineFile writes the pipeline assembled from NDJSON steps to a
+// temporary file, so it can be given to the agent like any other pipeline
+func ndjsonPipelineFile(r io.Reader) (*os.File, error) {
+	pipeline, err := ndjsonPipeline(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "pipeline-*.json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(pipeline); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
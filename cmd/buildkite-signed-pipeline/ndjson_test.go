@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNDJSONPipeline(t *testing.T) {
+	input := `{"label":"build","command":"make"}
+
+{"label":"test","commands":["make test"],"plugins":[{"docker#v3.0.0":{"image":"golang"}}]}   ` + "\r\n" +
+		"   \n" +
+		`{"label":"deploy","command":"make deploy","timeout_in_minutes":10}`
+
+	pipelineJSON, err := ndjsonPipeline(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := parsePipeline(pipelineJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signed, report, err := signer.SignWithReport(pipeline)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Signed)
+
+	var labels []string
+	walkSteps(signed, func(step map[string]interface{}) {
+		labels = append(labels, step["label"].(string))
+		sig, ok := stepSignature(step)
+		assert.True(t, ok, "step %s wasn't signed", step["label"])
+		assert.Nil(t, verifyStepLocally(*signer, step, sig))
+	})
+	assert.Equal(t, []string{"build", "test", "deploy"}, labels)
+}
+
+func TestNDJSONPipelineInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		input string
+		err   string
+	}{
+		"array":     {`{"command":"make"}` + "\n" + `["make test"]`, "Line 2 of the NDJSON steps isn't a JSON object"},
+		"string":    {`"wait"`, "Line 1 of the NDJSON steps isn't a JSON object"},
+		"truncated": {`{"command":"make"`, "Line 1 of the NDJSON steps isn't a JSON object"},
+		"two steps": {`{"command":"make"} {"command":"make test"}`, "Line 1 of the NDJSON steps isn't a JSON object"},
+		"empty":     {"\n  \n", "No steps found in the NDJSON input"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ndjsonPipeline(strings.NewReader(tc.input))
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
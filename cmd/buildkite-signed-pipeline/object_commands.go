@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// objectCommandExtractor flattens a command given as an object, which Buildkite
+// doesn't support, to the string command that's signed and uploaded in its
+// place. It reports false if it doesn't handle the shape of the object.
+type objectCommandExtractor func(command map[string]interface{}) (string, bool, error)
+
+// runArgsCommand flattens a command of the form {run: ./deploy.sh, args: [prod]}
+// to the run command followed by its args, quoted for the shell
+func runArgsCommand(command map[string]interface{}) (string, bool, error) {
+	run, ok := command["run"].(string)
+	if !ok {
+		return "", false, nil
+	}
+	for key := range command {
+		if key != "run" && key != "args" {
+			return "", true, fmt.Errorf("Unexpected key %q in command object, only run and args are supported", key)
+		}
+	}
+
+	parts := []string{run}
+	switch args := command["args"].(type) {
+	case nil:
+	case []interface{}:
+		for i, arg := range args {
+			value, err := canonicalFieldValue(arg)
+			if err != nil {
+				return "", true, fmt.Errorf("Unexpected type for command arg %d: %T", i, arg)
+			}
+			parts = append(parts, shellQuote(value))
+		}
+	default:
+		return "", true, fmt.Errorf("Unexpected type for command args: %T", args)
+	}
+	return strings.Join(parts, " "), true, nil
+}
+
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./=:,@%+-]+$`)
+
+// shellQuote quotes an argument for the shell, unless it only contains
+// characters the shell doesn't interpret
+func shellQuote(arg string) string {
+	if shellSafeRegex.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// flattenObjectCommand flattens a command object with the first of the
+// configured extractors that handles it
+func (s SharedSecretSigner) flattenObjectCommand(command map[string]interface{}) (string, error) {
+	for _, extractor := range s.objectCommandExtractors {
+		flattened, ok, err := extractor(command)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return flattened, nil
+		}
+	}
+
+	keys := make([]string, 0, len(command))
+	for key := range command {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return "", fmt.Errorf("Unexpected command object with keys %s, commands must be a string or a list of strings",
+		strings.Join(keys, ", "))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectCommands(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	const pipelineJSON = `{"steps":[{"label":"Deploy","command":{"run":"./deploy.sh","args":["prod","it's live",3]}}]}`
+
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(pipelineJSON), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	// unsupported by default, with an error naming the step
+	signer := NewSharedSecretSigner("secret-llamas")
+	_, err := signer.Sign(pipeline)
+	assert.EqualError(t, err, `Step "Deploy": Unexpected command object with keys args, run, commands must be a string or a list of strings`)
+
+	// flattened to the command that's signed and uploaded in its place
+	signer.objectCommandExtractors = []objectCommandExtractor{runArgsCommand}
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, `./deploy.sh prod 'it'\''s live' 3`, step["command"])
+
+	signature, _ := stepSignature(step)
+	assert.Nil(t, signer.Verify(`./deploy.sh prod 'it'\''s live' 3`, "", signature))
+	assert.Equal(t, errSignatureMismatch, signer.Verify(`./deploy.sh staging 'it'\''s live' 3`, "", signature))
+
+	// the original pipeline isn't modified
+	original := pipeline.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+	assert.IsType(t, map[string]interface{}{}, original["command"])
+}
+
+func TestRunArgsCommand(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Command  string
+		Expected string
+		Handled  bool
+		Err      string
+	}{
+		{"run only", `{"run":"make test"}`, "make test", true, ""},
+		{"quoted args", `{"run":"echo","args":["a b","$HOME","",true]}`, `echo 'a b' '$HOME' '' true`, true, ""},
+		{"other shape", `{"script":"make test"}`, "", false, ""},
+		{"unknown key", `{"run":"make","env":{"A":"1"}}`, "", true, `Unexpected key "env" in command object, only run and args are supported`},
+		{"nested arg", `{"run":"make","args":[["a"]]}`, "", true, "Unexpected type for command arg 0: []interface {}"},
+		{"args not a list", `{"run":"make","args":"test"}`, "", true, "Unexpected type for command args: string"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var command map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.Command), &command); err != nil {
+				t.Fatal(err)
+			}
+
+			flattened, handled, err := runArgsCommand(command)
+			assert.Equal(t, tc.Handled, handled)
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, flattened)
+		})
+	}
+}
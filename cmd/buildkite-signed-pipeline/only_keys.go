@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseOnlyKeys parses step keys given as a comma separated list, which may be
+// repeated
+func parseOnlyKeys(list []string) []string {
+	var keys []string
+	for _, item := range list {
+		for _, key := range strings.Split(item, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// onlyStepKeys filters a pipeline down to the steps with the given keys, along
+// with the wait steps between them and any block or input steps before them. A
+// group with one of the keys is kept whole, otherwise it's kept with just its
+// steps that have one of the keys.
+func onlyStepKeys(pipeline interface{}, keys []string) error {
+	values, ok := pipelineValues(pipeline)
+	if !ok {
+		return fmt.Errorf("Unexpected type for pipeline: %T", pipeline)
+	}
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = false
+	}
+
+	for key, steps := range values {
+		if !strings.EqualFold(key, "steps") {
+			continue
+		}
+		filtered, err := onlyStepKeysList(steps, wanted)
+		if err != nil {
+			return err
+		}
+		values[key] = filtered
+	}
+
+	var missing []string
+	for key, found := range wanted {
+		if !found {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("No steps with the keys %s in the pipeline", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func onlyStepKeysList(steps interface{}, wanted map[string]bool) ([]interface{}, error) {
+	list, ok := steps.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type for steps: %T", steps)
+	}
+
+	filtered := []interface{}{}
+	var pending []interface{}
+	pendingWait := false
+	for _, item := range list {
+		// a wait is only kept between kept steps, and consecutive waits left
+		// by removed steps are collapsed into the first of them
+		if isWaitStep(item) {
+			if len(filtered) > 0 && !pendingWait {
+				pending = append(pending, item)
+				pendingWait = true
+			}
+			continue
+		}
+
+		kept, err := onlyStepKeysStep(item, wanted)
+		if err != nil {
+			return nil, err
+		}
+		if kept == nil {
+			// a block or input step gates the steps after it, so it's kept
+			// where any of them are
+			if isBlockStep(item) {
+				pending = append(pending, item)
+			}
+			continue
+		}
+		filtered = append(filtered, pending...)
+		filtered = append(filtered, kept)
+		pending, pendingWait = nil, false
+	}
+	return filtered, nil
+}
+
+// onlyStepKeysStep returns the step if it's kept, with a group's steps
+// filtered, or nil if it isn't
+func onlyStepKeysStep(item interface{}, wanted map[string]bool) (interface{}, error) {
+	step, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	key, _ := canonicalFieldValue(stepFieldValue(step, "key"))
+	if _, ok := wanted[key]; ok && key != "" {
+		wanted[key] = true
+		return step, nil
+	}
+
+	if _, isGroup := step["group"]; !isGroup || step["steps"] == nil {
+		return nil, nil
+	}
+	nested, err := onlyStepKeysList(step["steps"], wanted)
+	if err != nil {
+		return nil, err
+	}
+	if len(nested) == 0 {
+		return nil, nil
+	}
+	group := copyMap(step)
+	group["steps"] = nested
+	return group, nil
+}
+
+// isWaitStep reports whether a step is a wait step, either as the string form
+// or as a step with a wait key
+func isWaitStep(item interface{}) bool {
+	switch step := item.(type) {
+	case string:
+		return step == "wait" || step == "waiter"
+	case map[string]interface{}:
+		_, isWait := step["wait"]
+		_, isWaiter := step["waiter"]
+		return isWait || isWaiter
+	}
+	return false
+}
+
+// isBlockStep reports whether a step is a block or input step, either as the
+// string form or as a step with a block or input key
+func isBlockStep(item interface{}) bool {
+	switch step := item.(type) {
+	case string:
+		return step == "block" || step == "input"
+	case map[string]interface{}:
+		_, isBlock := step["block"]
+		_, isInput := step["input"]
+		return isBlock || isInput
+	}
+	return false
+}
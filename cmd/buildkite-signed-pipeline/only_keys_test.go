@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnlyStepKeys(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Pipeline string
+		Keys     []string
+		Expected string
+		Err      string
+	}{
+		{
+			"waits between kept steps",
+			`{"steps":[{"key":"lint","command":"lint"},"wait",{"key":"test","command":"test"},"wait",{"key":"build","command":"build"},"wait",{"key":"deploy","command":"deploy"}]}`,
+			[]string{"lint", "deploy"},
+			`{"steps":[{"key":"lint","command":"lint"},"wait",{"key":"deploy","command":"deploy"}]}`,
+			"",
+		},
+		{
+			"leading and trailing waits",
+			`{"steps":["wait",{"key":"lint","command":"lint"},{"wait":null,"continue_on_failure":true},{"key":"test","command":"test"},"wait"]}`,
+			[]string{"test", "lint"},
+			`{"steps":[{"key":"lint","command":"lint"},{"wait":null,"continue_on_failure":true},{"key":"test","command":"test"}]}`,
+			"",
+		},
+		{
+			"no wait between adjacent steps",
+			`{"steps":[{"key":"lint","command":"lint"},{"key":"test","command":"test"},"wait",{"key":"deploy","command":"deploy"}]}`,
+			[]string{"lint", "test"},
+			`{"steps":[{"key":"lint","command":"lint"},{"key":"test","command":"test"}]}`,
+			"",
+		},
+		{
+			"key aliases and blocks",
+			`{"steps":[{"identifier":"lint","command":"lint"},{"block":"Release"},{"id":"deploy","command":"deploy"}]}`,
+			[]string{"lint,deploy"},
+			`{"steps":[{"identifier":"lint","command":"lint"},{"block":"Release"},{"id":"deploy","command":"deploy"}]}`,
+			"",
+		},
+		{
+			"blocks before kept steps",
+			`{"steps":["block",{"key":"lint","command":"lint"},"wait",{"key":"test","command":"test"},{"input":"Version"},"wait",{"key":"deploy","command":"deploy"},{"block":"Cleanup"}]}`,
+			[]string{"lint", "deploy"},
+			`{"steps":["block",{"key":"lint","command":"lint"},"wait",{"input":"Version"},{"key":"deploy","command":"deploy"}]}`,
+			"",
+		},
+		{
+			"groups",
+			`{"steps":[{"group":"Tests","steps":[{"key":"unit","command":"unit"},"wait",{"key":"e2e","command":"e2e"}]},{"group":"Deploy","key":"deploy","steps":[{"command":"deploy"}]},{"group":"Other","steps":[{"key":"other","command":"other"}]}]}`,
+			[]string{"e2e", "deploy"},
+			`{"steps":[{"group":"Tests","steps":[{"key":"e2e","command":"e2e"}]},{"group":"Deploy","key":"deploy","steps":[{"command":"deploy"}]}]}`,
+			"",
+		},
+		{
+			"unknown keys",
+			`{"steps":[{"key":"lint","command":"lint"}]}`,
+			[]string{"lint", "tset", "bulid"},
+			"",
+			"No steps with the keys bulid, tset in the pipeline",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var pipeline interface{}
+			if err := json.Unmarshal([]byte(tc.Pipeline), &pipeline); err != nil {
+				t.Fatal(err)
+			}
+
+			err := onlyStepKeys(pipeline, parseOnlyKeys(tc.Keys))
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.Nil(t, err)
+
+			filtered, err := json.Marshal(pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.JSONEq(t, tc.Expected, string(filtered))
+		})
+	}
+}
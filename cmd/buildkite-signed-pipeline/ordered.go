@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// orderedPipeline is a pipeline that keeps the order of its top level keys, so
+// the signed pipeline reads like the pipeline it was signed from. Go maps have
+// no order and encoding/json sorts their keys, so the order is tracked apart
+// from the values.
+type orderedPipeline struct {
+	Keys   []string
+	Values map[string]interface{}
+}
+
+// parsePipeline decodes the JSON of a pipeline, optionally keeping the order of
+// its top level keys
+func parsePipeline(b []byte, preserveOrder bool) (interface{}, error) {
+	var parsed interface{}
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return nil, err
+	}
+
+	values, ok := parsed.(map[string]interface{})
+	if !preserveOrder || !ok {
+		return parsed, nil
+	}
+
+	keys, err := topLevelKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	return &orderedPipeline{Keys: keys, Values: values}, nil
+}
+
+// topLevelKeys returns the keys of a JSON object in the order they appear, a
+// key that is repeated is kept where it first appears
+func topLevelKeys(b []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("Expected a JSON object, found %v", tok)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected a JSON object key, found %v", tok)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// orderedKeys returns the keys of the pipeline in order, any that aren't
+// tracked are kept at the end in the order encoding/json would give them
+func (p *orderedPipeline) orderedKeys() []string {
+	keys := make([]string, 0, len(p.Values))
+	for _, key := range p.Keys {
+		if _, ok := p.Values[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	var untracked []string
+	for key := range p.Values {
+		if !containsString(keys, key) {
+			untracked = append(untracked, key)
+		}
+	}
+	sort.Strings(untracked)
+	return append(keys, untracked...)
+}
+
+func (p *orderedPipeline) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range p.orderedKeys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(p.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// yamlNode renders the pipeline as a YAML mapping in order, the values are
+// normalised through JSON so they are those the agent would see
+func (p *orderedPipeline) yamlNode() (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, key := range p.orderedKeys() {
+		value, err := normaliseJSON(p.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		var valueNode yaml.Node
+		if err := valueNode.Encode(value); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &valueNode)
+	}
+	return node, nil
+}
+
+// normaliseJSON returns a value as it would be decoded from its JSON
+func normaliseJSON(value interface{}) (interface{}, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalised interface{}
+	if err := json.Unmarshal(b, &normalised); err != nil {
+		return nil, err
+	}
+	return normalised, nil
+}
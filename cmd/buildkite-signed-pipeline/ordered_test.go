@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testOrderedPipeline = `{
+	"steps": [{"command": "echo hello world"}],
+	"env": {"LLAMAS": "true"},
+	"agents": {"queue": "default"},
+	"notify": [{"email": "llamas@example.com"}]
+}`
+
+func TestSignPreservesTopLevelKeyOrder(t *testing.T) {
+	parsed, err := parsePipeline([]byte(testOrderedPipeline), true)
+	assert.Nil(t, err)
+
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(parsed)
+	assert.Nil(t, err)
+
+	output, err := marshalPipeline(signed)
+	assert.Nil(t, err)
+
+	keys, err := topLevelKeys(output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"steps", "env", "agents", "notify"}, keys)
+
+	// the steps are signed as they would be without the key order
+	assert.Empty(t, unsignedCommandSteps(signed))
+	assert.Contains(t, string(output), `"STEP_SIGNATURE":"sha256:`)
+
+	yamlOutput, err := marshalPipelineYAML(signed)
+	assert.Nil(t, err)
+	assert.Regexp(t, `(?s)^steps:.*\nenv:.*\nagents:.*\nnotify:`, string(yamlOutput))
+}
+
+func TestSignWithoutPreservingOrderSortsKeys(t *testing.T) {
+	parsed, err := parsePipeline([]byte(testOrderedPipeline), false)
+	assert.Nil(t, err)
+
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(parsed)
+	assert.Nil(t, err)
+
+	output, err := marshalPipeline(signed)
+	assert.Nil(t, err)
+
+	keys, err := topLevelKeys(output)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"agents", "env", "notify", "steps"}, keys)
+}
+
+func TestTopLevelKeysRepeated(t *testing.T) {
+	keys, err := topLevelKeys([]byte(`{"steps":[],"env":{"steps":1},"steps":[{"command":"true"}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"steps", "env"}, keys)
+
+	_, err = topLevelKeys([]byte(`["steps"]`))
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), "Expected a JSON object"))
+}
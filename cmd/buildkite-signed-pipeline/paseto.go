@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	pasetoCommandClaim = `command_sha256`
+	pasetoPluginsClaim = `plugins_sha256`
+	pasetoBuildIDClaim = `build_id`
+	pasetoFieldsClaim  = `fields_sha256`
+	pasetoSaltClaim    = `salt`
+
+	// registered claims, times are formatted as RFC 3339
+	pasetoIssuedAtClaim   = `iat`
+	pasetoExpirationClaim = `exp`
+)
+
+// pasetoClaims is the JSON payload of a token, all of its claims are strings
+type pasetoClaims map[string]string
+
+// time returns the time of a registered claim, which is zero if it isn't set
+func (c pasetoClaims) time(name string) (time.Time, error) {
+	value, ok := c[name]
+	if !ok {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("🚨 Signature token has an invalid %s time %q", name, value)
+	}
+	return t, nil
+}
+
+// pasetoKey derives the 32 byte symmetric key required by PASETO v2.local from
+// the signing key
+func (s SharedSecretSigner) pasetoKey() ([]byte, error) {
+	signingKey, err := s.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(signingKey)
+	return key[:], nil
+}
+
+func hashClaim(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+}
+
+// signPaseto produces a PASETO v2.local token carrying hashes of the command and
+// plugins along with the build and the time it was issued
+func (s SharedSecretSigner) signPaseto(content stepContent) (Signature, error) {
+	now := s.currentTime()
+
+	claims := pasetoClaims{
+		pasetoIssuedAtClaim: now.Format(time.RFC3339),
+		pasetoCommandClaim:  hashClaim(canonicalCommand(content.Command)),
+		pasetoPluginsClaim:  hashClaim(content.PluginJSON),
+		pasetoBuildIDClaim:  s.currentBuildID(),
+	}
+	if s.maxAge > 0 {
+		claims[pasetoExpirationClaim] = now.Add(s.maxAge).Format(time.RFC3339)
+	}
+	if len(content.Fields) > 0 {
+		claims[pasetoFieldsClaim] = hashClaim(canonicalStepFields(content.Fields))
+	}
+	if content.Salt != "" {
+		claims[pasetoSaltClaim] = content.Salt
+	}
+
+	key, err := s.pasetoKey()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := pasetoV2Encrypt(key, payload)
+	if err != nil {
+		return "", err
+	}
+	return Signature(encrypted), nil
+}
+
+func (s SharedSecretSigner) verifyPaseto(content stepContent, expected Signature) error {
+	key, err := s.pasetoKey()
+	if err != nil {
+		return err
+	}
+	var claims pasetoClaims
+	payload, err := pasetoV2Decrypt(key, string(expected))
+	if err == nil {
+		err = json.Unmarshal(payload, &claims)
+	}
+	if err != nil {
+		return errors.New("🚨 Signature token could not be decrypted. " +
+			"Perhaps check the shared secret is the same across agents?")
+	}
+
+	now := s.currentTime()
+	issuedAt, err := claims.time(pasetoIssuedAtClaim)
+	if err != nil {
+		return err
+	}
+	expiration, err := claims.time(pasetoExpirationClaim)
+	if err != nil {
+		return err
+	}
+	if !expiration.IsZero() && now.After(expiration) {
+		return fmt.Errorf("🚨 Signature token expired at %s", expiration.Format(time.RFC3339))
+	}
+	if ahead := issuedAt.Sub(now); ahead > allowedClockSkew {
+		return fmt.Errorf("🚨 Signature token was issued %s in the future which exceeds the allowed clock skew of %s",
+			ahead.Round(time.Second), allowedClockSkew)
+	}
+
+	if s.maxAge > 0 {
+		if issuedAt.IsZero() {
+			return errors.New("🚨 Signature token has no issued at time, so its age can't be checked")
+		}
+		if age := now.Sub(issuedAt); age > s.maxAge {
+			return fmt.Errorf("🚨 Signature expired. It was issued %s ago which exceeds the maximum age of %s",
+				age.Round(time.Second), s.maxAge)
+		}
+	}
+
+	expectedFields := ""
+	if len(content.Fields) > 0 {
+		expectedFields = hashClaim(canonicalStepFields(content.Fields))
+	}
+
+	if claims[pasetoCommandClaim] != hashClaim(canonicalCommand(content.Command)) ||
+		claims[pasetoPluginsClaim] != hashClaim(content.PluginJSON) ||
+		claims[pasetoBuildIDClaim] != s.currentBuildID() ||
+		claims[pasetoFieldsClaim] != expectedFields ||
+		claims[pasetoSaltClaim] != content.Salt {
+		return errors.New("🚨 Signature mismatch. " +
+			"The signature token doesn't match the command, plugins, fields or build of this job.")
+	}
+
+	return nil
+}
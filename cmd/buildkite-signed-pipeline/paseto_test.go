@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPasetoSigner(now time.Time) *SharedSecretSigner {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.format = signatureFormatPaseto
+	signer.maxAge = 10 * time.Minute
+	signer.now = func() time.Time {
+		return now
+	}
+	return signer
+}
+
+func TestVerifyPasetoToken(t *testing.T) {
+	const pluginJSON = `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v123":{"image":"node8"}}]`
+	now := time.Unix(1600000000, 0)
+
+	signature, err := newPasetoSigner(now).signatureFunc()(stepContent{Command: "echo hello world", PluginJSON: pluginJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(signature), "v2.local.")
+
+	err = newPasetoSigner(now.Add(time.Minute)).Verify("echo hello world", pluginJSON, signature)
+	assert.Nil(t, err)
+}
+
+func TestVerifyPasetoTokenExpired(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	signature, err := newPasetoSigner(now).signatureFunc()(stepContent{Command: "echo hello world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newPasetoSigner(now.Add(time.Hour)).Verify("echo hello world", "", signature)
+	assert.NotNil(t, err)
+
+	// the verifier's max age applies even if the signer didn't set an expiry
+	signer := newPasetoSigner(now)
+	signer.maxAge = 0
+	signature, err = signer.signatureFunc()(stepContent{Command: "echo hello world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newPasetoSigner(now.Add(time.Hour)).Verify("echo hello world", "", signature)
+	assert.EqualError(t, err, "🚨 Signature expired. It was issued 1h0m0s ago which exceeds the maximum age of 10m0s")
+}
+
+func TestVerifyPasetoTokenTampered(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	signer := newPasetoSigner(now)
+
+	signature, err := signer.signatureFunc()(stepContent{Command: "echo hello world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different command doesn't match the command claim
+	err = signer.Verify("echo something-naughty", "", signature)
+	assert.NotNil(t, err)
+
+	// changing the token itself fails authentication
+	tampered := []byte(signature)
+	tampered[len(tampered)-2] ^= 1
+	err = signer.Verify("echo hello world", "", Signature(tampered))
+	assert.NotNil(t, err)
+
+	// a token from a different secret isn't accepted
+	other := newPasetoSigner(now)
+	other.secret = "other-llamas"
+	err = other.Verify("echo hello world", "", signature)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyPasetoTokenWithSalt(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	signature, err := newPasetoSigner(now).signatureFunc()(stepContent{Command: "echo hello world", Salt: "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(stepSignatureSaltEnv, "llamas")
+	assert.Nil(t, newPasetoSigner(now).Verify("echo hello world", "", signature))
+
+	t.Setenv(stepSignatureSaltEnv, "alpacas")
+	assert.NotNil(t, newPasetoSigner(now).Verify("echo hello world", "", signature))
+}
+
+func TestVerifyPasetoTokenIssuedInFuture(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	signature, err := newPasetoSigner(now.Add(time.Hour)).signatureFunc()(stepContent{Command: "echo hello world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newPasetoSigner(now).Verify("echo hello world", "", signature)
+	assert.EqualError(t, err, "🚨 Signature token was issued 1h0m0s in the future which exceeds the allowed clock skew of 1m0s")
+
+	// within the allowed clock skew
+	assert.Nil(t, newPasetoSigner(now.Add(time.Hour-30*time.Second)).Verify("echo hello world", "", signature))
+}
+
+func TestVerifyPasetoTokenOfEarlierVersion(t *testing.T) {
+	// issued at 1600000000 with a footer of null, as earlier versions did
+	const signature = "v2.local.wAPG5Hs3uy5IIYowH15Y5PduhHvAm4Xn7Un0eUmw-P2nmrBFiz0J4BqtAn8s9xjvnyEsWYmHC2cNoXJ0Neh5Ak6EWAELqld6CgQtSAH6Z4MUJ8jcieBoLvd_c_RhbKj3ubbivTwz4i1BdAo_gI7eh29IyOr5vle6TXHjZg9NJHGRzSV9OU_kZqHUw-_W2Y-ncfjxGk4k588hgVTszVRowN63iAJcGmk2lMwP-zsAwInsrx4BuOxMwLfTqmVmDYiOmuvC_-SqXrzxA4TvUlTZT65HK1Z8tjl6x3WgoL_m-Lui0tpD1GbimIcsYBbmisyCZtnEac0c7pgrWJd-h2zutXxCjjThk3i53nE4FGRMwCdAS2EkNqS9mII.bnVsbA"
+	now := time.Unix(1600000000, 0)
+
+	assert.Nil(t, newPasetoSigner(now.Add(time.Minute)).Verify("echo hello world", "", signature))
+	assert.NotNil(t, newPasetoSigner(now.Add(time.Minute)).Verify("echo something-naughty", "", signature))
+	assert.EqualError(t, newPasetoSigner(now.Add(time.Hour)).Verify("echo hello world", "", signature),
+		"🚨 Signature token expired at 2020-09-13T12:36:40Z")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasetoV2LocalTestVector(t *testing.T) {
+	// test vector 2-E-1 of the PASETO specification
+	key, _ := hex.DecodeString("707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	const payload = `{"data":"this is a signed message","exp":"2019-01-01T00:00:00+00:00"}`
+	const expected = "v2.local.97TTOvgwIxNGvV80XKiGZg_kD3tsXM_-qB4dZGHOeN1cTkgQ4PnW8888l802W8d9AvEGnoNBY3BnqHORy8a5cC8aKpbA0En8XELw2yDk2f1sVODyfnDbi6rEGMY3pSfCbLWMM2oHJxvlEl2XbQ"
+
+	token, err := pasetoV2EncryptWithNonceKey(key, []byte(payload), make([]byte, 24))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, token)
+
+	decrypted, err := pasetoV2Decrypt(key, token)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, string(decrypted))
+}
+
+func TestPasetoV2Decrypt(t *testing.T) {
+	key := make([]byte, 32)
+	token, err := pasetoV2Encrypt(key, []byte("llamas"))
+	assert.Nil(t, err)
+
+	payload, err := pasetoV2Decrypt(key, token)
+	assert.Nil(t, err)
+	assert.Equal(t, "llamas", string(payload))
+
+	// each token has its own nonce
+	other, err := pasetoV2Encrypt(key, []byte("llamas"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, other)
+
+	for _, invalid := range []string{
+		"",
+		"v2.public." + token[len(pasetoV2LocalHeader):],
+		"v1.local." + token[len(pasetoV2LocalHeader):],
+		token[:len(token)-1],
+		token + ".Zm9vdGVy",
+		token + "..",
+		"v2.local.bGxhbWFz",
+	} {
+		_, err := pasetoV2Decrypt(key, invalid)
+		assert.Equal(t, errPasetoInvalidToken, err, invalid)
+	}
+
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	_, err = pasetoV2Decrypt(otherKey, token)
+	assert.Equal(t, errPasetoInvalidToken, err)
+}
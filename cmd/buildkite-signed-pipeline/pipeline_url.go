@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// parseHeaders parses headers of the form "Name: value"
+func parseHeaders(headers []string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid header %q, expected Name: value", header)
+		}
+		parsed.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return parsed, nil
+}
+
+// pipelineFileExtension picks the extension of the downloaded pipeline from its
+// content type, as the agent parses pipelines based on their extension
+func pipelineFileExtension(contentType string) (string, error) {
+	if contentType == "" {
+		return ".yml", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("Invalid content type %q: %v", contentType, err)
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return ".json", nil
+	case strings.Contains(mediaType, "yaml"), mediaType == "text/plain", mediaType == "application/octet-stream":
+		return ".yml", nil
+	}
+	// e.g. a HTML login or error page served with a 200
+	return "", fmt.Errorf("Unexpected content type %q for a pipeline", mediaType)
+}
+
+// downloadPipeline fetches a pipeline into a temporary file so it can be handed
+// to the agent like a local pipeline, the caller is responsible for removing it.
+// Redirects are followed, although headers aren't sent to other hosts.
+func downloadPipeline(client *http.Client, pipelineURL string, headers []string) (*os.File, error) {
+	req, err := http.NewRequest(http.MethodGet, pipelineURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header, err = parseHeaders(headers); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download pipeline: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to download pipeline from %s: %s", pipelineURL, resp.Status)
+	}
+
+	ext, err := pipelineFileExtension(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "pipeline-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("Unable to download pipeline: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadPipeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pipeline.yml":
+			if r.Header.Get("Authorization") != "Bearer llamas" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write([]byte("steps:\n  - command: echo hello\n"))
+		case "/moved.yml":
+			http.Redirect(w, r, "/pipeline.yml", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f, err := downloadPipeline(server.Client(), server.URL+"/moved.yml", []string{"Authorization: Bearer llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	assert.Equal(t, ".yml", filepath.Ext(f.Name()))
+
+	pipeline, err := readPipelineFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, unsignedCommandSteps(signed))
+
+	_, err = downloadPipeline(server.Client(), server.URL+"/pipeline.yml", nil)
+	assert.EqualError(t, err, "Unable to download pipeline from "+server.URL+"/pipeline.yml: 401 Unauthorized")
+
+	_, err = downloadPipeline(server.Client(), server.URL+"/pipeline.yml", []string{"Authorization"})
+	assert.EqualError(t, err, `Invalid header "Authorization", expected Name: value`)
+}
+
+func TestPipelineFileExtension(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"":                                ".yml",
+		"application/json":                ".json",
+		"application/json; charset=utf-8": ".json",
+		"application/x-yaml":              ".yml",
+		"text/yaml":                       ".yml",
+		"text/plain; charset=utf-8":       ".yml",
+	} {
+		ext, err := pipelineFileExtension(contentType)
+		assert.Nil(t, err, contentType)
+		assert.Equal(t, expected, ext, contentType)
+	}
+
+	_, err := pipelineFileExtension("text/html; charset=utf-8")
+	assert.EqualError(t, err, `Unexpected content type "text/html" for a pipeline`)
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"path"
 	"regexp"
 	"sort"
+	"strings"
 )
 var (
 	// 'official-plugin' and 'official-plugin#v2'
@@ -35,14 +39,127 @@ func NewPluginFromReference(item interface{}) (*Plugin, error) {
 	return nil, fmt.Errorf("Unknown plugin reference type %T", item)
 }
 
+const (
+	pluginFormOfficial    = `official`
+	pluginFormGithub      = `github`
+	pluginFormLocal       = `local`
+	pluginFormPassthrough = `passthrough`
+)
+
 func (p Plugin) Repository() string {
+	repository, _ := p.resolveRepository()
+	return repository
+}
+
+// resolveRepository returns the repository a plugin reference normalises to
+// along with which form of reference it was recognised as
+func (p Plugin) resolveRepository() (string, string) {
+	if isLocalPluginReference(p.Name) {
+		return canonicalLocalPlugin(p.Name), pluginFormLocal
+	}
 	if m := officialPluginRegex.FindStringSubmatch(p.Name); len(m) == 3 {
-		return fmt.Sprintf(`github.com/buildkite-plugins/%s-buildkite-plugin%s`, m[1], m[2])
+		return fmt.Sprintf(`github.com/buildkite-plugins/%s-buildkite-plugin%s`, m[1], m[2]), pluginFormOfficial
 	}
 	if m := githubPluginRegex.FindStringSubmatch(p.Name); len(m) == 3 {
-		return fmt.Sprintf(`github.com/%s-buildkite-plugin%s`, m[1], m[2])
+		return fmt.Sprintf(`github.com/%s-buildkite-plugin%s`, m[1], m[2]), pluginFormGithub
 	}
-	return p.Name
+	return p.Name, pluginFormPassthrough
+}
+
+// isLocalPluginReference reports whether a plugin is referenced by a path on the
+// agent, e.g. ./my-plugin, rather than a repository
+func isLocalPluginReference(name string) bool {
+	return strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "/")
+}
+
+// canonicalLocalPlugin renders a local plugin path as written but with redundant
+// separators and elements removed, so ./my-plugin/ and ./my-plugin are the same.
+// Relative paths keep their leading ./ so they're never taken for a plugin name.
+func canonicalLocalPlugin(name string) string {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return cleaned
+	}
+	return "./" + cleaned
+}
+
+// logPluginNormalisation logs how each plugin reference was normalised
+func logPluginNormalisation(plugins []Plugin) {
+	for _, plugin := range plugins {
+		repository, form := plugin.resolveRepository()
+		log.Printf("Plugin %q matched %s form, normalised to %q", plugin.Name, form, repository)
+	}
+}
+
+// duplicatePlugins returns the repositories that are referenced more than once,
+// regardless of version
+func duplicatePlugins(plugins []Plugin) []string {
+	seen := make(map[string]int)
+	var duplicates []string
+	for _, plugin := range plugins {
+		repository := strings.SplitN(plugin.Repository(), "#", 2)[0]
+		seen[repository]++
+		if seen[repository] == 2 {
+			duplicates = append(duplicates, repository)
+		}
+	}
+	return duplicates
+}
+
+// maxPluginCandidates caps the variations of plugins that are tried, including
+// as presented, as each is a separate verification and with KMS a separate API
+// call. Where trying each versioned plugin with and without its version would
+// exceed it, only all or none of the versions are stripped.
+const maxPluginCandidates = 8
+
+// unversionedPluginCandidates returns canonical plugin JSON followed by each
+// variation of it with plugin versions stripped, for matching plugins that
+// were signed without a version
+func unversionedPluginCandidates(pluginJSON string, order pluginOrder) ([]string, error) {
+	var plugins []map[string]interface{}
+	if err := json.Unmarshal([]byte(pluginJSON), &plugins); err != nil {
+		return nil, err
+	}
+
+	var versioned []int
+	for i, plugin := range plugins {
+		if name, _ := getPluginPair(plugin); strings.Contains(name, "#") {
+			versioned = append(versioned, i)
+		}
+	}
+
+	masks := []int{}
+	if 1<<len(versioned) <= maxPluginCandidates {
+		for mask := 1; mask < 1<<len(versioned); mask++ {
+			masks = append(masks, mask)
+		}
+	} else if len(versioned) > 0 {
+		masks = append(masks, 1<<len(versioned)-1)
+	}
+
+	candidates := []string{pluginJSON}
+	for _, mask := range masks {
+		variation := make([]map[string]interface{}, len(plugins))
+		copy(variation, plugins)
+		for bit, i := range versioned {
+			if mask&(1<<bit) == 0 {
+				continue
+			}
+			name, settings := getPluginPair(plugins[i])
+			variation[i] = map[string]interface{}{strings.SplitN(name, "#", 2)[0]: settings}
+		}
+
+		b, err := json.Marshal(variation)
+		if err != nil {
+			return nil, err
+		}
+		candidate, err := canonicalisePluginJSON(string(b), order)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
 }
 
 // The bootstrap expects an array of plugins like [{"plugin1#v1.0.0":{...}}, {"plugin2#v1.0.0":{...}}]
@@ -60,6 +177,13 @@ func marshalPlugins(plugins []Plugin) (string, error) {
 	return string(b), nil
 }
 
+// pluginSortKey orders a plugin by its ref and then its settings
+type pluginSortKey struct {
+	name     string
+	settings string
+	plugin   map[string]interface{}
+}
+
 func getPluginPair(pluginReference map[string]interface{}) (string, interface{}) {
 	for k, v := range pluginReference {
 		return k, v
@@ -67,21 +191,62 @@ func getPluginPair(pluginReference map[string]interface{}) (string, interface{})
 	return "", nil
 }
 
-func canonicalisePluginJSON(pluginJSON string) (string, error) {
+func canonicalisePluginJSON(pluginJSON string, order pluginOrder) (string, error) {
 	// plugin JSON is of the form [{"plugin-ref#version":{settings}},{"plugin-ref2#version":null}]
 	// https://golang.org/pkg/encoding/json/#Marshal provides consistent ordering of JSON
-	// unmarshal and remarshal to ensure this ordering is the same as extraction
+	// unmarshal and remarshal to ensure this ordering is the same as extraction.
+	// This also removes differences that aren't significant in JSON, such as
+	// whitespace between tokens, how characters in strings are escaped and how
+	// numbers are written, while whitespace within strings is kept.
 	var plugins []map[string]interface{}
 	if err := json.Unmarshal([]byte(pluginJSON), &plugins); err != nil {
 		return "", err
 	}
+	return canonicalisePlugins(plugins, order)
+}
 
-	// sort by the plugin ref
-	sort.Slice(plugins, func(i, j int) bool {
-		thisName, _ := getPluginPair(plugins[i])
-		otherName, _ := getPluginPair(plugins[j])
-		return thisName < otherName
-	})
+// pluginOrder is whether the order plugins are listed in is signed
+type pluginOrder bool
+
+const (
+	// plugins are sorted, so listing them in another order still verifies
+	sortPlugins pluginOrder = false
+	// plugins are kept in the order they're listed in, so reordering them is
+	// detected, e.g. where the order their hooks run in matters
+	keepPluginOrder pluginOrder = true
+)
+
+// canonicalisePlugins renders parsed plugin JSON in its canonical form, the
+// plugins are modified in doing so
+func canonicalisePlugins(plugins []map[string]interface{}, order pluginOrder) (string, error) {
+	// an empty set of plugins is canonicalised to no plugins, matching signing
+	if len(plugins) == 0 {
+		return "", nil
+	}
+
+	// plugins without settings may be presented with null or empty settings,
+	// these are canonicalised to null. Local plugins are presented by the path
+	// they were referenced with, which is canonicalised as when signing, and
+	// negative zero in settings is the same as zero.
+	for i, plugin := range plugins {
+		canonical := make(map[string]interface{}, len(plugin))
+		for name, settings := range plugin {
+			if m, ok := settings.(map[string]interface{}); ok && len(m) == 0 {
+				settings = nil
+			}
+			if isLocalPluginReference(name) {
+				name = canonicalLocalPlugin(name)
+			}
+			canonical[name], _ = normaliseNegativeZero(settings)
+		}
+		plugins[i] = canonical
+	}
+
+	if order == sortPlugins {
+		if err := sortPluginsByRef(plugins); err != nil {
+			return "", err
+		}
+	}
 
 	pluginBytes, err := json.Marshal(plugins)
 	if err != nil {
@@ -89,3 +254,163 @@ func canonicalisePluginJSON(pluginJSON string) (string, error) {
 	}
 	return string(pluginBytes), nil
 }
+
+// sortPluginsByRef sorts plugins by their ref, then by their settings for
+// plugins referenced more than once, so the order doesn't depend on the order
+// they were listed in
+func sortPluginsByRef(plugins []map[string]interface{}) error {
+	sorted := make([]pluginSortKey, len(plugins))
+	for i, plugin := range plugins {
+		name, settings := getPluginPair(plugin)
+		settingsJSON, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		sorted[i] = pluginSortKey{name: name, settings: string(settingsJSON), plugin: plugin}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].name != sorted[j].name {
+			return sorted[i].name < sorted[j].name
+		}
+		return sorted[i].settings < sorted[j].settings
+	})
+	for i := range sorted {
+		plugins[i] = sorted[i].plugin
+	}
+	return nil
+}
+
+// normaliseNegativeZero replaces -0 in plugin settings with 0, returning
+// whether any was replaced. Settings are only copied where a number changes.
+// Other numbers are left as they are, settings hold them as float64 as parsing
+// JSON does, which encoding writes the same way however they were written.
+func normaliseNegativeZero(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v == 0 && math.Signbit(v) {
+			return float64(0), true
+		}
+	case map[string]interface{}:
+		var copied map[string]interface{}
+		for key, item := range v {
+			if canonical, changed := normaliseNegativeZero(item); changed {
+				if copied == nil {
+					copied = copyMap(v)
+				}
+				copied[key] = canonical
+			}
+		}
+		if copied != nil {
+			return copied, true
+		}
+	case []interface{}:
+		var copied []interface{}
+		for i, item := range v {
+			if canonical, changed := normaliseNegativeZero(item); changed {
+				if copied == nil {
+					copied = append([]interface{}{}, v...)
+				}
+				copied[i] = canonical
+			}
+		}
+		if copied != nil {
+			return copied, true
+		}
+	}
+	return value, false
+}
+
+// canonicalisePluginReferences renders plugins referenced by a step in their
+// canonical form. Settings that are already as they'd be parsed from JSON are
+// used as is, avoiding copying large settings through a marshal and unmarshal.
+func canonicalisePluginReferences(plugins []Plugin, order pluginOrder) (string, error) {
+	resolved := make([]map[string]interface{}, 0, len(plugins))
+	for _, plugin := range plugins {
+		if !isParsedJSON(plugin.Params) {
+			// e.g. integers from YAML, which must be converted as JSON would be
+			pluginJSON, err := marshalPlugins(plugins)
+			if err != nil {
+				return "", err
+			}
+			return canonicalisePluginJSON(pluginJSON, order)
+		}
+		resolved = append(resolved, map[string]interface{}{plugin.Repository(): plugin.Params})
+	}
+	return canonicalisePlugins(resolved, order)
+}
+
+// isParsedJSON reports whether a value only contains the types that parsing JSON
+// produces, so encoding it is the same as encoding it after a round trip
+func isParsedJSON(value interface{}) bool {
+	switch v := value.(type) {
+	case nil, string, bool, float64:
+		return true
+	case map[string]interface{}:
+		for _, item := range v {
+			if !isParsedJSON(item) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if !isParsedJSON(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// excludedPluginSetting is a setting of a plugin that isn't signed, as the agent
+// rewrites it at runtime
+type excludedPluginSetting struct {
+	// The repository of the plugin, without a version
+	Plugin  string
+	Setting string
+}
+
+// parseExcludedPluginSettings parses settings of the form plugin.setting, e.g.
+// docker.mount-buildkite-agent. The plugin may be referenced in any form
+// a step could reference it, and any version is ignored.
+func parseExcludedPluginSettings(list []string) ([]excludedPluginSetting, error) {
+	var excluded []excludedPluginSetting
+	for _, item := range list {
+		i := strings.LastIndex(item, ".")
+		if i <= 0 || i == len(item)-1 {
+			return nil, fmt.Errorf("Invalid plugin setting %q, expected plugin.setting", item)
+		}
+		plugin := Plugin{Name: strings.SplitN(item[:i], "#", 2)[0]}
+		excluded = append(excluded, excludedPluginSetting{Plugin: plugin.Repository(), Setting: item[i+1:]})
+	}
+	return excluded, nil
+}
+
+// excludePluginSettings removes the excluded settings from canonical plugin
+// JSON, this is done when both signing and verifying so the settings can
+// differ between them
+func (s SharedSecretSigner) excludePluginSettings(pluginJSON string) (string, error) {
+	if len(s.excludedPluginSettings) == 0 || pluginJSON == "" {
+		return pluginJSON, nil
+	}
+
+	var plugins []map[string]interface{}
+	if err := json.Unmarshal([]byte(pluginJSON), &plugins); err != nil {
+		return "", err
+	}
+	for _, plugin := range plugins {
+		name, settings := getPluginPair(plugin)
+		params, ok := settings.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		repository := strings.SplitN(name, "#", 2)[0]
+		for _, excluded := range s.excludedPluginSettings {
+			if excluded.Plugin == repository {
+				delete(params, excluded.Setting)
+			}
+		}
+	}
+	return canonicalisePlugins(plugins, s.pluginOrder())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type pluginsCommand struct {
+	File string
+}
+
+func (c *pluginsCommand) run(ctx *kingpin.ParseContext) error {
+	pipeline, err := readPipelineFile(c.File)
+	if err != nil {
+		return err
+	}
+
+	steps, err := listPipelinePlugins(pipeline)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(steps)
+}
+
+// stepPlugins lists how each plugin reference of a step is normalised when it's
+// signed, so surprising rewrites can be found before they fail verification
+type stepPlugins struct {
+	Step    string            `json:"step"`
+	Plugins []pluginReference `json:"plugins"`
+}
+
+type pluginReference struct {
+	Reference  string `json:"reference"`
+	Repository string `json:"repository"`
+	Form       string `json:"form"`
+}
+
+// listPipelinePlugins returns the plugins of each step of a pipeline that has any
+func listPipelinePlugins(pipeline interface{}) ([]stepPlugins, error) {
+	steps := []stepPlugins{}
+
+	var err error
+	walkSteps(pipeline, func(step map[string]interface{}) {
+		plugins, ok := step["plugins"]
+		if err != nil || !ok {
+			return
+		}
+
+		parsed, stepErr := parsePluginReferences(plugins)
+		if stepErr != nil {
+			err = fmt.Errorf("Unable to parse the plugins of %s: %v", stepName(step), stepErr)
+			return
+		}
+		if len(parsed) == 0 {
+			return
+		}
+
+		listed := stepPlugins{Step: stepName(step)}
+		for _, plugin := range parsed {
+			repository, form := plugin.resolveRepository()
+			listed.Plugins = append(listed.Plugins, pluginReference{
+				Reference:  plugin.Name,
+				Repository: repository,
+				Form:       form,
+			})
+		}
+		steps = append(steps, listed)
+	})
+
+	return steps, err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestListPipelinePlugins(t *testing.T) {
+	var pipeline interface{}
+	err := yaml.Unmarshal([]byte(`
+steps:
+  - label: build
+    command: make
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+      - seek-oss/aws-sm#v2.0.0
+      - ssh://git@git.example.com/ci/cache-buildkite-plugin.git#v1.0.0: ~
+  - label: test
+    command: make test
+  - group: deploy
+    steps:
+      - key: deploy
+        plugins:
+          https://github.com/example/deploy-buildkite-plugin.git#main:
+            env: prod
+          ecr#v2.0.0: ~
+  - wait
+`), &pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := listPipelinePlugins(pipeline)
+	assert.Nil(t, err)
+	assert.Equal(t, []stepPlugins{
+		{
+			Step: "build",
+			Plugins: []pluginReference{
+				{"docker#v3.0.0", "github.com/buildkite-plugins/docker-buildkite-plugin#v3.0.0", pluginFormOfficial},
+				{"seek-oss/aws-sm#v2.0.0", "github.com/seek-oss/aws-sm-buildkite-plugin#v2.0.0", pluginFormGithub},
+				{"ssh://git@git.example.com/ci/cache-buildkite-plugin.git#v1.0.0", "ssh://git@git.example.com/ci/cache-buildkite-plugin.git#v1.0.0", pluginFormPassthrough},
+			},
+		},
+		{
+			Step: "deploy",
+			Plugins: []pluginReference{
+				{"ecr#v2.0.0", "github.com/buildkite-plugins/ecr-buildkite-plugin#v2.0.0", pluginFormOfficial},
+				{"https://github.com/example/deploy-buildkite-plugin.git#main", "https://github.com/example/deploy-buildkite-plugin.git#main", pluginFormPassthrough},
+			},
+		},
+	}, steps)
+}
+
+func TestListPipelinePluginsInvalid(t *testing.T) {
+	_, err := listPipelinePlugins(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"label": "build", "plugins": 42},
+		},
+	})
+	assert.EqualError(t, err, "Unable to parse the plugins of build: Unknown plugin type int")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// captureLog redirects the standard logger to a buffer for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &buf
+}
+
+func TestDebugPluginNormalisation(t *testing.T) {
+	output := captureLog(t)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.debugPlugins = true
+	_, err := signer.extractPlugins([]interface{}{
+		"docker#v3.8.0",
+		"seek-oss/aws-sm#v2.3.1",
+		"ssh://git@example.com/my-plugin.git#v1.0.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, output.String(), `Plugin "docker#v3.8.0" matched official form, normalised to "github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0"`)
+	assert.Contains(t, output.String(), `Plugin "seek-oss/aws-sm#v2.3.1" matched github form, normalised to "github.com/seek-oss/aws-sm-buildkite-plugin#v2.3.1"`)
+	assert.Contains(t, output.String(), `Plugin "ssh://git@example.com/my-plugin.git#v1.0.0" matched passthrough form, normalised to "ssh://git@example.com/my-plugin.git#v1.0.0"`)
+}
+
+func TestNoPluginNormalisationLoggingByDefault(t *testing.T) {
+	output := captureLog(t)
+
+	_, err := NewSharedSecretSigner("secret-llamas").extractPlugins([]interface{}{"docker#v3.8.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, output.String(), "normalised to")
+}
+
+func TestDuplicatePluginsWarn(t *testing.T) {
+	output := captureLog(t)
+
+	pluginJSON, err := NewSharedSecretSigner("secret-llamas").extractPlugins([]interface{}{
+		map[string]interface{}{"docker#v3.8.0": map[string]interface{}{"image": "alpine"}},
+		"seek-oss/aws-sm#v2.3.1",
+		map[string]interface{}{"docker#v3.9.0": map[string]interface{}{"image": "evil"}},
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), "⚠️ Step references the same plugin more than once: github.com/buildkite-plugins/docker-buildkite-plugin")
+
+	// both instances are signed, so neither can be dropped or altered
+	assert.Equal(t, `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"alpine"}},`+
+		`{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.9.0":{"image":"evil"}},`+
+		`{"github.com/seek-oss/aws-sm-buildkite-plugin#v2.3.1":null}]`, pluginJSON)
+}
+
+func TestDuplicatePluginsRejected(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.rejectDuplicatePlugins = true
+
+	_, err := signer.extractPlugins([]interface{}{
+		map[string]interface{}{"docker#v3.8.0": map[string]interface{}{"image": "alpine"}},
+		map[string]interface{}{"docker#v3.8.0": map[string]interface{}{"image": "evil"}},
+	})
+	assert.EqualError(t, err, "🚨 Step references the same plugin more than once: github.com/buildkite-plugins/docker-buildkite-plugin")
+
+	_, err = signer.extractPlugins([]interface{}{"docker#v3.8.0", "docker-compose#v3.8.0"})
+	assert.Nil(t, err)
+}
+
+func TestVerifyUnversionedPluginAgainstResolvedVersion(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	signedPlugins, err := signer.extractPlugins([]interface{}{
+		"docker",
+		map[string]interface{}{"seek-oss/aws-sm#v2.3.1": map[string]interface{}{"env": "SECRET"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.signData(stepContent{Command: "echo hello", PluginJSON: signedPlugins})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolvedPlugins := `[{"github.com/seek-oss/aws-sm-buildkite-plugin#v2.3.1":{"env":"SECRET"}},` +
+		`{"github.com/buildkite-plugins/docker-buildkite-plugin#v5.0.0":null}]`
+
+	// by default the plugins must be presented as they were signed
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", resolvedPlugins, signature))
+	assert.Nil(t, signer.Verify("echo hello", signedPlugins, signature))
+
+	signer.matchUnversionedPlugins = true
+	assert.Nil(t, signer.Verify("echo hello", resolvedPlugins, signature))
+
+	// but a plugin that was signed with a version must still match it
+	changedVersion := `[{"github.com/seek-oss/aws-sm-buildkite-plugin#v2.4.0":{"env":"SECRET"}},` +
+		`{"github.com/buildkite-plugins/docker-buildkite-plugin#v5.0.0":null}]`
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", changedVersion, signature))
+}
+
+func TestUnversionedPluginCandidates(t *testing.T) {
+	candidates, err := unversionedPluginCandidates(`[{"a#v1":null},{"b":null},{"c#v1":{"x":1}}]`, sortPlugins)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`[{"a#v1":null},{"b":null},{"c#v1":{"x":1}}]`,
+		`[{"a":null},{"b":null},{"c#v1":{"x":1}}]`,
+		`[{"a#v1":null},{"b":null},{"c":{"x":1}}]`,
+		`[{"a":null},{"b":null},{"c":{"x":1}}]`,
+	}, candidates)
+
+	// beyond the cap only all or none of the versions are stripped
+	candidates, err = unversionedPluginCandidates(`[{"a#v1":null},{"b#v1":null},{"c#v1":null},{"d#v1":null}]`, sortPlugins)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`[{"a#v1":null},{"b#v1":null},{"c#v1":null},{"d#v1":null}]`,
+		`[{"a":null},{"b":null},{"c":null},{"d":null}]`,
+	}, candidates)
+}
+
+func TestVerifyPluginWithoutSettingsAsEmptyObject(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	signedPlugins, err := signer.extractPlugins([]interface{}{"docker#v3.8.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":null}]`, signedPlugins)
+
+	signature, err := signer.signData(stepContent{Command: "echo hello", PluginJSON: signedPlugins})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{}}]`, signature))
+	assert.Nil(t, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":null}]`, signature))
+}
+
+func TestSigningPluginWithEmptySettings(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	withNull, err := signer.extractPlugins([]interface{}{map[string]interface{}{"docker#v3.8.0": nil}})
+	assert.Nil(t, err)
+	withEmpty, err := signer.extractPlugins([]interface{}{map[string]interface{}{"docker#v3.8.0": map[string]interface{}{}}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, withNull, withEmpty)
+}
+
+func TestCanonicalisePluginReferencesMatchesRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		Name    string
+		Plugins []Plugin
+	}{
+		{"Settings parsed from JSON", []Plugin{
+			{"docker#v3.8.0", map[string]interface{}{"image": "golang", "environment": []interface{}{"A=<b>&c"}, "debug": true, "retries": float64(3)}},
+			{"artifacts#v1.5.0", nil},
+		}},
+		{"Empty settings", []Plugin{{"docker#v3.8.0", map[string]interface{}{}}}},
+		{"Integers parsed from YAML", []Plugin{
+			{"docker#v3.8.0", map[string]interface{}{"retries": 3, "large": int64(9007199254740993)}},
+		}},
+		{"Nested integers parsed from YAML", []Plugin{
+			{"docker#v3.8.0", map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": 8080}}}},
+		}},
+		{"Unordered plugins", []Plugin{
+			{"zzz#v1.0.0", map[string]interface{}{"a": "b"}},
+			{"aaa#v1.0.0", nil},
+		}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			pluginJSON, err := marshalPlugins(tc.Plugins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTripped, err := canonicalisePluginJSON(pluginJSON, sortPlugins)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			canonical, err := canonicalisePluginReferences(tc.Plugins, sortPlugins)
+			assert.Nil(t, err)
+			assert.Equal(t, roundTripped, canonical)
+		})
+	}
+}
+
+func TestVerifyExcludedPluginSettings(t *testing.T) {
+	excluded, err := parseExcludedPluginSettings([]string{"docker.mount-buildkite-agent", "seek-oss/aws-sm#v2.3.1.region"})
+	assert.Nil(t, err)
+	assert.Equal(t, []excludedPluginSetting{
+		{Plugin: "github.com/buildkite-plugins/docker-buildkite-plugin", Setting: "mount-buildkite-agent"},
+		{Plugin: "github.com/seek-oss/aws-sm-buildkite-plugin", Setting: "region"},
+	}, excluded)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.excludedPluginSettings = excluded
+
+	signature := signedStepSignature(t, signer, `{"command":"echo hello","plugins":[{"docker#v3.8.0":{"image":"alpine","mount-buildkite-agent":false}}]}`)
+
+	// the excluded setting may be rewritten, or dropped, by the agent
+	assert.Nil(t, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"alpine","mount-buildkite-agent":"/usr/bin/buildkite-agent"}}]`, signature))
+	assert.Nil(t, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"alpine"}}]`, signature))
+
+	// but other settings must still match
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"evil","mount-buildkite-agent":false}}]`, signature))
+
+	// as must the same setting of other plugins
+	other := signedStepSignature(t, signer, `{"command":"echo hello","plugins":[{"docker-compose#v3.8.0":{"mount-buildkite-agent":false}}]}`)
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.8.0":{"mount-buildkite-agent":true}}]`, other))
+
+	// without the exclusion the rewritten setting fails verification
+	signer.excludedPluginSettings = nil
+	signature = signedStepSignature(t, signer, `{"command":"echo hello","plugins":[{"docker#v3.8.0":{"image":"alpine","mount-buildkite-agent":false}}]}`)
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"alpine","mount-buildkite-agent":"/usr/bin/buildkite-agent"}}]`, signature))
+}
+
+func TestParseExcludedPluginSettingsInvalid(t *testing.T) {
+	for _, item := range []string{"docker", "docker.", ".image"} {
+		_, err := parseExcludedPluginSettings([]string{item})
+		assert.EqualError(t, err, fmt.Sprintf("Invalid plugin setting %q, expected plugin.setting", item))
+	}
+}
+
+func TestLocalPluginReferences(t *testing.T) {
+	for _, tc := range []struct {
+		Reference string
+		Canonical string
+		Presented []string
+	}{
+		{"./my-plugin", "./my-plugin", []string{"./my-plugin", "./my-plugin/", ".//my-plugin"}},
+		{"./plugins/../my-plugin/", "./my-plugin", []string{"./my-plugin"}},
+		{"../my-plugin", "../my-plugin", []string{"../my-plugin", "../my-plugin/", "./../my-plugin"}},
+		{"/opt/plugins/my-plugin", "/opt/plugins/my-plugin", []string{"/opt/plugins/my-plugin/"}},
+	} {
+		t.Run(tc.Reference, func(t *testing.T) {
+			repository, form := Plugin{Name: tc.Reference}.resolveRepository()
+			assert.Equal(t, tc.Canonical, repository)
+			assert.Equal(t, pluginFormLocal, form)
+
+			signer := NewSharedSecretSigner("secret-llamas")
+			signedPlugins, err := signer.extractPlugins([]interface{}{
+				map[string]interface{}{tc.Reference: map[string]interface{}{"mode": "dev"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, fmt.Sprintf(`[{%q:{"mode":"dev"}}]`, tc.Canonical), signedPlugins)
+
+			signature, err := signer.signData(stepContent{Command: "make", PluginJSON: signedPlugins})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, presented := range append(tc.Presented, tc.Reference) {
+				assert.Nil(t, signer.Verify("make", fmt.Sprintf(`[{%q:{"mode":"dev"}}]`, presented), signature), presented)
+			}
+
+			// a different plugin at another path doesn't match
+			assert.Equal(t, errSignatureMismatch, signer.Verify("make", `[{"./other-plugin":{"mode":"dev"}}]`, signature))
+		})
+	}
+}
+
+func TestPluginJSONInsignificantDifferences(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	signedPlugins, err := signer.extractPlugins([]interface{}{
+		map[string]interface{}{"docker#v3.8.0": map[string]interface{}{
+			"image":   "golang:1.17",
+			"command": []interface{}{"sh", "-c", "echo <a> & </b>  "},
+			"shm":     100,
+			"env":     map[string]interface{}{"PATH": "/usr/bin"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.signData(stepContent{Command: "make", PluginJSON: signedPlugins})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same settings as they might be presented by the agent
+	for name, presented := range map[string]string{
+		"compact": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"command":["sh","-c","echo <a> & </b>  "],"env":{"PATH":"/usr/bin"},"image":"golang:1.17","shm":100}}]`,
+		"whitespace": `
+			[ { "github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0" : {
+				"image" : "golang:1.17",
+				"command" : [ "sh" , "-c" , "echo <a> & </b>  " ],
+				"shm" : 100 ,
+				"env" : { "PATH" : "/usr/bin" }
+			} } ]
+		`,
+		"escaped": `[{"github.com\/buildkite-plugins\/docker-buildkite-plugin#v3.8.0":{"command":["sh","-c","echo <a> & </b>  "],"env":{"PATH":"\/usr\/bin"},"image":"\u0067olang:1.17","shm":100}}]`,
+		"numbers": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"command":["sh","-c","echo <a> & </b>  "],"env":{"PATH":"/usr/bin"},"image":"golang:1.17","shm":1e2}}]`,
+	} {
+		assert.Nil(t, signer.Verify("make", presented, signature), name)
+	}
+
+	// whitespace within strings is significant
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make",
+		`[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"command":["sh","-c","echo <a> & </b>"],"env":{"PATH":"/usr/bin"},"image":"golang:1.17","shm":100}}]`,
+		signature))
+}
+
+func TestPluginsWithSameRepositorySortStably(t *testing.T) {
+	first := map[string]interface{}{"docker#v3.8.0": map[string]interface{}{"image": "alpine"}}
+	second := map[string]interface{}{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0": map[string]interface{}{"image": "golang"}}
+
+	expected := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"alpine"}},` +
+		`{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}}]`
+
+	for _, plugins := range [][]interface{}{{first, second}, {second, first}} {
+		plugins, err := parsePluginReferences(plugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		canonical, err := canonicalisePluginReferences(plugins, sortPlugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, canonical)
+
+		pluginJSON, err := marshalPlugins(plugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		canonical, err = canonicalisePluginJSON(pluginJSON, sortPlugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, canonical)
+	}
+}
+
+func TestPluginSettingNumbersCanonicalised(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	// as parsed from pipeline.yml, where 1.0 is a float and 1 an int
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal([]byte("retries: 1.0\nshm: 100\nratio: 0.5\nbig: 1.5e3\noffset: -0.0\n"), &settings); err != nil {
+		t.Fatal(err)
+	}
+	signedPlugins, err := signer.extractPlugins([]interface{}{
+		map[string]interface{}{"docker#v3.8.0": settings},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.signData(stepContent{Command: "make", PluginJSON: signedPlugins})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, presented := range map[string]string{
+		"integers": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"big":1500,"offset":0,"ratio":0.5,"retries":1,"shm":100}}]`,
+		"floats":   `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"big":1500.0,"offset":-0.0,"ratio":0.50,"retries":1.0,"shm":100.0}}]`,
+		"exponent": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"big":1.5e3,"offset":0e0,"ratio":5E-1,"retries":1e0,"shm":1e2}}]`,
+	} {
+		assert.Nil(t, signer.Verify("make", presented, signature), name)
+	}
+
+	// numbers are still compared by value
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make",
+		`[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"big":1500,"offset":0,"ratio":0.5,"retries":2,"shm":100}}]`,
+		signature))
+}
+
+func TestNormaliseNegativeZeroCopiesOnlyWhenChanged(t *testing.T) {
+	settings := map[string]interface{}{"offset": math.Copysign(0, -1), "list": []interface{}{1.0, "a"}}
+
+	canonical, changed := normaliseNegativeZero(settings)
+	assert.True(t, changed)
+	assert.False(t, math.Signbit(canonical.(map[string]interface{})["offset"].(float64)))
+	assert.True(t, math.Signbit(settings["offset"].(float64)), "settings aren't modified")
+
+	_, changed = normaliseNegativeZero(settings["list"])
+	assert.False(t, changed)
+}
+
+func TestPreservePluginOrder(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	const (
+		ordered   = `[{"github.com/buildkite-plugins/docker-login-buildkite-plugin#v2.0.1":null},{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}}]`
+		reordered = `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}},{"github.com/buildkite-plugins/docker-login-buildkite-plugin#v2.0.1":null}]`
+	)
+	step := `{"command":"make test","plugins":[{"docker-login#v2.0.1":null},{"docker#v3.8.0":{"image":"golang"}}]}`
+
+	sorting := NewSharedSecretSigner("secret-llamas")
+	signature := signedStepSignature(t, sorting, step)
+	assert.Nil(t, sorting.Verify("make test", ordered, signature))
+	assert.Nil(t, sorting.Verify("make test", reordered, signature), "plugins are sorted by default")
+
+	preserving := NewSharedSecretSigner("secret-llamas")
+	preserving.preservePluginOrder = true
+	signature = signedStepSignature(t, preserving, step)
+	assert.Nil(t, preserving.Verify("make test", ordered, signature))
+	assert.Equal(t, errSignatureMismatch, preserving.Verify("make test", reordered, signature))
+
+	// the order is kept through versions being matched and settings excluded
+	preserving.matchUnversionedPlugins = true
+	preserving.excludedPluginSettings = []excludedPluginSetting{{Plugin: "github.com/buildkite-plugins/docker-buildkite-plugin", Setting: "mount-buildkite-agent"}}
+	signature = signedStepSignature(t, preserving, `{"command":"make test","plugins":[{"docker-login":null},{"docker#v3.8.0":{"image":"golang"}}]}`)
+	assert.Nil(t, preserving.Verify("make test", ordered, signature))
+	assert.Equal(t, errSignatureMismatch, preserving.Verify("make test", reordered, signature))
+}
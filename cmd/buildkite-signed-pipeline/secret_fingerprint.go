@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// secretFingerprintLabel is what a secret's fingerprint is made over, which is
+// never the content of a step
+const secretFingerprintLabel = `buildkite-signed-pipeline secret fingerprint`
+
+// secretFingerprintLength is the number of hex characters of a fingerprint,
+// enough to tell secrets apart but far too short to be used as a signature
+const secretFingerprintLength = 8
+
+// secretFingerprint identifies a secret so it can be compared across agents
+// without revealing it. It's the start of a HMAC keyed by the secret rather
+// than a hash of the secret, so it can't be looked up in precomputed tables of
+// hashes, and only 32 bits of it are kept.
+func secretFingerprint(secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(secretFingerprintLabel))
+	return fmt.Sprintf("%x", h.Sum(nil))[:secretFingerprintLength]
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFingerprint(t *testing.T) {
+	fingerprint := secretFingerprint("secret-llamas")
+	assert.Len(t, fingerprint, secretFingerprintLength)
+	assert.Equal(t, fingerprint, secretFingerprint("secret-llamas"))
+	assert.NotEqual(t, fingerprint, secretFingerprint("secret-alpacas"))
+	assert.NotEqual(t, fingerprint, secretFingerprint("secret-llamas "))
+
+	// it isn't a plain hash of the secret, and doesn't contain the secret
+	assert.False(t, strings.HasPrefix(fmt.Sprintf("%x", sha256.Sum256([]byte("secret-llamas"))), fingerprint))
+	assert.NotContains(t, fingerprint, "llamas")
+}
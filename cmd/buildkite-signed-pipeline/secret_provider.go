@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	secretSchemeAwsSm = `awssm`
+	secretSchemeVault = `vault`
+	secretSchemeFile  = `file`
+	secretSchemeEnv   = `env`
+
+	vaultAddrEnv  = `VAULT_ADDR`
+	vaultTokenEnv = `VAULT_TOKEN`
+)
+
+// SecretProvider fetches the shared secret from a backend
+type SecretProvider interface {
+	Fetch(ctx context.Context) (string, error)
+}
+
+// secretProviderOptions are the settings that apply to providers of a source
+type secretProviderOptions struct {
+	AwsSmMaxAttempts int
+	// A role assumed to fetch secrets from AWS SM, e.g. in another account
+	AwsAssumeRoleArn string
+}
+
+// secretProviderFactory creates a provider for the part of a secret source after
+// the scheme, e.g. the path of file:///path
+type secretProviderFactory func(ref string, options secretProviderOptions) (SecretProvider, error)
+
+var secretProviders = map[string]secretProviderFactory{
+	secretSchemeAwsSm: func(ref string, options secretProviderOptions) (SecretProvider, error) {
+		return awsSmSecretProvider{SecretID: ref, MaxAttempts: options.AwsSmMaxAttempts, RoleArn: options.AwsAssumeRoleArn}, nil
+	},
+	secretSchemeVault: newVaultSecretProvider,
+	secretSchemeFile: func(ref string, options secretProviderOptions) (SecretProvider, error) {
+		return fileSecretProvider{Path: ref}, nil
+	},
+	secretSchemeEnv: func(ref string, options secretProviderOptions) (SecretProvider, error) {
+		return envSecretProvider{Name: ref}, nil
+	},
+}
+
+// RegisterSecretProvider adds a provider for secret sources with the scheme
+func RegisterSecretProvider(scheme string, factory secretProviderFactory) {
+	secretProviders[scheme] = factory
+}
+
+// parseSecretSource splits a secret source of the form scheme://ref, the ref
+// isn't parsed as a URL as it may be an ARN
+func parseSecretSource(source string) (string, string, error) {
+	parts := strings.SplitN(source, "://", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid secret source %q, expected scheme://ref", source)
+	}
+	return parts[0], parts[1], nil
+}
+
+// newSecretProvider selects the provider for a secret source by its scheme
+func newSecretProvider(source string, options secretProviderOptions) (SecretProvider, error) {
+	scheme, ref, err := parseSecretSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	factory, ok := secretProviders[scheme]
+	if !ok {
+		var schemes []string
+		for scheme := range secretProviders {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("Unknown secret source scheme %q, expected one of %s", scheme, strings.Join(schemes, ", "))
+	}
+	return factory(ref, options)
+}
+
+// awsSmSecretProvider fetches the secret from AWS SM by id or ARN
+type awsSmSecretProvider struct {
+	SecretID    string
+	MaxAttempts int
+	RoleArn     string
+}
+
+func (p awsSmSecretProvider) Fetch(ctx context.Context) (string, error) {
+	return GetAwsSmSecret(p.SecretID, p.MaxAttempts, p.RoleArn)
+}
+
+// fileSecretProvider reads the secret from a file, ignoring a trailing newline
+type fileSecretProvider struct {
+	Path string
+}
+
+func (p fileSecretProvider) Fetch(ctx context.Context) (string, error) {
+	b, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// envSecretProvider reads the secret from an environment variable
+type envSecretProvider struct {
+	Name string
+}
+
+func (p envSecretProvider) Fetch(ctx context.Context) (string, error) {
+	secret := os.Getenv(p.Name)
+	if secret == "" {
+		return "", fmt.Errorf("Secret env %s is not set", p.Name)
+	}
+	return secret, nil
+}
+
+// readStdinSecret reads the shared secret piped to stdin, ignoring a trailing
+// newline. All of stdin is read, so it can't also be used for the pipeline.
+func readStdinSecret(r io.Reader) (string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the secret from stdin: %v", err)
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return "", errors.New("The secret from stdin is empty")
+	}
+	return secret, nil
+}
+
+// vaultSecretProvider reads a field of a secret from HashiCorp Vault's KV
+// secrets engine, using VAULT_ADDR and VAULT_TOKEN
+type vaultSecretProvider struct {
+	Address    string
+	Token      string
+	Path       string
+	Field      string
+	HTTPClient *http.Client
+}
+
+// newVaultSecretProvider creates a provider for a ref of the form path?field=name,
+// the field defaults to value
+func newVaultSecretProvider(ref string, options secretProviderOptions) (SecretProvider, error) {
+	path, field := ref, "value"
+	if parts := strings.SplitN(ref, "?", 2); len(parts) == 2 {
+		query, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vault secret source %q: %v", ref, err)
+		}
+		path = parts[0]
+		if query.Get("field") != "" {
+			field = query.Get("field")
+		}
+	}
+
+	address := os.Getenv(vaultAddrEnv)
+	if address == "" {
+		return nil, fmt.Errorf("%s must be set to use a vault secret source", vaultAddrEnv)
+	}
+
+	return vaultSecretProvider{
+		Address:    address,
+		Token:      os.Getenv(vaultTokenEnv),
+		Path:       strings.Trim(path, "/"),
+		Field:      field,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (p vaultSecretProvider) Fetch(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(p.Address, "/"), p.Path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to fetch secret %s from vault: %s", p.Path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Unable to parse vault response: %v", err)
+	}
+
+	// version 2 of the KV engine nests the secret data within the response data
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+
+	secret, ok := data[p.Field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string field %s", p.Path, p.Field)
+	}
+	return secret, nil
+}
+
+// fetchSecret fetches the secret from the source, logging where it came from
+func fetchSecret(source string, options secretProviderOptions) (string, error) {
+	provider, err := newSecretProvider(source, options)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Using secret from %s", source)
+	secret, err := provider.Fetch(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", fmt.Errorf("The secret from %s is empty", source)
+	}
+	return secret, nil
+}
+
+// secretFromMapFile selects the secret of a pipeline from a JSON or YAML file
+// mapping pipeline slugs to secrets, so one set of agents can serve pipelines
+// that each have their own secret
+func secretFromMapFile(path string, slug string) (string, error) {
+	if slug == "" {
+		return "", fmt.Errorf("%s must be set to select a secret from %s", buildkitePipelineSlugEnv, path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read secret map file: %v", err)
+	}
+
+	// YAML is a superset of JSON, so this parses either
+	var secrets map[string]string
+	if err := yaml.Unmarshal(b, &secrets); err != nil {
+		return "", fmt.Errorf("Unable to parse secret map file %s, expected a mapping of pipeline slugs to secrets: %v", path, err)
+	}
+
+	secret, ok := secrets[slug]
+	if !ok {
+		return "", fmt.Errorf("No secret for pipeline %q in secret map file %s", slug, path)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("The secret for pipeline %q in secret map file %s is empty", slug, path)
+	}
+	log.Printf("Using secret for pipeline %s from %s", slug, path)
+	return secret, nil
+}
+
+// secretConfig is where the shared secret is configured to come from
+type secretConfig struct {
+	SharedSecret string
+	Source       string
+	// A file mapping pipeline slugs to secrets, the secret of the current
+	// pipeline is used
+	MapFile  string
+	Encoding string
+	Options  secretProviderOptions
+}
+
+func (c secretConfig) isSet() bool {
+	return c.SharedSecret != "" || c.Source != "" || c.MapFile != ""
+}
+
+// checkCommand rejects a configuration that can't be used by a command. The map
+// file is resolved once for the pipeline the process runs in, but serve signs
+// pipelines for any pipeline
+func (c secretConfig) checkCommand(command string) error {
+	if c.MapFile != "" && command == "serve" {
+		return errors.New("--secret-map-file can't be used with serve, which signs every pipeline with a single secret")
+	}
+	return nil
+}
+
+// resolve fetches the secret from its source if one is configured and decodes it
+func (c secretConfig) resolve() (string, error) {
+	secret := c.SharedSecret
+	var err error
+	switch {
+	case c.MapFile != "":
+		if secret, err = secretFromMapFile(c.MapFile, os.Getenv(buildkitePipelineSlugEnv)); err != nil {
+			return "", err
+		}
+	case c.Source != "":
+		if secret, err = fetchSecret(c.Source, c.Options); err != nil {
+			return "", err
+		}
+	}
+	return decodeSecret(secret, c.Encoding)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecretSource(t *testing.T) {
+	scheme, ref, err := parseSecretSource("awssm://arn:aws:secretsmanager:ap-southeast-2:1234567:secret:my-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "awssm", scheme)
+	assert.Equal(t, "arn:aws:secretsmanager:ap-southeast-2:1234567:secret:my-secret", ref)
+
+	scheme, ref, err = parseSecretSource("file:///etc/signed-pipeline/secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "file", scheme)
+	assert.Equal(t, "/etc/signed-pipeline/secret", ref)
+
+	for _, source := range []string{"my-secret", "://my-secret", "env://"} {
+		_, _, err := parseSecretSource(source)
+		assert.NotNil(t, err, source)
+	}
+}
+
+func TestSecretProviderSelection(t *testing.T) {
+	t.Setenv(vaultAddrEnv, "https://vault.example.com")
+	t.Setenv(vaultTokenEnv, "token")
+
+	options := secretProviderOptions{AwsSmMaxAttempts: 3}
+	for source, expected := range map[string]SecretProvider{
+		"awssm://my-secret":       awsSmSecretProvider{SecretID: "my-secret", MaxAttempts: 3},
+		"file:///path/to/secret":  fileSecretProvider{Path: "/path/to/secret"},
+		"env://MY_SIGNING_SECRET": envSecretProvider{Name: "MY_SIGNING_SECRET"},
+	} {
+		provider, err := newSecretProvider(source, options)
+		assert.Nil(t, err, source)
+		assert.Equal(t, expected, provider, source)
+	}
+
+	provider, err := newSecretProvider("vault://secret/data/signed-pipeline?field=secret", options)
+	assert.Nil(t, err)
+	vault := provider.(vaultSecretProvider)
+	assert.Equal(t, "https://vault.example.com", vault.Address)
+	assert.Equal(t, "secret/data/signed-pipeline", vault.Path)
+	assert.Equal(t, "secret", vault.Field)
+
+	_, err = newSecretProvider("gcpsm://my-secret", options)
+	assert.EqualError(t, err, `Unknown secret source scheme "gcpsm", expected one of awssm, env, file, vault`)
+}
+
+type staticSecretProvider string
+
+func (p staticSecretProvider) Fetch(ctx context.Context) (string, error) {
+	return string(p), nil
+}
+
+func TestRegisterSecretProvider(t *testing.T) {
+	RegisterSecretProvider("static", func(ref string, options secretProviderOptions) (SecretProvider, error) {
+		return staticSecretProvider(ref), nil
+	})
+	t.Cleanup(func() {
+		delete(secretProviders, "static")
+	})
+
+	secret, err := fetchSecret("static://llamas", secretProviderOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "llamas", secret)
+}
+
+func TestFileSecretProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("secret-llamas\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := fetchSecret("file://"+path, secretProviderOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+}
+
+func TestVerifyWithSecretFromStdin(t *testing.T) {
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	go func() {
+		w.Write([]byte("secret-llamas\n"))
+		w.Close()
+	}()
+
+	secret, err := readStdinSecret(stdin)
+	assert.Nil(t, err)
+
+	resolved, err := secretConfig{SharedSecret: secret, Encoding: secretEncodingRaw}.resolve()
+	assert.Nil(t, err)
+
+	signature := signedStepSignature(t, NewSharedSecretSigner("secret-llamas"), `{"command":"echo hello world"}`)
+	v := &verifyCommand{Signer: NewSharedSecretSigner(resolved)}
+	result, err := v.verify(&verifyEnv{Command: "echo hello world", Signature: signature})
+	assert.Nil(t, err)
+	assert.Equal(t, "Signature matched", result)
+}
+
+func TestReadStdinSecretEmpty(t *testing.T) {
+	_, err := readStdinSecret(strings.NewReader("\n"))
+	assert.EqualError(t, err, "The secret from stdin is empty")
+}
+
+func TestSecretFromMapFile(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "secrets.yml")
+	if err := os.WriteFile(yamlPath, []byte("app: secret-llamas\nlib: secret-alpacas\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "secrets.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"app":"secret-llamas","lib":"c2VjcmV0LWFscGFjYXM="}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	secret, err := secretConfig{MapFile: yamlPath, Encoding: secretEncodingRaw}.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+
+	t.Setenv(buildkitePipelineSlugEnv, "lib")
+	secret, err = secretConfig{MapFile: yamlPath, Encoding: secretEncodingRaw}.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-alpacas", secret)
+
+	// secrets in the map are decoded like any other
+	secret, err = secretConfig{MapFile: jsonPath, Encoding: secretEncodingBase64}.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-alpacas", secret)
+
+	t.Setenv(buildkitePipelineSlugEnv, "unknown")
+	_, err = secretConfig{MapFile: yamlPath}.resolve()
+	assert.EqualError(t, err, `No secret for pipeline "unknown" in secret map file `+yamlPath)
+
+	t.Setenv(buildkitePipelineSlugEnv, "")
+	_, err = secretConfig{MapFile: yamlPath}.resolve()
+	assert.EqualError(t, err, "BUILDKITE_PIPELINE_SLUG must be set to select a secret from "+yamlPath)
+}
+
+func TestSecretMapFileCantBeServed(t *testing.T) {
+	config := secretConfig{MapFile: "secrets.yml"}
+	assert.EqualError(t, config.checkCommand("serve"),
+		"--secret-map-file can't be used with serve, which signs every pipeline with a single secret")
+	assert.Nil(t, config.checkCommand("upload"))
+	assert.Nil(t, secretConfig{SharedSecret: "llamas"}.checkCommand("serve"))
+}
+
+func TestSecretFromMapFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yml")
+	if err := os.WriteFile(path, []byte("- app\n- lib\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := secretFromMapFile(path, "app")
+	assert.Regexp(t, `^Unable to parse secret map file .*, expected a mapping of pipeline slugs to secrets`, err)
+}
+
+func TestEnvSecretProvider(t *testing.T) {
+	t.Setenv("MY_SIGNING_SECRET", "secret-llamas")
+
+	secret, err := fetchSecret("env://MY_SIGNING_SECRET", secretProviderOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+
+	_, err = fetchSecret("env://MY_MISSING_SECRET", secretProviderOptions{})
+	assert.EqualError(t, err, "Secret env MY_MISSING_SECRET is not set")
+}
+
+func TestVaultSecretProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/signed-pipeline":
+			w.Write([]byte(`{"data":{"data":{"value":"secret-llamas"},"metadata":{"version":1}}}`))
+		case "/v1/kv/signed-pipeline":
+			w.Write([]byte(`{"data":{"secret":"secret-alpacas"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(vaultAddrEnv, server.URL)
+	t.Setenv(vaultTokenEnv, "token")
+
+	secret, err := fetchSecret("vault://secret/data/signed-pipeline", secretProviderOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+
+	secret, err = fetchSecret("vault://kv/signed-pipeline?field=secret", secretProviderOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-alpacas", secret)
+
+	_, err = fetchSecret("vault://kv/missing", secretProviderOptions{})
+	assert.EqualError(t, err, "Unable to fetch secret kv/missing from vault: 404 Not Found")
+}
@@ -1,13 +1,41 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
 )
 
+const (
+	secretEncodingRaw    = `raw`
+	secretEncodingBase64 = `base64`
+)
+
+var (
+	// environment variables the AWS SDK reads the default region from
+	awsRegionEnvs = []string{"AWS_REGION", "AWS_DEFAULT_REGION"}
+)
+
+// ec2RegionProvider is satisfied by the EC2 instance metadata client
+type ec2RegionProvider interface {
+	Region() (string, error)
+}
+
 func getAwsSmSecretRegion(secretId string) (string, bool) {
 	re := regexp.MustCompile("^arn:aws:secretsmanager:([^:]+):")
 	result := re.FindStringSubmatch(secretId)
@@ -17,25 +45,154 @@ func getAwsSmSecretRegion(secretId string) (string, bool) {
 	return result[1], true
 }
 
-func GetAwsSmSecret(secretId string) (string, error) {
-	var awsSession *session.Session
-
+// resolveAwsSmSecretRegion picks the region to fetch a secret from, preferring the
+// region in the secret ARN, then the environment, then the region the session
+// resolved from the shared config or profile and finally EC2 instance metadata.
+// An empty region leaves the decision to the AWS SDK defaults.
+func resolveAwsSmSecretRegion(secretId string, sessionRegion string, metadata ec2RegionProvider) string {
 	// use the ARN as a hint for the region of the secret rather than the default
 	// this is because the region in the ARN means nothing to AWS SM
 	if secretRegion, hasRegion := getAwsSmSecretRegion(secretId); hasRegion {
-		awsSession = session.Must(session.NewSession(&aws.Config{Region: aws.String(secretRegion)}))
-	} else {
-		awsSession = session.Must(session.NewSession())
+		return secretRegion
+	}
+
+	for _, env := range awsRegionEnvs {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+
+	if sessionRegion != "" {
+		return sessionRegion
 	}
 
-	client := secretsmanager.New(awsSession)
+	region, err := metadata.Region()
+	if err != nil {
+		log.Printf("Unable to determine region from EC2 instance metadata: %v", err)
+		return ""
+	}
+	return region
+}
+
+// awsSmRetryer retries throttling and transient errors from AWS SM with
+// exponential backoff, NumMaxRetries is set from the configured attempts
+var awsSmRetryer = client.DefaultRetryer{
+	MinRetryDelay:    100 * time.Millisecond,
+	MaxRetryDelay:    5 * time.Second,
+	MinThrottleDelay: 500 * time.Millisecond,
+	MaxThrottleDelay: 10 * time.Second,
+}
+
+func newAwsSmClient(awsSession *session.Session, maxAttempts int) *secretsmanager.SecretsManager {
+	retryer := awsSmRetryer
+	retryer.NumMaxRetries = maxAttempts - 1
+	return secretsmanager.New(awsSession, request.WithRetryer(aws.NewConfig(), retryer))
+}
+
+func getAwsSmSecretValue(client secretsmanageriface.SecretsManagerAPI, secretId string, maxAttempts int) (string, error) {
 	request := &secretsmanager.GetSecretValueInput {
 		SecretId: aws.String(secretId),
 	}
 
 	result, err := client.GetSecretValue(request)
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && isRetryableAwsError(aerr) {
+			return "", fmt.Errorf("Unable to fetch secret %s from AWS SM after %d attempts: %v", secretId, maxAttempts, err)
+		}
 		return "", err
 	}
 	return *result.SecretString, nil
 }
+
+func isRetryableAwsError(err awserr.Error) bool {
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// awsRoleSessionName identifies the signer in CloudTrail when it assumes a role
+const awsRoleSessionName = `buildkite-signed-pipeline`
+
+// withAssumedRole returns a copy of the session that uses the credentials of the
+// role, which is assumed with the session's own credentials. This allows the
+// secret to be kept in another account.
+func withAssumedRole(awsSession *session.Session, roleArn string, options ...func(*stscreds.AssumeRoleProvider)) *session.Session {
+	options = append([]func(*stscreds.AssumeRoleProvider){func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = awsRoleSessionName
+	}}, options...)
+	return awsSession.Copy(&aws.Config{Credentials: stscreds.NewCredentials(awsSession, roleArn, options...)})
+}
+
+// newAwsSession creates the session secrets are fetched with, allowing it to be
+// overridden in tests
+var newAwsSession = func() (*session.Session, error) {
+	return session.NewSession()
+}
+
+// GetAwsSmSecret fetches a secret from AWS SM, the secret id may be a comma
+// separated list of ids or ARNs such as replicas in other regions, which are
+// tried in order until one can be read
+func GetAwsSmSecret(secretIds string, maxAttempts int, roleArn string) (string, error) {
+	return getAwsSmSecretWithFailover(strings.Split(secretIds, ","), func(secretId string) (string, error) {
+		// e.g. a malformed shared config or profile
+		awsSession, err := newAwsSession()
+		if err != nil {
+			return "", fmt.Errorf("Unable to create an AWS session to fetch secret %s: %v", secretId, err)
+		}
+
+		if region := resolveAwsSmSecretRegion(secretId, aws.StringValue(awsSession.Config.Region), ec2metadata.New(awsSession)); region != "" {
+			awsSession = awsSession.Copy(&aws.Config{Region: aws.String(region)})
+		}
+		if roleArn != "" {
+			awsSession = withAssumedRole(awsSession, roleArn)
+		}
+
+		return getAwsSmSecretValue(newAwsSmClient(awsSession, maxAttempts), secretId, maxAttempts)
+	})
+}
+
+// getAwsSmSecretWithFailover returns the first secret that can be fetched,
+// logging why any before it couldn't be
+func getAwsSmSecretWithFailover(secretIds []string, fetch func(secretId string) (string, error)) (string, error) {
+	var errs []error
+	var failed []string
+	for _, secretId := range secretIds {
+		secretId = strings.TrimSpace(secretId)
+		if secretId == "" {
+			continue
+		}
+
+		secret, err := fetch(secretId)
+		if err == nil {
+			if len(errs) > 0 {
+				warnf("⚠️ Using secret %s after failing to fetch %s", secretId, strings.Join(failed, ", "))
+			}
+			return secret, nil
+		}
+
+		warnf("⚠️ Unable to fetch secret %s: %v", secretId, err)
+		errs = append(errs, err)
+		failed = append(failed, secretId)
+	}
+
+	switch len(errs) {
+	case 0:
+		return "", errors.New("No AWS SM secret id provided")
+	case 1:
+		return "", errs[0]
+	}
+	return "", fmt.Errorf("Unable to fetch any of the AWS SM secrets %s, the last error was: %v", strings.Join(failed, ", "), errs[len(errs)-1])
+}
+
+// decodeSecret decodes a secret from any source into the key used for signing
+func decodeSecret(secret string, encoding string) (string, error) {
+	switch encoding {
+	case secretEncodingRaw, "":
+		return secret, nil
+	case secretEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+		if err != nil {
+			return "", fmt.Errorf("Unable to decode base64 secret: %v", err)
+		}
+		return string(decoded), nil
+	}
+	return "", fmt.Errorf("Unknown secret encoding %q", encoding)
+}
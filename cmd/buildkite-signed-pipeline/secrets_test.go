@@ -1,8 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,3 +29,230 @@ func TestParseRegionFromAwsSmId(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestResolveAwsSmSecretRegionPrecedence(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			w.Write([]byte("token"))
+		case "/latest/dynamic/instance-identity/document":
+			w.Write([]byte(`{"region":"eu-west-1"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	metadata := ec2metadata.New(session.Must(session.NewSession()), aws.NewConfig().WithEndpoint(server.URL+"/latest"))
+
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	// falls back to instance metadata with no ARN, environment or configured region
+	assert.Equal(t, "eu-west-1", resolveAwsSmSecretRegion("just-an-id", "", metadata))
+
+	// the region of the shared config or profile takes precedence over instance metadata
+	assert.Equal(t, "ap-northeast-1", resolveAwsSmSecretRegion("just-an-id", "ap-northeast-1", metadata))
+
+	// the environment takes precedence over the session
+	t.Setenv("AWS_DEFAULT_REGION", "us-east-1")
+	assert.Equal(t, "us-east-1", resolveAwsSmSecretRegion("just-an-id", "ap-northeast-1", metadata))
+
+	// the ARN takes precedence over everything
+	assert.Equal(t, "ap-southeast-2", resolveAwsSmSecretRegion("arn:aws:secretsmanager:ap-southeast-2:1234567:secret:my-global-secret", "ap-northeast-1", metadata))
+}
+
+func TestDecodeSecret(t *testing.T) {
+	raw, err := decodeSecret("secret-llamas", secretEncodingRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", raw)
+
+	decoded, err := decodeSecret("c2VjcmV0LWxsYW1hcw==\n", secretEncodingBase64)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", decoded)
+
+	_, err = decodeSecret("not base64!", secretEncodingBase64)
+	assert.NotNil(t, err)
+}
+
+func TestDecodedSecretsProduceSameSignature(t *testing.T) {
+	raw, err := decodeSecret("secret-llamas", secretEncodingRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSecret("c2VjcmV0LWxsYW1hcw==", secretEncodingBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := stepContent{Command: "echo hello world"}
+	rawSignature, _ := NewSharedSecretSigner(raw).signData(content)
+	decodedSignature, _ := NewSharedSecretSigner(decoded).signData(content)
+	assert.Equal(t, rawSignature, decodedSignature)
+}
+
+// withFastAwsSmRetries shortens the backoff between retries for the test
+func withFastAwsSmRetries(t *testing.T) {
+	original := awsSmRetryer
+	awsSmRetryer.MinThrottleDelay = time.Millisecond
+	awsSmRetryer.MaxThrottleDelay = time.Millisecond
+	t.Cleanup(func() {
+		awsSmRetryer = original
+	})
+}
+
+func newTestAwsSmServer(t *testing.T, failures int) (*httptest.Server, *int) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if attempts <= failures {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ThrottlingException","message":"Rate exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{"SecretString":"secret-llamas"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+func newTestAwsSmClient(endpoint string, maxAttempts int) *secretsmanager.SecretsManager {
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-southeast-2"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return newAwsSmClient(awsSession, maxAttempts)
+}
+
+func TestGetAwsSmSecretRetriesThrottling(t *testing.T) {
+	withFastAwsSmRetries(t)
+
+	server, attempts := newTestAwsSmServer(t, 2)
+
+	secret, err := getAwsSmSecretValue(newTestAwsSmClient(server.URL, 3), "my-secret", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+	assert.Equal(t, 3, *attempts)
+}
+
+func TestGetAwsSmSecretRetriesExhausted(t *testing.T) {
+	withFastAwsSmRetries(t)
+
+	server, attempts := newTestAwsSmServer(t, 5)
+
+	_, err := getAwsSmSecretValue(newTestAwsSmClient(server.URL, 2), "my-secret", 2)
+	assert.Contains(t, err.Error(), "Unable to fetch secret my-secret from AWS SM after 2 attempts")
+	assert.Equal(t, 2, *attempts)
+}
+
+func TestGetAwsSmSecretFailsOverToReplica(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"AccessDeniedException","message":"Region is unavailable"}`))
+	}))
+	t.Cleanup(primary.Close)
+	replica, attempts := newTestAwsSmServer(t, 0)
+
+	const (
+		primaryArn = "arn:aws:secretsmanager:ap-southeast-2:1234567:secret:my-secret"
+		replicaArn = "arn:aws:secretsmanager:ap-southeast-4:1234567:secret:my-secret"
+	)
+	endpoints := map[string]string{primaryArn: primary.URL, replicaArn: replica.URL}
+	var fetched []string
+
+	secret, err := getAwsSmSecretWithFailover([]string{primaryArn, " " + replicaArn}, func(secretId string) (string, error) {
+		fetched = append(fetched, secretId)
+		return getAwsSmSecretValue(newTestAwsSmClient(endpoints[secretId], 1), secretId, 1)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+	assert.Equal(t, []string{primaryArn, replicaArn}, fetched)
+	assert.Equal(t, 1, *attempts)
+}
+
+func TestGetAwsSmSecretFailoverExhausted(t *testing.T) {
+	fetch := func(secretId string) (string, error) {
+		return "", fmt.Errorf("%s is unavailable", secretId)
+	}
+
+	_, err := getAwsSmSecretWithFailover([]string{"primary", "replica"}, fetch)
+	assert.EqualError(t, err, "Unable to fetch any of the AWS SM secrets primary, replica, the last error was: replica is unavailable")
+
+	// a single secret fails with its own error
+	_, err = getAwsSmSecretWithFailover([]string{"primary"}, fetch)
+	assert.EqualError(t, err, "primary is unavailable")
+
+	// and the first secret that can be fetched stops any others being tried
+	secret, err := getAwsSmSecretWithFailover([]string{"primary", "replica"}, func(secretId string) (string, error) {
+		if secretId == "replica" {
+			t.Fatal("The replica shouldn't be fetched")
+		}
+		return "secret-llamas", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+}
+
+func TestGetAwsSmSecretSessionError(t *testing.T) {
+	original := newAwsSession
+	t.Cleanup(func() { newAwsSession = original })
+	newAwsSession = func() (*session.Session, error) {
+		return nil, errors.New("malformed profile")
+	}
+
+	_, err := GetAwsSmSecret("my-secret", 1, "")
+	assert.EqualError(t, err, "Unable to create an AWS session to fetch secret my-secret: malformed profile")
+}
+
+func TestGetAwsSmSecretWithAssumedRole(t *testing.T) {
+	const roleArn = "arn:aws:iam::1234567:role/signed-pipeline-secret"
+
+	var assumedWith string
+	stsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "AssumeRole", r.Form.Get("Action"))
+		assert.Equal(t, roleArn, r.Form.Get("RoleArn"))
+		assert.Equal(t, awsRoleSessionName, r.Form.Get("RoleSessionName"))
+		assumedWith = r.Header.Get("Authorization")
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleResult>
+				<Credentials>
+					<AccessKeyId>assumed-id</AccessKeyId>
+					<SecretAccessKey>assumed-secret</SecretAccessKey>
+					<SessionToken>assumed-token</SessionToken>
+					<Expiration>2099-01-01T00:00:00Z</Expiration>
+				</Credentials>
+			</AssumeRoleResult>
+		</AssumeRoleResponse>`))
+	}))
+	t.Cleanup(stsServer.Close)
+
+	var fetchedWith, fetchedToken string
+	smServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchedWith = r.Header.Get("Authorization")
+		fetchedToken = r.Header.Get("X-Amz-Security-Token")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"SecretString":"secret-llamas"}`))
+	}))
+	t.Cleanup(smServer.Close)
+
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-southeast-2"),
+		Credentials: credentials.NewStaticCredentials("agent-id", "agent-secret", ""),
+	}))
+	assumed := withAssumedRole(awsSession, roleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.Client = sts.New(awsSession, aws.NewConfig().WithEndpoint(stsServer.URL))
+	})
+
+	client := newAwsSmClient(assumed.Copy(aws.NewConfig().WithEndpoint(smServer.URL)), 1)
+	secret, err := getAwsSmSecretValue(client, "my-secret", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-llamas", secret)
+
+	// the role is assumed with the agent's credentials, and used to fetch the secret
+	assert.Contains(t, assumedWith, "Credential=agent-id/")
+	assert.Contains(t, fetchedWith, "Credential=assumed-id/")
+	assert.Equal(t, "assumed-token", fetchedToken)
+}
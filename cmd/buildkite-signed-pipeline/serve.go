@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	defaultServeListen = `127.0.0.1:8765`
+	signPath           = `/sign`
+
+	// the build and pipeline a pipeline is signed for, as the signer service
+	// doesn't run in the build
+	buildIDHeader      = `X-Buildkite-Build-Id`
+	pipelineSlugHeader = `X-Buildkite-Pipeline-Slug`
+
+	// maxSignRequestBytes limits the size of pipelines the signer service accepts
+	maxSignRequestBytes = 16 << 20
+)
+
+// newSignHandler serves a HTTP API that signs pipelines, a pipeline is POSTed as
+// JSON and the signed pipeline is returned. An empty token allows any caller.
+func newSignHandler(signer SharedSecretSigner, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(signPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Pipelines must be POSTed to be signed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if token != "" {
+			authorization := r.Header.Get("Authorization")
+			given := strings.TrimPrefix(authorization, "Bearer ")
+			if given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				warnf("🚨 Rejected a request to sign a pipeline from %s without a valid token", r.RemoteAddr)
+				http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		buildID := r.Header.Get(buildIDHeader)
+		if buildID == "" {
+			http.Error(w, fmt.Sprintf("The %s header is required, signatures are bound to the build", buildIDHeader), http.StatusBadRequest)
+			return
+		}
+		slug := r.Header.Get(pipelineSlugHeader)
+
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxSignRequestBytes+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read the pipeline: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(b) > maxSignRequestBytes {
+			http.Error(w, "The pipeline is too large to sign", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		pipeline, err := parsePipeline(b, true)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to parse the pipeline: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// each request is signed for the build it came from
+		requestSigner := signer
+		requestSigner.buildID = buildID
+		requestSigner.getenv = func(key string) string {
+			switch key {
+			case buildkiteBuildIDEnv:
+				return buildID
+			case buildkitePipelineSlugEnv:
+				return slug
+			}
+			return ""
+		}
+
+		signed, report, err := requestSigner.SignWithReport(pipeline)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		output, err := marshalPipeline(signed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		log.Printf("Signed a pipeline for build %s of %s from %s, %d steps signed", buildID, slug, r.RemoteAddr, report.Signed)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(output)
+	})
+	return mux
+}
+
+type serveCommand struct {
+	Signer      *SharedSecretSigner
+	Listen      string
+	Token       string
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+}
+
+func (c *serveCommand) run(ctx *kingpin.ParseContext) error {
+	if c.Token == "" {
+		warnf("⚠️ No --token is set, anyone who can reach %s can sign pipelines", c.Listen)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("Both --tls-cert and --tls-key must be provided to serve TLS")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	server := &http.Server{
+		Addr:              c.Listen,
+		Handler:           newSignHandler(*c.Signer, c.Token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// clients must present a certificate issued by the CA, for mTLS
+	if c.TLSClientCA != "" {
+		pem, err := os.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("Unable to read --tls-client-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", c.TLSClientCA)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+
+	log.Printf("Signing pipelines POSTed to %s%s", c.Listen, signPath)
+	if c.TLSCert != "" {
+		return server.ListenAndServeTLS(c.TLSCert, c.TLSKey)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signRequest(pipeline string, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, signPath, strings.NewReader(pipeline))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set(buildIDHeader, "build-abc")
+	req.Header.Set(pipelineSlugHeader, "app")
+	return req
+}
+
+func TestSignHandler(t *testing.T) {
+	// the build of the service itself isn't used
+	t.Setenv(buildkiteBuildIDEnv, "build-of-the-service")
+
+	handler := newSignHandler(*NewSharedSecretSigner("secret-llamas"), "llamas")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, signRequest(`{"steps":[{"command":"echo hello world"}],"env":{"A":"b"}}`, "llamas"))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.buildID = "build-abc"
+	expected, err := signer.signData(stepContent{Command: "echo hello world"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo hello world","env":{"STEP_SIGNATURE":"`+string(expected)+`"}}],"env":{"A":"b"}}`, rec.Body.String())
+}
+
+func TestSignHandlerUnauthorized(t *testing.T) {
+	handler := newSignHandler(*NewSharedSecretSigner("secret-llamas"), "llamas")
+
+	for _, token := range []string{"", "alpacas"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, signRequest(`{"steps":[{"command":"echo hello world"}]}`, token))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "STEP_SIGNATURE")
+	}
+
+	// the token must be given as a bearer token
+	for _, authorization := range []string{"llamas", "Basic llamas"} {
+		rec := httptest.NewRecorder()
+		req := signRequest(`{"steps":[{"command":"echo hello world"}]}`, "")
+		req.Header.Set("Authorization", authorization)
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, authorization)
+	}
+}
+
+func TestSignHandlerInvalidRequests(t *testing.T) {
+	handler := newSignHandler(*NewSharedSecretSigner("secret-llamas"), "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req := signRequest(`{"steps":[]}`, "")
+	req.Header.Del(buildIDHeader)
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, signRequest(`{"steps":`, ""))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, signRequest(`{"steps":"echo hello world"}`, ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Unexpected type for steps")
+}
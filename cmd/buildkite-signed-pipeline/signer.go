@@ -1,19 +1,48 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const (
+	stepSignatureEnv     = `STEP_SIGNATURE`
+	stepSignatureSaltEnv = `STEP_SIGNATURE_SALT`
+	buildkiteBuildIDEnv  = `BUILDKITE_BUILD_ID`
+)
+
+var (
+	errSignatureMismatch = errors.New("🚨 Signature mismatch. " +
+		"Perhaps check the shared secret is the same across agents?")
 )
 
+// allowedClockSkew is how far in the future a signature's issued at time may
+// be, allowing for clocks that differ between the signing and verifying agents
+const allowedClockSkew = time.Minute
+
 const (
-	stepSignatureEnv  = `STEP_SIGNATURE`
-	buildkiteBuildIDEnv = `BUILDKITE_BUILD_ID`
+	// signatureFormatHMAC signs steps with a HMAC-SHA256 of the step content
+	signatureFormatHMAC = `hmac`
+	// signatureFormatPaseto signs steps with a PASETO v2.local token carrying
+	// claims about the step content
+	signatureFormatPaseto = `paseto`
 )
 
 func NewSharedSecretSigner(secret string) *SharedSecretSigner {
@@ -24,57 +53,225 @@ func NewSharedSecretSigner(secret string) *SharedSecretSigner {
 
 type SharedSecretSigner struct {
 	secret string
+	// Patterns stripped from commands before they are signed or verified, used
+	// where agent hooks wrap the command that is presented at verify time
+	commandTransforms []*regexp.Regexp
+	// The format of the signatures produced and accepted, defaults to HMAC
+	format string
+	// Signatures older than this are rejected, zero disables the check
+	maxAge time.Duration
+	// Allow the current time to be overriden in tests
+	now func() time.Time
+	// The build steps are signed for and verified in, read from the job env
+	// when empty
+	buildID string
+	// Allow the job environment to be overriden, e.g. when checking locally
+	getenv func(string) string
+	// Log how plugin references are normalised when signing
+	debugPlugins bool
+	// Log which decision verification took and why
+	debugVerify bool
+	// Fail signing steps that reference the same plugin more than once
+	rejectDuplicatePlugins bool
+	// Also match plugins presented with a version against those signed without one
+	matchUnversionedPlugins bool
+	// Accept a comma separated list of signatures, any of which may match
+	allowSignatureList bool
+	// Also sign the set of signed steps, in the pipeline's top level env
+	signPipeline bool
+	// Fail signing pipelines with top level keys that aren't known
+	strictTopLevel bool
+	// Fail signing steps that have no key
+	requireStepKeys bool
+	// Fail signing and verifying when there's no build to bind signatures to
+	requireBuildID bool
+	// Also accept signatures made by versions that didn't bind them to a build
+	acceptLegacy bool
+	// Leave the build ID out of signatures, as versions before it was signed did
+	legacyScheme bool
+	// Fold the contents of the local script a command runs into its signature
+	hashReferencedScripts bool
+	// Flatten commands given as objects, tried in turn
+	objectCommandExtractors []objectCommandExtractor
+	// Sign the order plugins are listed in, rather than sorting them
+	preservePluginOrder bool
+	// Plugin settings left out of signatures as the agent rewrites them
+	excludedPluginSettings []excludedPluginSetting
+	// Only steps with a key or label matching this are signed, if set
+	signOnly *regexp.Regexp
+	// Steps with these keys are left unsigned, and allowed to run unsigned
+	ignoredStepKeys []string
+	// Opt-in step properties that are folded into the signature
+	signedFields []string
+	// The job env signed step properties are verified against, where it isn't
+	// the env the agent exposes them in
+	signedFieldEnvs map[string]string
+	// Step env keys whose values are folded into the signature
+	signedEnv []string
+	// Fold a random salt into each signature, stored alongside it in the step
+	includeSalt bool
+	// Sign with a key derived from the secret for each pipeline
+	deriveKey bool
+	// Commands that may run without a signature in addition to upload commands,
+	// these must match exactly
+	allowedUnsignedCommands []string
+	// Glob patterns of commands that may run without a signature
+	unsignedAllowlist []string
+	// Signs and verifies steps with an asymmetric KMS key rather than the secret
+	kms                 kmsiface.KMSAPI
+	kmsKeyID            string
+	kmsSigningAlgorithm string
 	// Allow the signature function to be overriden in tests
-	signerFunc func(string, string) (Signature, error)
+	signerFunc func(stepContent) (Signature, error)
 	// Allow the unsigned command validation to be overriden in tests
 	unsignedCommandValidatorFunc func(string) (bool, error)
 }
 
 func (s SharedSecretSigner) Sign(pipeline interface{}) (interface{}, error) {
-	original := reflect.ValueOf(pipeline)
+	signed, _, err := s.SignWithReport(pipeline)
+	return signed, err
+}
+
+// SignWithReport signs a pipeline, also reporting which steps were signed
+func (s SharedSecretSigner) SignWithReport(pipeline interface{}) (interface{}, *SignReport, error) {
+	report := &SignReport{}
+	if err := s.checkBuildID(); err != nil {
+		return nil, report, err
+	}
+	signed, err := s.sign(pipeline, report)
+	if err != nil {
+		return nil, report, err
+	}
+	if s.signPipeline {
+		if err := s.addPipelineSignature(signed); err != nil {
+			return nil, report, err
+		}
+	}
+	return signed, report, nil
+}
+
+func (s SharedSecretSigner) sign(pipeline interface{}, report *SignReport) (interface{}, error) {
+	if ordered, ok := pipeline.(*orderedPipeline); ok {
+		// sign the values, keeping the order of the keys
+		signed, err := s.sign(ordered.Values, report)
+		if err != nil {
+			return nil, err
+		}
+		return &orderedPipeline{Keys: ordered.Keys, Values: signed.(map[string]interface{})}, nil
+	}
+
+	original, ok := pipeline.(map[string]interface{})
+	if !ok {
+		// only process pipelines that are either a single complex step (not "wait") or a collection of steps
+		reflected := reflect.ValueOf(pipeline)
+		if reflected.Kind() != reflect.Map {
+			return pipeline, nil
+		}
+		// parsed pipelines are always map[string]interface{}, other maps are
+		// converted so they can be handled the same way
+		original = make(map[string]interface{}, reflected.Len())
+		for _, key := range reflected.MapKeys() {
+			original[key.String()] = reflected.MapIndex(key).Interface()
+		}
+	}
 
-	// only process pipelines that are either a single complex step (not "wait") or a collection of steps
-	if original.Kind() != reflect.Map {
-		return pipeline, nil
+	if s.strictTopLevel {
+		if err := checkTopLevelKeys(original); err != nil {
+			return nil, err
+		}
 	}
 
-	copy := reflect.MakeMap(original.Type())
+	if setsCommandFile(original["env"]) {
+		return nil, fmt.Errorf("🚨 The pipeline env sets %s, which only an agent hook may set", buildkiteCommandFileEnv)
+	}
+
+	copy := make(map[string]interface{}, len(original))
 
 	// TODO handle pipelines of single commands (e.g. `command: foo`)
 	// Iterate over the top level map (where keys are things like, steps, agents, env)
-	for _, mk := range original.MapKeys() {
-		keyName := mk.String()
-		item := original.MapIndex(mk)
-
+	for keyName, item := range original {
 		// We only care about "steps" at the top level, so dive into this field
 		if strings.EqualFold(keyName, "steps") {
-			unwrapped := item.Elem()
-			if unwrapped.Kind() == reflect.Slice {
+			switch steps := item.(type) {
+			case []interface{}:
 				// newSteps will replace the existing steps. they will be built up with the signature added
-				var newSteps []interface{}
-				for i := 0; i < unwrapped.Len(); i += 1 {
-					stepItem := unwrapped.Index(i)
-					// If the current stepItem is a complex type (list or map)
-					if stepItem.Elem().Kind() != reflect.String {
-						signedStep, err := s.signStep(stepItem)
-						if err != nil {
-							return nil, err
-						}
-						newSteps = append(newSteps, signedStep)
-					} else { // The current stepItem is a plain string (like just `wait` or `block`) so added it without modification
-						newSteps = append(newSteps, stepItem.Interface())
+				newSteps := make([]interface{}, 0, len(steps))
+				for _, stepItem := range steps {
+					// The current stepItem is a plain string (like just `wait` or `block`) so added it without modification
+					if str, isString := stepItem.(string); isString {
+						newSteps = append(newSteps, stepItem)
+						report.Skipped = append(report.Skipped, str)
+						continue
 					}
+					signedStep, err := s.signStep(stepItem, report)
+					if err != nil {
+						return nil, err
+					}
+					newSteps = append(newSteps, signedStep)
 				}
-				item = reflect.ValueOf(newSteps)
+				item = newSteps
+			case nil:
+			default:
+				// anything else would be passed through unsigned, so fail loudly instead
+				return nil, fmt.Errorf("Unexpected type for steps: %T, expected a list of steps", item)
 			}
 		}
-		copy.SetMapIndex(mk, item)
+		copy[keyName] = item
 	}
 
-	return copy.Interface(), nil
+	return copy, nil
 }
 
-func addSignature(env interface{}, signature Signature) (interface{}, error) {
+// knownTopLevelKeys are the top level pipeline keys the signer understands, none
+// of them hold anything that runs other than steps
+var knownTopLevelKeys = []string{"agents", "env", "image", "notify", "steps"}
+
+// checkTopLevelKeys fails if a pipeline has a top level key that isn't known,
+// which may be a new feature carrying content that isn't signed
+func checkTopLevelKeys(pipeline map[string]interface{}) error {
+	var unknown []string
+	for key := range pipeline {
+		if !containsString(knownTopLevelKeys, strings.ToLower(key)) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("🚨 Pipeline has top level keys that aren't understood: %s. With --strict-top-level only %s are allowed",
+		strings.Join(unknown, ", "), strings.Join(knownTopLevelKeys, ", "))
+}
+
+// isSignatureEnv reports whether a step env key is one that signing adds. Env
+// names are compared case-insensitively, as on Windows or where a shell
+// uppercases them they would collide with the key that's added.
+func isSignatureEnv(key string) bool {
+	return strings.EqualFold(key, stepSignatureEnv) || strings.EqualFold(key, stepSignatureSaltEnv)
+}
+
+// setsCommandFile reports whether env sets BUILDKITE_COMMAND_FILE, which only
+// an agent hook may set as verify would otherwise read the command from a file
+// the step author chose
+func setsCommandFile(env interface{}) bool {
+	switch e := env.(type) {
+	case []interface{}:
+		for _, item := range e {
+			if str, ok := item.(string); ok && strings.EqualFold(strings.SplitN(str, "=", 2)[0], buildkiteCommandFileEnv) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for key := range e {
+			if strings.EqualFold(key, buildkiteCommandFileEnv) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addSignature(env interface{}, signature Signature, salt string) (interface{}, error) {
 	// if there's no env, default to the map format
 	if env == nil {
 		env = make(map[string]interface{})
@@ -83,99 +280,262 @@ func addSignature(env interface{}, signature Signature) (interface{}, error) {
 	switch i := env.(type) {
 	// key=value environment variables
 	case []interface{}:
-		envCopy := make([]interface{}, len(i))
-		copy(envCopy, i)
+		envCopy := make([]interface{}, 0, len(i)+2)
+		for _, item := range i {
+			// drop any existing signature so there's only ever one value
+			if str, ok := item.(string); ok {
+				if key := strings.SplitN(str, "=", 2)[0]; isSignatureEnv(key) {
+					warnf("⚠️ Overwriting pre-existing %s in step env", key)
+					continue
+				}
+			}
+			envCopy = append(envCopy, item)
+		}
 		envCopy = append(envCopy, fmt.Sprintf("%s=%s", stepSignatureEnv, signature))
+		if salt != "" {
+			envCopy = append(envCopy, fmt.Sprintf("%s=%s", stepSignatureSaltEnv, salt))
+		}
 		return envCopy, nil
 	// map of environment variables
 	case map[string]interface{}:
-		envCopy := make(map[string]interface{})
-		reflectedEnv := reflect.ValueOf(i)
-		for _, key := range reflectedEnv.MapKeys() {
-			envCopy[key.String()] = reflectedEnv.MapIndex(key).Interface()
+		envCopy := make(map[string]interface{}, len(i)+2)
+		for key, original := range i {
+			if isSignatureEnv(key) {
+				warnf("⚠️ Overwriting pre-existing %s in step env", key)
+				continue
+			}
+			// the agent exposes env to jobs as strings, so normalise bools and
+			// numbers to the same form
+			value, err := canonicalFieldValue(original)
+			if err != nil {
+				return nil, fmt.Errorf("Unexpected type for env %s: %T", key, original)
+			}
+			envCopy[key] = value
 		}
 		envCopy[stepSignatureEnv] = signature
+		if salt != "" {
+			envCopy[stepSignatureSaltEnv] = salt
+		}
 		return envCopy, nil
 	}
 	return nil, fmt.Errorf("Unknown environment type %T", env)
 }
 
-func (s SharedSecretSigner) signStep(step reflect.Value) (interface{}, error) {
-	original := step.Elem()
+// generateSalt returns a random salt to fold into a signature, so identical
+// steps are signed differently every time
+func generateSalt() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate a salt: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
 
+func (s SharedSecretSigner) signStep(step interface{}, report *SignReport) (interface{}, error) {
 	// Check to make sure the interface isn't nil
-	if !original.IsValid() {
+	if step == nil {
 		return nil, errors.New("Nil interface provided")
 	}
 
+	original, ok := step.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type for step: %T", step)
+	}
+
 	// Create a new object
-	copy := make(map[string]interface{})
-	for _, key := range original.MapKeys() {
-		copy[key.String()] = original.MapIndex(key).Interface()
+	copy := copyMap(original)
+
+	if setsCommandFile(copy["env"]) {
+		return nil, fmt.Errorf("🚨 Step %q sets %s in its env, which only an agent hook may set", stepName(copy), buildkiteCommandFileEnv)
+	}
+
+	// if the step is a `group`, or any other container of steps, we need to
+	// recurse to calculate the signature of nested command steps
+	containers := nestedStepContainers(copy)
+	for _, key := range containers {
+		container := copy
+		if key != "" {
+			container = copyMap(copy[key].(map[string]interface{}))
+		}
+		signedSteps, err := s.sign(map[string]interface{}{"steps": container["steps"]}, report)
+		if err != nil {
+			return nil, err
+		}
+		container["steps"] = signedSteps.(map[string]interface{})["steps"]
+		if key != "" {
+			copy[key] = container
+		}
 	}
 
-	rawCommand, hasCommand := copy["command"]
+	// containers are reported through their nested steps rather than themselves
+	skip := func() (interface{}, error) {
+		if len(containers) == 0 {
+			report.Skipped = append(report.Skipped, stepKind(copy))
+		}
+		return copy, nil
+	}
+
+	// during a gradual rollout only some steps may be signed
+	if s.signOnly != nil && !stepIdentityMatches(s.signOnly, copy) {
+		return skip()
+	}
+
+	key, _ := canonicalFieldValue(stepFieldValue(copy, "key"))
+	if s.isIgnoredStepKey(key) {
+		warnf("⚠️ Not signing step %q, its key is ignored", key)
+		return skip()
+	}
+
+	content, hasContent, err := s.extractStepContent(copy)
+	if err != nil {
+		return nil, err
+	}
+
+	// a command object is uploaded flattened as it was signed, as the agent
+	// only runs string commands
+	if object, ok := copy["command"].(map[string]interface{}); ok {
+		if copy["command"], err = s.flattenObjectCommand(object); err != nil {
+			return nil, err
+		}
+	}
+
+	// a list of commands is uploaded with each entry trimmed as it was signed,
+	// so the command the agent joins them into is the one that was signed
+	for _, key := range []string{"command", "commands"} {
+		if list, ok := copy[key].([]interface{}); ok {
+			copy[key] = trimCommandEntries(list)
+		}
+	}
+
+	// no plugins or commands -- nothing to do
+	if !hasContent {
+		return skip()
+	}
+
+	if s.requireStepKeys && key == "" {
+		return nil, fmt.Errorf("🚨 Step %q has no key, --require-step-keys requires every signed step to have one", stepName(copy))
+	}
+
+	if s.includeSalt {
+		if content.Salt, err = generateSalt(); err != nil {
+			return nil, err
+		}
+	}
+
+	signature, err := s.signatureFunc()(content)
+	if err != nil {
+		return nil, err
+	}
+
+	existingEnv, _ := copy["env"]
+	if copy["env"], err = addSignature(existingEnv, signature, content.Salt); err != nil {
+		return nil, err
+	}
+	report.Signed++
+
+	return copy, nil
+}
+
+// isIgnoredStepKey reports whether steps with the key are exempt from signing
+func (s SharedSecretSigner) isIgnoredStepKey(key string) bool {
+	return key != "" && containsString(s.ignoredStepKeys, key)
+}
+
+// extractStepContent returns the canonical content of a step that its signature
+// covers, or false if the step has no command or plugins to sign
+func (s SharedSecretSigner) extractStepContent(step map[string]interface{}) (stepContent, bool, error) {
+	rawCommand, hasCommand := step["command"]
 	if !hasCommand {
 		// treat commands as an alias of command
 		var hasCommands bool
-		rawCommand, hasCommands = copy["commands"]
+		rawCommand, hasCommands = step["commands"]
 		if !hasCommands {
 			// no commands to sign
 			rawCommand = ""
 		}
 	}
 
-	// if the step is a `group` we need to recurse to calculate the signature of nested command steps
-	if _, hasGroup := copy["group"]; hasGroup {
-		pipeline := make(map[string]interface{})
-		pipeline["steps"] = copy["steps"]
-		signedGroup, err := s.Sign(pipeline)
-		copy["steps"] = signedGroup.(map[string]interface{})["steps"]
-		return copy, err
-	}
-
 	// extract the plugin declaration for signing
 	extractedPlugins := ""
 	var err error
-	if plugins, hasPlugins := copy["plugins"]; hasPlugins {
+	if plugins, hasPlugins := step["plugins"]; hasPlugins {
 		extractedPlugins, err = s.extractPlugins(plugins)
 		if err != nil {
-			return nil, err
+			return stepContent{}, false, err
 		}
 
 		log.Printf("Signing canonicalised plugins %s", extractedPlugins)
 	}
 
-	// no plugins or commands -- nothing to do
 	if rawCommand == "" && extractedPlugins == "" {
-		return copy, nil
+		return stepContent{}, false, nil
 	}
 
 	extractedCommand, err := s.extractCommand(rawCommand)
+	if _, isObject := rawCommand.(map[string]interface{}); isObject && err != nil {
+		return stepContent{}, false, fmt.Errorf("Step %q: %v", stepName(step), err)
+	} else if err != nil {
+		return stepContent{}, false, err
+	}
+	extractedCommand = s.transformCommand(extractedCommand)
+
+	fields, err := s.extractStepFields(step)
 	if err != nil {
-		return nil, err
+		return stepContent{}, false, err
+	}
+	if fields, err = s.addReferencedScriptHash(extractedCommand, fields); err != nil {
+		return stepContent{}, false, err
 	}
 
-	// allow signerFunc to be overwritten in tests
-	signerFunc := s.signerFunc
-	if signerFunc == nil {
-		signerFunc = s.signData
+	return stepContent{
+		Command:    extractedCommand,
+		PluginJSON: extractedPlugins,
+		Fields:     fields,
+	}, true, nil
+}
+
+func (s SharedSecretSigner) extractPlugins(plugins interface{}) (string, error) {
+	// an explicitly null plugins key, e.g. from a template, is the same as no
+	// plugins key at all
+	if plugins == nil {
+		return "", nil
 	}
 
-	signature, err := signerFunc(extractedCommand, extractedPlugins)
+	parsed, err := parsePluginReferences(plugins)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	existingEnv, _ := copy["env"]
-	if copy["env"], err = addSignature(existingEnv, signature); err != nil {
-		return nil, err
+	// an empty plugins declaration is treated the same as no plugins at all
+	if len(parsed) == 0 {
+		warnf("⚠️ Step has an empty plugins declaration, treating it as having no plugins")
+		return "", nil
 	}
 
-	return copy, nil
+	if s.debugPlugins {
+		logPluginNormalisation(parsed)
+	}
+
+	// the agent's behaviour isn't defined for a plugin that's referenced twice,
+	// so a second instance could be used to smuggle in different settings
+	if duplicates := duplicatePlugins(parsed); len(duplicates) > 0 {
+		if s.rejectDuplicatePlugins {
+			return "", fmt.Errorf("🚨 Step references the same plugin more than once: %s", strings.Join(duplicates, ", "))
+		}
+		warnf("⚠️ Step references the same plugin more than once: %s", strings.Join(duplicates, ", "))
+	}
+
+	// ensure the same plugin form (ordering, etc) is used as the verify step
+	canonical, err := canonicalisePluginReferences(parsed, s.pluginOrder())
+	if err != nil {
+		return "", err
+	}
+	return s.excludePluginSettings(canonical)
 }
 
-func (s SharedSecretSigner) extractPlugins(plugins interface{}) (string, error) {
+// parsePluginReferences parses the plugins of a step, in any of the forms
+// Buildkite accepts them
+func parsePluginReferences(plugins interface{}) ([]Plugin, error) {
 	var parsed []Plugin
 
 	switch t := plugins.(type) {
@@ -191,7 +551,7 @@ func (s SharedSecretSigner) extractPlugins(plugins interface{}) (string, error)
 		for _, item := range t {
 			plugin, err := NewPluginFromReference(item)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			parsed = append(parsed, *plugin)
 		}
@@ -203,69 +563,384 @@ func (s SharedSecretSigner) extractPlugins(plugins interface{}) (string, error)
 	    a-parameter: true
 	*/
 	case map[string]interface{}:
-		for k, v := range t {
+		names := make([]string, 0, len(t))
+		for k := range t {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			v := t[k]
 			// convert to a single map so it can be treated the same as the array syntax
 			plugin, err := NewPluginFromReference(map[string]interface{}{k:v})
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			parsed = append(parsed, *plugin)
 		}
+	/*
+	 handles a single plugin reference without settings, e.g.
+	 plugins: foo#v1.2.3
+	*/
+	case string:
+		plugin, err := NewPluginFromReference(t)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, *plugin)
 	default:
-		return "", fmt.Errorf("Unknown plugin type %T", t)
+		return nil, fmt.Errorf("Unknown plugin type %T", t)
 	}
+	return parsed, nil
+}
 
-	pluginJSON, err := marshalPlugins(parsed)
-	if err != nil {
-		return "", err
-	}
+// commandSeparator joins a list of commands, Buildkite joins a step's commands
+// with a newline to form the single BUILDKITE_COMMAND the agent runs. Block
+// scalars keep their trailing newline, which would leave a blank line between
+// commands, so it's trimmed from each entry both when signing and in the
+// uploaded step.
+const commandSeparator = "\n"
 
-	// ensure the same plugin form (ordering, etc) is used as the verify step
-	canonicalJSON, err := canonicalisePluginJSON(pluginJSON)
-	if err != nil {
-		return "", err
+// trimCommandEntry trims the trailing newlines a block scalar keeps from an
+// entry of a list of commands
+func trimCommandEntry(command string) string {
+	return strings.TrimRight(command, "\n")
+}
+
+// trimCommandEntries returns a list of commands with each entry trimmed as it
+// was signed
+func trimCommandEntries(commands []interface{}) []interface{} {
+	trimmed := make([]interface{}, len(commands))
+	for i, item := range commands {
+		if str, ok := item.(string); ok {
+			item = trimCommandEntry(str)
+		}
+		trimmed[i] = item
 	}
+	return trimmed
+}
 
-	return canonicalJSON, err
+// canonicalCommand is the form of a command that's signed. Block scalars keep
+// their trailing newline, which may or may not be kept by the time the agent
+// presents the command, so surrounding whitespace is removed. Otherwise
+// commands are signed byte for byte, including blank lines and null bytes, as
+// within a heredoc or quoted string they change what the shell runs.
+func canonicalCommand(command string) string {
+	return strings.TrimSpace(validUTF8Command(command))
 }
 
-func (s SharedSecretSigner) extractCommand(command interface{}) (string, error) {
-	value := reflect.ValueOf(command)
+// validUTF8Command returns a command as the agent receives it once the signed
+// pipeline is encoded as JSON, which replaces each byte that isn't valid UTF-8
+// with U+FFFD. Valid commands, including any null bytes, are returned as is.
+func validUTF8Command(command string) string {
+	if utf8.ValidString(command) {
+		return command
+	}
+	var valid strings.Builder
+	for i := 0; i < len(command); {
+		r, size := utf8.DecodeRuneInString(command[i:])
+		if r == utf8.RuneError && size == 1 {
+			valid.WriteRune(utf8.RuneError)
+		} else {
+			valid.WriteString(command[i : i+size])
+		}
+		i += size
+	}
+	return valid.String()
+}
 
+func (s SharedSecretSigner) extractCommand(command interface{}) (string, error) {
+	switch c := command.(type) {
+	case string:
+		return c, nil
 	// expand into simple list of commands
-	var commandStrings []string
-	if value.Kind() == reflect.Slice {
-		for i := 0; i < value.Len(); i += 1 {
-			commandStrings = append(commandStrings, value.Index(i).Elem().String())
+	case []interface{}:
+		commandStrings := make([]string, 0, len(c))
+		for i, item := range c {
+			// non-strings would otherwise be silently rendered as placeholders
+			str, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("Unexpected type for command entry %d: %T", i, item)
+			}
+			commandStrings = append(commandStrings, trimCommandEntry(str))
 		}
-	} else if value.Kind() == reflect.String {
-		commandStrings = append(commandStrings, value.String())
-	} else {
-		return "", fmt.Errorf("Unexpected type for command: %T", command)
+		return strings.Join(commandStrings, commandSeparator), nil
+	case []string:
+		commandStrings := make([]string, 0, len(c))
+		for _, str := range c {
+			commandStrings = append(commandStrings, trimCommandEntry(str))
+		}
+		return strings.Join(commandStrings, commandSeparator), nil
+	case map[string]interface{}:
+		return s.flattenObjectCommand(c)
 	}
+	return "", fmt.Errorf("Unexpected type for command: %T", command)
+}
 
-	return strings.Join(commandStrings, "\n"), nil
+// transformCommand strips any configured command transform patterns, this must
+// be applied identically when signing and verifying
+func (s SharedSecretSigner) transformCommand(command string) string {
+	for _, re := range s.commandTransforms {
+		command = re.ReplaceAllString(command, "")
+	}
+	return command
+}
+
+// isUnsignedCommandOk allows upload commands and any explicitly allowed commands
+// to run without a signature
+func (s SharedSecretSigner) isUnsignedCommandOk(command string) (bool, error) {
+	if isExplicitlyAllowedCommand(command, s.allowedUnsignedCommands) {
+		return true, nil
+	}
+	if pattern, ok := matchesUnsignedAllowlist(command, s.unsignedAllowlist); ok {
+		warnf("⚠️ Command matches %q from the unsigned allow-list file", pattern)
+		return true, nil
+	}
+	return IsUnsignedCommandOk(command)
 }
 
 type Signature string
 
-func (s SharedSecretSigner) signData(command string, pluginJSON string) (Signature, error) {
-	h := hmac.New(sha256.New, []byte(s.secret))
-	h.Write([]byte(strings.TrimSpace(command)))
-	h.Write([]byte(os.Getenv(buildkiteBuildIDEnv)))
-	h.Write([]byte(pluginJSON))
-	return Signature(fmt.Sprintf("sha256:%x", h.Sum(nil))), nil
+// SignReport records the outcome of signing the steps of a pipeline
+type SignReport struct {
+	Signed int
+	// The kind or name of each step that wasn't signed
+	Skipped []string
+}
+
+func (r SignReport) String() string {
+	total := r.Signed + len(r.Skipped)
+	if len(r.Skipped) == 0 {
+		return fmt.Sprintf("Signed %d of %d steps", r.Signed, total)
+	}
+	return fmt.Sprintf("Signed %d of %d steps (%d skipped: %s)", r.Signed, total, len(r.Skipped), strings.Join(r.Skipped, ", "))
+}
+
+// stepContent is the content of a step that is covered by its signature
+type stepContent struct {
+	Command    string
+	PluginJSON string
+	// Opt-in step properties, keyed by property name
+	Fields map[string]string
+	// A random salt stored alongside the signature, if any
+	Salt string
+}
+
+// signatureFunc returns the function used to sign step content for the
+// configured format, allowing it to be overwritten in tests
+func (s SharedSecretSigner) signatureFunc() func(stepContent) (Signature, error) {
+	if s.signerFunc != nil {
+		return s.signerFunc
+	}
+	switch s.format {
+	case signatureFormatPaseto:
+		return s.signPaseto
+	case signatureFormatKMS:
+		return s.signKMS
+	}
+	return s.signData
+}
+
+// jobEnv returns a value from the environment of the job being verified
+func (s SharedSecretSigner) jobEnv(key string) string {
+	if s.getenv != nil {
+		return s.getenv(key)
+	}
+	return os.Getenv(key)
+}
+
+// currentBuildID returns the build signatures are bound to, so they can't be
+// replayed in another build
+func (s SharedSecretSigner) currentBuildID() string {
+	if s.buildID != "" {
+		return s.buildID
+	}
+	return s.jobEnv(buildkiteBuildIDEnv)
+}
+
+// pluginOrder is whether the order plugins are listed in is signed
+func (s SharedSecretSigner) pluginOrder() pluginOrder {
+	if s.preservePluginOrder {
+		return keepPluginOrder
+	}
+	return sortPlugins
+}
+
+// checkBuildID fails when --require-build-id is set and there's no build, as
+// signatures over an empty build ID can be replayed in any build
+func (s SharedSecretSigner) checkBuildID() error {
+	if s.requireBuildID && strings.TrimSpace(s.currentBuildID()) == "" {
+		return fmt.Errorf("🚨 %s isn't set, --require-build-id requires signatures to be bound to a build", buildkiteBuildIDEnv)
+	}
+	return nil
+}
+
+func (s SharedSecretSigner) currentTime() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s SharedSecretSigner) signData(content stepContent) (Signature, error) {
+	// signatures are only timestamped when their age is checked, which keeps
+	// them compatible with verifiers that don't understand timestamps
+	issuedAt := ""
+	if s.maxAge > 0 {
+		issuedAt = strconv.FormatInt(s.currentTime().Unix(), 10)
+	}
+	return s.hmacSignature(content, issuedAt)
+}
+
+// signedPayload returns the bytes of the step content covered by a signature.
+// Each part is length prefixed so that characters can't be moved from one part
+// into its neighbour without changing the signature
+func (s SharedSecretSigner) signedPayload(content stepContent) []byte {
+	fields := ""
+	if len(content.Fields) > 0 {
+		fields = canonicalStepFields(content.Fields)
+	}
+
+	var payload bytes.Buffer
+	if s.legacyScheme {
+		// legacy signatures are an unframed concatenation without the build ID
+		payload.WriteString(canonicalCommand(content.Command))
+		payload.WriteString(content.PluginJSON)
+		payload.WriteString(fields)
+		return payload.Bytes()
+	}
+	for _, part := range []string{
+		canonicalCommand(content.Command),
+		s.currentBuildID(),
+		content.PluginJSON,
+		fields,
+		content.Salt,
+	} {
+		writePayloadPart(&payload, part)
+	}
+	return payload.Bytes()
+}
+
+// writePayloadPart writes a part of a signed payload prefixed with its length
+func writePayloadPart(w io.Writer, part string) {
+	fmt.Fprintf(w, "%d:%s", len(part), part)
+}
+
+// hmacSignature calculates the HMAC of the step content, an issued at unix
+// timestamp is included in the HMAC and appended to the signature if provided
+func (s SharedSecretSigner) hmacSignature(content stepContent, issuedAt string) (Signature, error) {
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write(s.signedPayload(content))
+	if issuedAt == "" {
+		return Signature(fmt.Sprintf("sha256:%x", h.Sum(nil))), nil
+	}
+	writePayloadPart(h, issuedAt)
+	return Signature(fmt.Sprintf("sha256:%x:%s", h.Sum(nil), issuedAt)), nil
+}
+
+// issuedAt returns the timestamp of a HMAC signature in the form sha256:<hex>:<unixts>
+func (sig Signature) issuedAt() (string, bool) {
+	parts := strings.SplitN(string(sig), ":", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	return parts[2], true
+}
+
+// matchesLegacyHMAC reports whether a signature was made by a version that
+// didn't include the build ID, when --accept-legacy allows them. Those versions
+// didn't salt or timestamp signatures, and their unframed payload can't safely
+// cover either
+func (s SharedSecretSigner) matchesLegacyHMAC(content stepContent, issuedAt string, expected Signature) bool {
+	if !s.acceptLegacy || s.currentBuildID() == "" || content.Salt != "" || issuedAt != "" {
+		return false
+	}
+	legacy := s
+	legacy.legacyScheme = true
+	signature, err := legacy.hmacSignature(content, issuedAt)
+	if err != nil {
+		return false
+	}
+	s.debugf("trying the legacy signature without a build ID")
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+func (s SharedSecretSigner) verifyHMAC(content stepContent, expected Signature) error {
+	issuedAt, hasIssuedAt := expected.issuedAt()
+
+	signature, err := s.hmacSignature(content, issuedAt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		if !s.matchesLegacyHMAC(content, issuedAt, expected) {
+			return errSignatureMismatch
+		}
+		warnf("⚠️ Accepted a legacy signature that isn't bound to build %s. "+
+			"Upgrade the agents signing this pipeline, support for legacy signatures will be removed", s.currentBuildID())
+	}
+
+	// signatures without a timestamp predate --max-age and aren't age checked
+	if !hasIssuedAt || s.maxAge == 0 {
+		return nil
+	}
+
+	unix, err := strconv.ParseInt(issuedAt, 10, 64)
+	if err != nil {
+		return fmt.Errorf("🚨 Signature has an invalid timestamp %q", issuedAt)
+	}
+	now := s.currentTime()
+	if ahead := time.Unix(unix, 0).Sub(now); ahead > allowedClockSkew {
+		return fmt.Errorf("🚨 Signature was issued %s in the future which exceeds the allowed clock skew of %s",
+			ahead.Round(time.Second), allowedClockSkew)
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > s.maxAge {
+		return fmt.Errorf("🚨 Signature expired. It was issued %s ago which exceeds the maximum age of %s",
+			age.Round(time.Second), s.maxAge)
+	}
+
+	return nil
 }
 
 func (s SharedSecretSigner) Verify(command string, pluginJSON string, expected Signature) error {
+	command = s.transformCommand(command)
+
+	// env injection may add a trailing newline, which is never part of a signature
+	expected = Signature(strings.TrimSpace(string(expected)))
+
+	// any plugins env forces a signature check, even one that canonicalises to no
+	// plugins, so stripping the signature can't be used to run an allowed command
+	// alongside plugins
+	hasPlugins := strings.TrimSpace(pluginJSON) != ""
+	s.debugf("command present: %t, plugins present: %t, signature present: %t", command != "", hasPlugins, expected != "")
+	if hasPlugins {
+		canonical, err := canonicalisePluginJSON(pluginJSON, s.pluginOrder())
+		if err != nil {
+			s.debugf("rejected because %s couldn't be parsed", buildkitePluginsEnv)
+			return malformedPluginsError(pluginJSON, err)
+		}
+		if pluginJSON, err = s.excludePluginSettings(canonical); err != nil {
+			return err
+		}
+	}
+
+	if expected == "" && hasPlugins {
+		s.debugf("rejected because plugins are present, which always require a signature, and there's no signature")
+		return errors.New("🚨 Signature missing. Steps with plugins must be signed.")
+	}
+
 	// step with just a command (no plugins) isn't signed
-	if expected == "" && pluginJSON == "" && command != "" {
-		log.Printf("⚠️ Command is unsigned, checking if it's allow-listed")
+	if expected == "" && command != "" {
+		warnf("⚠️ Command is unsigned, checking if it's allow-listed")
 
 		// allow a custom validator func to be provided in tests
 		validatorFunc := s.unsignedCommandValidatorFunc
 		if validatorFunc == nil {
-			validatorFunc = IsUnsignedCommandOk
+			validatorFunc = s.isUnsignedCommandOk
 		}
 
 		isAllowed, err := validatorFunc(command)
@@ -273,35 +948,156 @@ func (s SharedSecretSigner) Verify(command string, pluginJSON string, expected S
 			return err
 		}
 		if isAllowed {
-			log.Printf("Allowing unsigned command")
+			warnf("Allowing unsigned command")
+			s.debugf("allowed because the command is on the unsigned allow-list and no plugins or signature are present")
 			return nil
 		}
+		s.debugf("rejected because there's no signature and the command isn't on the unsigned allow-list")
 		return errors.New("🚨 Signature missing. The provided command is not permitted to be unsigned.")
 	}
 
-	if pluginJSON != "" {
-		var err error
-		pluginJSON, err = canonicalisePluginJSON(pluginJSON)
-		if err != nil {
-			return err
+	if err := s.checkBuildID(); err != nil {
+		s.debugf("rejected because there's no build to verify the signature against")
+		return err
+	}
+
+	fields, err := s.stepFieldsFromEnv()
+	if err != nil {
+		return err
+	}
+	if fields, err = s.addReferencedScriptHash(command, fields); err != nil {
+		s.debugf("rejected because the script the command runs couldn't be hashed")
+		return err
+	}
+
+	// a salt is verified whenever present, as adding or changing one can only
+	// break the signature
+	content := stepContent{
+		Command:    command,
+		PluginJSON: pluginJSON,
+		Fields:     fields,
+		Salt:       s.jobEnv(stepSignatureSaltEnv),
+	}
+
+	s.debugf("checking the signature against the command, plugins, build %q, %d signed properties and salt present: %t",
+		s.currentBuildID(), len(fields), content.Salt != "")
+	if err := s.verifyAllowedSignatures(content, expected); err != nil {
+		s.debugf("rejected because the signature doesn't match: %v", err)
+		return err
+	}
+	s.debugf("allowed because the signature matched")
+	return nil
+}
+
+// maxAllowedSignatures limits how many signatures a list of allowed signatures
+// can hold, as each is checked in turn
+const maxAllowedSignatures = 16
+
+// verifyAllowedSignatures checks the signature of the step content. With
+// --allow-signature-list the signature may be a comma separated list of
+// signatures precomputed when signing, e.g. for each form of the command an agent
+// is known to rewrite it to, and any of them matching is accepted.
+func (s SharedSecretSigner) verifyAllowedSignatures(content stepContent, expected Signature) error {
+	if !s.allowSignatureList {
+		return s.verifySignature(content, expected)
+	}
+
+	var signatures []Signature
+	for _, sig := range strings.Split(string(expected), ",") {
+		if sig = strings.TrimSpace(sig); sig != "" {
+			signatures = append(signatures, Signature(sig))
 		}
 	}
+	if len(signatures) > maxAllowedSignatures {
+		return fmt.Errorf("🚨 %d allowed signatures were given, at most %d are accepted", len(signatures), maxAllowedSignatures)
+	}
 
-	// allow signerFunc to be overwritten in tests
-	signerFunc := s.signerFunc
-	if signerFunc == nil {
-		signerFunc = s.signData
+	err := errSignatureMismatch
+	for i, sig := range signatures {
+		sigErr := s.verifySignature(content, sig)
+		if sigErr == nil {
+			s.debugf("matched allowed signature %d of %d", i+1, len(signatures))
+			return nil
+		}
+		if i == 0 {
+			err = sigErr
+		}
 	}
-	signature, err := signerFunc(command, pluginJSON)
+	return err
+}
 
+// verifySignature checks the signature of the step content, also accepting
+// plugins signed without a version with --match-unversioned-plugins
+func (s SharedSecretSigner) verifySignature(content stepContent, expected Signature) error {
+	pluginJSON := content.PluginJSON
+	if !s.matchUnversionedPlugins || pluginJSON == "" {
+		return s.verifyContent(content, expected)
+	}
+
+	// plugins that were signed without a version may be presented with the
+	// version the agent resolved, so also try with their versions stripped
+	candidates, err := unversionedPluginCandidates(pluginJSON, s.pluginOrder())
 	if err != nil {
 		return err
 	}
+	var firstErr error
+	for _, candidate := range candidates {
+		content.PluginJSON = candidate
+		err := s.verifyContent(content, expected)
+		if err == nil {
+			if candidate != pluginJSON {
+				warnf("⚠️ Matched plugins that were signed without a version %s", candidate)
+			}
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-	if signature != expected {
-		return errors.New("🚨 Signature mismatch. " +
-			"Perhaps check the shared secret is the same across agents?")
+// debugf logs a step of verification with verify --debug
+func (s SharedSecretSigner) debugf(format string, args ...interface{}) {
+	if s.debugVerify {
+		log.Printf("[debug] verify: "+format, args...)
 	}
+}
 
-	return nil
+// malformedPluginsPrefixLength limits how much of malformed plugin JSON is
+// logged, enough to identify the plugin without including most of its settings
+const malformedPluginsPrefixLength = 40
+
+// malformedPluginsError describes plugin JSON presented to a job that couldn't
+// be parsed, distinct from it not matching the signature
+func malformedPluginsError(pluginJSON string, err error) error {
+	prefix := pluginJSON
+	if len(prefix) > malformedPluginsPrefixLength {
+		prefix = prefix[:malformedPluginsPrefixLength] + "..."
+	}
+	return fmt.Errorf("🚨 %s is malformed and can't be verified, it may have been truncated or mangled: %v (starts with %q)",
+		buildkitePluginsEnv, err, prefix)
+}
+
+// verifyContent checks the signature of the step content in the configured format
+func (s SharedSecretSigner) verifyContent(content stepContent, expected Signature) error {
+	// allow signerFunc to be overwritten in tests
+	if s.signerFunc != nil {
+		signature, err := s.signerFunc(content)
+		if err != nil {
+			return err
+		}
+		if signature != expected {
+			return errSignatureMismatch
+		}
+		return nil
+	}
+
+	switch s.format {
+	case signatureFormatPaseto:
+		return s.verifyPaseto(content, expected)
+	case signatureFormatKMS:
+		return s.verifyKMS(content, expected)
+	}
+	return s.verifyHMAC(content, expected)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const (
+	// signatureFormatKMS signs steps with an asymmetric AWS KMS key, so no
+	// secret material is held by the signer
+	signatureFormatKMS = `kms`
+	kmsSignaturePrefix = `kms:`
+)
+
+var (
+	// signing algorithms that sign a SHA-256 digest of the step content
+	kmsSigningAlgorithms = []string{
+		kms.SigningAlgorithmSpecEcdsaSha256,
+		kms.SigningAlgorithmSpecRsassaPssSha256,
+		kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+	}
+)
+
+func getKmsKeyRegion(keyId string) (string, bool) {
+	re := regexp.MustCompile("^arn:aws:kms:([^:]+):")
+	result := re.FindStringSubmatch(keyId)
+	if result == nil {
+		return "", false
+	}
+	return result[1], true
+}
+
+// NewKmsClient creates a KMS client in the region of the key if it's an ARN,
+// otherwise the AWS SDK defaults are used
+func NewKmsClient(keyId string) (kmsiface.KMSAPI, error) {
+	config := aws.NewConfig()
+	if region, hasRegion := getKmsKeyRegion(keyId); hasRegion {
+		config = config.WithRegion(region)
+	}
+
+	awsSession, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(awsSession), nil
+}
+
+// signKMS signs a SHA-256 digest of the step content with the KMS key
+func (s SharedSecretSigner) signKMS(content stepContent) (Signature, error) {
+	digest := sha256.Sum256(s.signedPayload(content))
+
+	out, err := s.kms.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.kmsKeyID),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.kmsSigningAlgorithm),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to sign step with KMS key %s: %v", s.kmsKeyID, err)
+	}
+
+	return Signature(kmsSignaturePrefix + base64.StdEncoding.EncodeToString(out.Signature)), nil
+}
+
+func (s SharedSecretSigner) verifyKMS(content stepContent, expected Signature) error {
+	mismatch := fmt.Errorf("🚨 Signature mismatch. "+
+		"The signature wasn't produced by KMS key %s for the command, plugins or build of this job.", s.kmsKeyID)
+
+	if !strings.HasPrefix(string(expected), kmsSignaturePrefix) {
+		return mismatch
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(expected), kmsSignaturePrefix))
+	if err != nil {
+		return mismatch
+	}
+
+	digest := sha256.Sum256(s.signedPayload(content))
+
+	out, err := s.kms.Verify(&kms.VerifyInput{
+		KeyId:            aws.String(s.kmsKeyID),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		Signature:        signature,
+		SigningAlgorithm: aws.String(s.kmsSigningAlgorithm),
+	})
+	if err != nil {
+		// KMS reports a signature that doesn't verify as an error
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kms.ErrCodeKMSInvalidSignatureException {
+			return mismatch
+		}
+		return fmt.Errorf("Unable to verify signature with KMS key %s: %v", s.kmsKeyID, err)
+	}
+	if !aws.BoolValue(out.SignatureValid) {
+		return mismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockKMS signs and verifies digests with a local ECDSA key, behaving like KMS
+// does for an ECC_NIST_P256 key
+type mockKMS struct {
+	kmsiface.KMSAPI
+	key        *ecdsa.PrivateKey
+	signs      int
+	verifies   int
+	publicKeys int
+}
+
+func newMockKMS(t *testing.T) *mockKMS {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mockKMS{key: key}
+}
+
+func (m *mockKMS) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	m.signs++
+	signature, err := ecdsa.SignASN1(rand.Reader, m.key, input.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: input.KeyId, Signature: signature}, nil
+}
+
+func (m *mockKMS) Verify(input *kms.VerifyInput) (*kms.VerifyOutput, error) {
+	m.verifies++
+	if !ecdsa.VerifyASN1(&m.key.PublicKey, input.Message, input.Signature) {
+		return nil, awserr.New(kms.ErrCodeKMSInvalidSignatureException, "invalid signature", nil)
+	}
+	return &kms.VerifyOutput{KeyId: input.KeyId, SignatureValid: aws.Bool(true)}, nil
+}
+
+func (m *mockKMS) GetPublicKey(input *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	m.publicKeys++
+	der, err := x509.MarshalPKIXPublicKey(&m.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{KeyId: input.KeyId, PublicKey: der}, nil
+}
+
+func newTestKmsSigner(client kmsiface.KMSAPI) *SharedSecretSigner {
+	signer := NewSharedSecretSigner("")
+	signer.format = signatureFormatKMS
+	signer.kms = client
+	signer.kmsKeyID = "alias/signed-pipeline"
+	signer.kmsSigningAlgorithm = kms.SigningAlgorithmSpecEcdsaSha256
+	return signer
+}
+
+func TestKmsSignatureRoundTrip(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	client := newMockKMS(t)
+	signer := newTestKmsSigner(client)
+
+	pluginJSON := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0":{"image":"alpine"}}]`
+	signature, err := signer.signKMS(stepContent{Command: "echo hello", PluginJSON: pluginJSON})
+	assert.Nil(t, err)
+	assert.Regexp(t, "^kms:", string(signature))
+
+	assert.Nil(t, signer.Verify("echo hello", pluginJSON, signature))
+	assert.Equal(t, 1, client.signs)
+	assert.Equal(t, 1, client.verifies)
+}
+
+func TestKmsSignatureMismatch(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := newTestKmsSigner(newMockKMS(t))
+
+	signature, err := signer.signKMS(stepContent{Command: "echo hello"})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, signer.Verify("echo goodbye", "", signature))
+
+	t.Setenv(buildkiteBuildIDEnv, "build-2")
+	assert.NotNil(t, signer.Verify("echo hello", "", signature))
+}
+
+func TestKmsSignatureFromAnotherKey(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	signature, err := newTestKmsSigner(newMockKMS(t)).signKMS(stepContent{Command: "echo hello"})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, newTestKmsSigner(newMockKMS(t)).Verify("echo hello", "", signature))
+}
+
+func TestKmsRejectsOtherSignatureFormats(t *testing.T) {
+	client := newMockKMS(t)
+	signer := newTestKmsSigner(client)
+
+	hmacSigner := NewSharedSecretSigner("secret-llamas")
+	signature, err := hmacSigner.signData(stepContent{Command: "echo hello"})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, signer.Verify("echo hello", "", signature))
+	assert.NotNil(t, signer.Verify("echo hello", "", Signature("kms:not base64!")))
+	// malformed signatures are rejected without calling KMS
+	assert.Equal(t, 0, client.verifies)
+}
+
+func TestKmsSignPipeline(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := newTestKmsSigner(newMockKMS(t))
+
+	signed, err := signer.Sign(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"command": "echo hello"},
+		},
+	})
+	assert.Nil(t, err)
+
+	sig, ok := stepSignature(signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{}))
+	assert.True(t, ok)
+	assert.Nil(t, signer.Verify("echo hello", "", sig))
+}
+
+func TestParseRegionFromKmsKeyArn(t *testing.T) {
+	region, ok := getKmsKeyRegion("arn:aws:kms:ap-southeast-2:1234567:key/1234abcd-12ab-34cd-56ef-1234567890ab")
+	assert.True(t, ok)
+	assert.Equal(t, "ap-southeast-2", region)
+
+	_, ok = getKmsKeyRegion("alias/signed-pipeline")
+	assert.False(t, ok)
+}
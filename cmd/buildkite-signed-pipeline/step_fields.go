@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stepFieldEnvs maps the step properties that can be signed to the job env
+// their value is verified against. The agent doesn't expose concurrency limits,
+// so like stepIfEnv those envs must be provided by a hook and, as step env can
+// also set them, are only checked for consistency. The rest are set by the agent
+var stepFieldEnvs = map[string]string{
+	"concurrency":        `BUILDKITE_CONCURRENCY`,
+	"concurrency_group":  `BUILDKITE_CONCURRENCY_GROUP`,
+	"key":                `BUILDKITE_STEP_KEY`,
+	"label":              `BUILDKITE_LABEL`,
+	"parallelism":        `BUILDKITE_PARALLEL_JOB_COUNT`,
+	"timeout_in_minutes": `BUILDKITE_TIMEOUT`,
+}
+
+// stepIfEnv is the job env a signed step `if` is verified against. Conditions
+// are evaluated by Buildkite before a job is assigned, so the agent doesn't
+// expose them and this must be provided to the job another way, e.g. by a hook.
+// As step env can also set it, this only checks the condition is consistent.
+const stepIfEnv = `SIGNED_PIPELINE_STEP_IF`
+
+// stepBranchesEnv is the job env a signed step `branches` filter is verified
+// against, like conditions it isn't exposed by the agent and is only checked for
+// consistency
+const stepBranchesEnv = `SIGNED_PIPELINE_STEP_BRANCHES`
+
+// stepFieldCanonicalisers render step properties that have several equivalent
+// forms, applied to both the step value and the env it's verified against
+var stepFieldCanonicalisers = map[string]func(interface{}) (string, error){
+	"branches":           canonicalBranches,
+	"timeout_in_minutes": canonicalTimeout,
+}
+
+// stepFieldAliases are alternative names the pipeline schema accepts for a step
+// property
+var stepFieldAliases = map[string][]string{
+	"key":   {"identifier", "id"},
+	"label": {"name"},
+}
+
+// signedEnvFieldPrefix distinguishes signed step env keys from step properties
+const signedEnvFieldPrefix = `env.`
+
+// fieldNames returns the names of the signed fields, step env keys are prefixed
+// to distinguish them from step properties
+func (s SharedSecretSigner) fieldNames() []string {
+	names := append([]string{}, s.signedFields...)
+	for _, key := range s.signedEnv {
+		names = append(names, signedEnvFieldPrefix+key)
+	}
+	return names
+}
+
+// fieldEnv returns the job env a signed field is verified against, preferring
+// any env configured for the field
+func (s SharedSecretSigner) fieldEnv(name string) (string, bool) {
+	if strings.HasPrefix(name, signedEnvFieldPrefix) {
+		return strings.TrimPrefix(name, signedEnvFieldPrefix), true
+	}
+	if env, ok := s.signedFieldEnvs[name]; ok {
+		return env, true
+	}
+	env, ok := stepFieldEnvs[name]
+	return env, ok
+}
+
+// parseSignFields parses a list of step properties of the form name or
+// name=ENV, where ENV is the job env the property is verified against
+func parseSignFields(list []string) ([]string, map[string]string, error) {
+	var fields []string
+	envs := make(map[string]string)
+	for _, item := range list {
+		for _, field := range strings.Split(item, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+
+			name, env := field, ""
+			if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+				name, env = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+				if name == "" || env == "" {
+					return nil, nil, fmt.Errorf("Invalid step property %q, expected name or name=ENV", field)
+				}
+				envs[name] = env
+			}
+
+			if _, ok := stepFieldEnvs[name]; !ok && env == "" {
+				return nil, nil, fmt.Errorf("Step property %s isn't exposed to jobs, so the env it's verified against must be given as %s=ENV", name, name)
+			}
+			fields = append(fields, name)
+		}
+	}
+	return fields, envs, nil
+}
+
+// stepFieldValue returns the value of a signed field from a step
+func stepFieldValue(step map[string]interface{}, name string) interface{} {
+	if !strings.HasPrefix(name, signedEnvFieldPrefix) {
+		if value, ok := step[name]; ok {
+			return value
+		}
+		for _, alias := range stepFieldAliases[name] {
+			if value, ok := step[alias]; ok {
+				return value
+			}
+		}
+		return nil
+	}
+	key := strings.TrimPrefix(name, signedEnvFieldPrefix)
+
+	switch env := step["env"].(type) {
+	case map[string]interface{}:
+		return env[key]
+	case []interface{}:
+		for _, item := range env {
+			if str, ok := item.(string); ok && strings.HasPrefix(str, key+"=") {
+				return strings.TrimPrefix(str, key+"=")
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalFieldValue renders a step property or env value the way the agent
+// presents it in the job env, so the signed and verified forms agree
+func canonicalFieldValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", fmt.Errorf("Unexpected type for signed step property: %T", value)
+}
+
+// canonicalBranches renders a branch filter, given either as a string of space
+// separated patterns or a list of them, as patterns separated by single spaces.
+// The order of patterns and any negation is kept, so changing them invalidates
+// the signature
+func canonicalBranches(value interface{}) (string, error) {
+	var patterns []string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		patterns = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("Unexpected type for branch pattern: %T", item)
+			}
+			patterns = append(patterns, strings.Fields(str)...)
+		}
+	default:
+		return "", fmt.Errorf("Unexpected type for branches: %T", value)
+	}
+	return strings.Join(patterns, " "), nil
+}
+
+// canonicalTimeout renders a timeout in minutes, given as a number or a string,
+// as a whole number of minutes. The agent presents a step without a timeout as
+// false, which is the same as none at all
+func canonicalTimeout(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		if v != float64(int64(v)) {
+			return "", fmt.Errorf("Timeout %v isn't a whole number of minutes", v)
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" || v == "false" {
+			return "", nil
+		}
+		minutes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Timeout %q isn't a whole number of minutes", v)
+		}
+		return strconv.FormatInt(minutes, 10), nil
+	}
+	return "", fmt.Errorf("Unexpected type for timeout: %T", value)
+}
+
+// canonicalField renders a signed field from either a step or the job env
+func canonicalField(name string, value interface{}) (string, error) {
+	if canonicalise, ok := stepFieldCanonicalisers[name]; ok {
+		return canonicalise(value)
+	}
+	return canonicalFieldValue(value)
+}
+
+// canonicalStepFields returns the fields as JSON, which has a consistent key order
+func canonicalStepFields(fields map[string]string) string {
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// extractStepFields returns the signed fields of a step, fields that aren't
+// present are included as empty so that adding them invalidates the signature
+func (s SharedSecretSigner) extractStepFields(step map[string]interface{}) (map[string]string, error) {
+	names := s.fieldNames()
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]string)
+	for _, name := range names {
+		value, err := canonicalField(name, stepFieldValue(step, name))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to sign step property %s: %v", name, err)
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+// stepFieldsFromEnv returns the signed fields of the current job
+func (s SharedSecretSigner) stepFieldsFromEnv() (map[string]string, error) {
+	names := s.fieldNames()
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]string)
+	for _, name := range names {
+		env, ok := s.fieldEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("Step property %s can't be verified, it isn't exposed to jobs", name)
+		}
+		value, err := canonicalField(name, s.jobEnv(env))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to verify step property %s: %v", name, err)
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signedStepSignature signs a single step pipeline and returns the step's signature
+func signedStepSignature(t *testing.T, signer *SharedSecretSigner, stepJSON string) Signature {
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{"steps":[`+stepJSON+`]}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Steps []struct {
+			Env map[string]string
+		}
+	}
+	if err := mapInto(&result, signed); err != nil {
+		t.Fatal(err)
+	}
+	return Signature(result.Steps[0].Env[stepSignatureEnv])
+}
+
+func TestSigningConcurrency(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"concurrency", "concurrency_group"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","concurrency":1,"concurrency_group":"deploy/production"}`)
+
+	t.Setenv("BUILDKITE_CONCURRENCY", "1")
+	t.Setenv("BUILDKITE_CONCURRENCY_GROUP", "deploy/production")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a changed concurrency group invalidates the signature
+	t.Setenv("BUILDKITE_CONCURRENCY_GROUP", "deploy/staging")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+
+	// as does removing the concurrency limit
+	t.Setenv("BUILDKITE_CONCURRENCY_GROUP", "deploy/production")
+	t.Setenv("BUILDKITE_CONCURRENCY", "")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningConcurrencyIsOnlyCheckedForConsistency(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"concurrency", "concurrency_group"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","concurrency":1,"concurrency_group":"deploy/production"}`)
+
+	// the agent doesn't set these, so a step whose concurrency limit was removed
+	// can set them to the signed values in its own env and still verify
+	t.Setenv("BUILDKITE_CONCURRENCY", "1")
+	t.Setenv("BUILDKITE_CONCURRENCY_GROUP", "deploy/production")
+	assert.NotEqual(t, signature, signedStepSignature(t, signer,
+		`{"command":"deploy.sh","env":{"BUILDKITE_CONCURRENCY":"1","BUILDKITE_CONCURRENCY_GROUP":"deploy/production"}}`))
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningConcurrencyDisabled(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	withConcurrency := signedStepSignature(t, signer, `{"command":"deploy.sh","concurrency":1,"concurrency_group":"deploy/production"}`)
+	withoutConcurrency := signedStepSignature(t, signer, `{"command":"deploy.sh"}`)
+	assert.Equal(t, withoutConcurrency, withConcurrency)
+}
+
+func TestSigningEnv(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedEnv = []string{"DEPLOY_ENV"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","env":{"DEPLOY_ENV":"production","DEBUG":"false"}}`)
+
+	t.Setenv("DEPLOY_ENV", "production")
+	t.Setenv("DEBUG", "false")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// keys that aren't signed can change
+	t.Setenv("DEBUG", "true")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// but a changed value of a signed key invalidates the signature
+	t.Setenv("DEPLOY_ENV", "staging")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningEnvListForm(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedEnv = []string{"DEPLOY_ENV"}
+
+	listFields, err := signer.extractStepFields(map[string]interface{}{
+		"env": []interface{}{"DEBUG=true", "DEPLOY_ENV=production"},
+	})
+	assert.Nil(t, err)
+
+	mapFields, err := signer.extractStepFields(map[string]interface{}{
+		"env": map[string]interface{}{"DEBUG": "true", "DEPLOY_ENV": "production"},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{"env.DEPLOY_ENV": "production"}, listFields)
+	assert.Equal(t, mapFields, listFields)
+}
+
+func TestSigningEnvMissingKey(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedEnv = []string{"DEPLOY_ENV"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh"}`)
+
+	t.Setenv("DEPLOY_ENV", "")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a signed key that's added to the job invalidates the signature
+	t.Setenv("DEPLOY_ENV", "production")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningKey(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"key"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","key":"deploy-production"}`)
+
+	t.Setenv("BUILDKITE_STEP_KEY", "deploy-production")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a signed command can't be reused under a different key
+	t.Setenv("BUILDKITE_STEP_KEY", "deploy-staging")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningKeyDisabled(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	withKey := signedStepSignature(t, signer, `{"command":"deploy.sh","key":"deploy-production"}`)
+	withOtherKey := signedStepSignature(t, signer, `{"command":"deploy.sh","key":"deploy-staging"}`)
+	assert.Equal(t, withKey, withOtherKey)
+}
+
+func TestSigningStepWithoutKey(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"key"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh"}`)
+
+	t.Setenv("BUILDKITE_STEP_KEY", "")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	t.Setenv("BUILDKITE_STEP_KEY", "deploy-production")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestSigningKeyAndLabelAliases(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"key", "label"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","identifier":"deploy","name":":rocket: Deploy"}`)
+	assert.Equal(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","key":"deploy","label":":rocket: Deploy"}`))
+
+	t.Setenv("BUILDKITE_STEP_KEY", "deploy")
+	t.Setenv("BUILDKITE_LABEL", ":rocket: Deploy")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	t.Setenv("BUILDKITE_LABEL", ":rocket: Deploy again")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestParseSignFields(t *testing.T) {
+	fields, envs, err := parseSignFields([]string{"soft_fail=STEP_SOFT_FAIL, parallelism", "skip=STEP_SKIP"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"soft_fail", "parallelism", "skip"}, fields)
+	assert.Equal(t, map[string]string{"soft_fail": "STEP_SOFT_FAIL", "skip": "STEP_SKIP"}, envs)
+
+	_, _, err = parseSignFields([]string{"soft_fail"})
+	assert.EqualError(t, err, "Step property soft_fail isn't exposed to jobs, so the env it's verified against must be given as soft_fail=ENV")
+
+	_, _, err = parseSignFields([]string{"soft_fail="})
+	assert.NotNil(t, err)
+}
+
+func TestSigningArbitraryFields(t *testing.T) {
+	fields, envs, err := parseSignFields([]string{"soft_fail=STEP_SOFT_FAIL,cancel_on_build_failing=STEP_CANCEL_ON_BUILD_FAILING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = fields
+	signer.signedFieldEnvs = envs
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","soft_fail":false,"cancel_on_build_failing":true}`)
+
+	t.Setenv("STEP_SOFT_FAIL", "false")
+	t.Setenv("STEP_CANCEL_ON_BUILD_FAILING", "true")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	t.Setenv("STEP_SOFT_FAIL", "true")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+
+	t.Setenv("STEP_SOFT_FAIL", "false")
+	t.Setenv("STEP_CANCEL_ON_BUILD_FAILING", "")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+
+	// a step signed with a different value of a field has a different signature
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","soft_fail":true,"cancel_on_build_failing":true}`))
+}
+
+func TestSigningIf(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"if"}
+	signer.signedFieldEnvs = map[string]string{"if": stepIfEnv}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","if":"build.branch == 'main'"}`)
+
+	t.Setenv(stepIfEnv, "build.branch == 'main'")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a changed condition invalidates the signature of an otherwise identical step
+	t.Setenv(stepIfEnv, "build.branch != 'main'")
+	assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature))
+
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","if":"build.branch != 'main'"}`))
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh"}`))
+}
+
+func TestSigningIfDisabled(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	assert.Equal(t,
+		signedStepSignature(t, signer, `{"command":"deploy.sh","if":"build.branch == 'main'"}`),
+		signedStepSignature(t, signer, `{"command":"deploy.sh","if":"build.branch != 'main'"}`))
+}
+
+func TestSigningBranches(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"branches"}
+	signer.signedFieldEnvs = map[string]string{"branches": stepBranchesEnv}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","branches":"main release/* !release/old"}`)
+
+	t.Setenv(stepBranchesEnv, "main release/* !release/old")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// whitespace between patterns isn't significant
+	t.Setenv(stepBranchesEnv, "  main   release/*\t!release/old ")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a list of patterns is equivalent to a string of them
+	assert.Equal(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","branches":["main","release/*","!release/old"]}`))
+
+	// a changed filter invalidates the signature of an otherwise identical step
+	for _, branches := range []string{"main release/*", "main release/* release/old", "main !release/* release/old", "*"} {
+		t.Setenv(stepBranchesEnv, branches)
+		assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature), branches)
+	}
+
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","branches":"main"}`))
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh"}`))
+}
+
+func TestCanonicalBranches(t *testing.T) {
+	for _, tc := range []struct {
+		Value    interface{}
+		Expected string
+	}{
+		{nil, ""},
+		{"main", "main"},
+		{" main  feature/* ", "main feature/*"},
+		{[]interface{}{"main", "!release/*"}, "main !release/*"},
+		{[]interface{}{"main feature/*", "!release/*"}, "main feature/* !release/*"},
+	} {
+		value, err := canonicalBranches(tc.Value)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.Expected, value)
+	}
+
+	_, err := canonicalBranches([]interface{}{"main", 1})
+	assert.NotNil(t, err)
+}
+
+func TestSigningBranchesDisabled(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	assert.Equal(t,
+		signedStepSignature(t, signer, `{"command":"deploy.sh","branches":"main"}`),
+		signedStepSignature(t, signer, `{"command":"deploy.sh","branches":"!main"}`))
+}
+
+func TestSigningTimeout(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.signedFields = []string{"timeout_in_minutes"}
+
+	signature := signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":10}`)
+
+	t.Setenv("BUILDKITE_TIMEOUT", "10")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+
+	// a timeout given as a string is equivalent to a number
+	assert.Equal(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":"10"}`))
+	assert.Equal(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":" 010 "}`))
+
+	// a changed timeout invalidates the signature of an otherwise identical step
+	for _, timeout := range []string{"600", "11", "false", ""} {
+		t.Setenv("BUILDKITE_TIMEOUT", timeout)
+		assert.Equal(t, errSignatureMismatch, signer.Verify("deploy.sh", "", signature), timeout)
+	}
+	assert.NotEqual(t, signature, signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":600}`))
+
+	// steps without a timeout are presented with false
+	signature = signedStepSignature(t, signer, `{"command":"deploy.sh"}`)
+	t.Setenv("BUILDKITE_TIMEOUT", "false")
+	assert.Nil(t, signer.Verify("deploy.sh", "", signature))
+}
+
+func TestCanonicalTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		Value    interface{}
+		Expected string
+	}{
+		{nil, ""},
+		{"false", ""},
+		{"", ""},
+		{10, "10"},
+		{float64(10), "10"},
+		{"10", "10"},
+		{" 010 ", "10"},
+	} {
+		value, err := canonicalTimeout(tc.Value)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.Expected, value)
+	}
+
+	for _, value := range []interface{}{1.5, "ten", "10m", true} {
+		_, err := canonicalTimeout(value)
+		assert.NotNil(t, err, "%v", value)
+	}
+}
+
+func TestSigningTimeoutDisabled(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	assert.Equal(t,
+		signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":10}`),
+		signedStepSignature(t, signer, `{"command":"deploy.sh","timeout_in_minutes":600}`))
+}
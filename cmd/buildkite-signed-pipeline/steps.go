@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// walkSteps calls fn for each step of a pipeline, including steps nested in groups
+func walkSteps(pipeline interface{}, fn func(step map[string]interface{})) {
+	if ordered, ok := pipeline.(*orderedPipeline); ok {
+		pipeline = ordered.Values
+	}
+	root, ok := pipeline.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, value := range root {
+		if strings.EqualFold(key, "steps") {
+			walkStepList(value, fn)
+		}
+	}
+}
+
+func walkStepList(steps interface{}, fn func(step map[string]interface{})) {
+	list, ok := steps.([]interface{})
+	if !ok {
+		return
+	}
+	for _, item := range list {
+		step, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fn(step)
+		for _, key := range nestedStepContainers(step) {
+			if key == "" {
+				walkStepList(step["steps"], fn)
+			} else {
+				walkStepList(step[key].(map[string]interface{})["steps"], fn)
+			}
+		}
+	}
+}
+
+// nestedStepContainers returns where a step holds nested steps, either "" for
+// its own steps such as in a group, or the key of a map under the step that
+// has a list of steps, which future container step types may use
+func nestedStepContainers(step map[string]interface{}) []string {
+	var containers []string
+
+	// a group without steps has nothing nested to sign, and isn't given any
+	_, isGroup := step["group"]
+	_, hasStepsKey := step["steps"]
+	if _, hasSteps := step["steps"].([]interface{}); (isGroup && hasStepsKey) || hasSteps {
+		containers = append(containers, "")
+	}
+
+	var keys []string
+	for key, value := range step {
+		// env and plugin settings are never steps, even if they look like them
+		if key == "env" || key == "plugins" {
+			continue
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			if _, hasSteps := m["steps"].([]interface{}); hasSteps {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return append(containers, keys...)
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	copy := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		copy[key] = value
+	}
+	return copy
+}
+
+// stepName returns a human readable name for a step for use in logs
+func stepName(step map[string]interface{}) string {
+	for _, key := range []string{"key", "label", "name", "group"} {
+		if name, ok := step[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	for _, key := range []string{"command", "commands"} {
+		if command, ok := step[key].(string); ok {
+			return command
+		}
+	}
+	return fmt.Sprintf("%v", step)
+}
+
+// stepSignature returns the signature added to a step's env, if any
+func stepSignature(step map[string]interface{}) (Signature, bool) {
+	sig, ok := stepEnvValue(step, stepSignatureEnv)
+	return Signature(sig), ok
+}
+
+// stepEnvValue returns a value added to a step's env when it was signed, if any
+func stepEnvValue(step map[string]interface{}, name string) (string, bool) {
+	switch env := step["env"].(type) {
+	case map[string]interface{}:
+		switch value := env[name].(type) {
+		case Signature:
+			return string(value), true
+		case string:
+			return value, true
+		}
+	case []interface{}:
+		for _, item := range env {
+			if str, ok := item.(string); ok && strings.HasPrefix(str, name+"=") {
+				return strings.TrimPrefix(str, name+"="), true
+			}
+		}
+	}
+	return "", false
+}
+
+// nonCommandStepKeys identify steps that don't run anything on an agent, so
+// have nothing to sign
+var nonCommandStepKeys = []string{"wait", "block", "input", "trigger", "group"}
+
+// identityMatches reports whether a step's key or label matches the pattern
+func identityMatches(pattern *regexp.Regexp, key string, label string) bool {
+	return (key != "" && pattern.MatchString(key)) || (label != "" && pattern.MatchString(label))
+}
+
+// stepIdentityMatches reports whether a step's key or label, or their aliases,
+// match the pattern
+func stepIdentityMatches(pattern *regexp.Regexp, step map[string]interface{}) bool {
+	key, _ := canonicalFieldValue(stepFieldValue(step, "key"))
+	label, _ := canonicalFieldValue(stepFieldValue(step, "label"))
+	return identityMatches(pattern, key, label)
+}
+
+// stepKind describes a step by its type, or its name if it's a command step
+func stepKind(step map[string]interface{}) string {
+	for _, key := range nonCommandStepKeys {
+		if _, ok := step[key]; ok {
+			return key
+		}
+	}
+	return stepName(step)
+}
+
+func isCommandStep(step map[string]interface{}) bool {
+	for _, key := range nonCommandStepKeys {
+		if _, ok := step[key]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// unsignedCommandSteps returns the names of command steps in a signed pipeline
+// that didn't receive a signature
+func unsignedCommandSteps(pipeline interface{}) []string {
+	var unsigned []string
+	walkSteps(pipeline, func(step map[string]interface{}) {
+		if !isCommandStep(step) {
+			return
+		}
+		if _, ok := stepSignature(step); !ok {
+			unsigned = append(unsigned, stepName(step))
+		}
+	})
+	return unsigned
+}
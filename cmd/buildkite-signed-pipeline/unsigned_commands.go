@@ -6,11 +6,17 @@ import (
 	"runtime"
 	"fmt"
 	"os"
+	"path"
+	"strconv"
 )
 
 const (
 	posixSpecialChars = "!\"#$&'()*,;<=>?[]\\^`{}|~"
 	batchSpecialChars = "^&;,=%"
+
+	// disableUnsignedAllowlistEnv disables allowing upload commands to run
+	// unsigned, e.g. when set globally on locked down agents
+	disableUnsignedAllowlistEnv = `SIGNED_PIPELINE_DISABLE_UNSIGNED_ALLOWLIST`
 )
 
 func getToolNames() []string {
@@ -49,10 +55,113 @@ func hasSpecialShellChars(str string) bool {
 	return strings.ContainsAny(str, posixSpecialChars);
 }
 
+// isUnsignedAllowlistDisabled reports whether upload commands must be signed,
+// any value other than a false one disables the allow-list so typos fail closed
+func isUnsignedAllowlistDisabled() bool {
+	value := os.Getenv(disableUnsignedAllowlistEnv)
+	if value == "" {
+		return false
+	}
+	disabled, err := strconv.ParseBool(value)
+	return err != nil || disabled
+}
+
 func IsUnsignedCommandOk(command string) (bool, error) {
+	if isUnsignedAllowlistDisabled() {
+		warnf("⚠️ Unsigned upload commands aren't allowed as %s is set", disableUnsignedAllowlistEnv)
+		return false, nil
+	}
 	if !isUploadCommand(command) {
 		return false, nil
 	}
 	// ensure no special shell variables are used, this means `buildkite-agent pipeline upload `rm -rf /`` would be disallowed
 	return !hasSpecialShellChars(command), nil
 }
+
+// isExplicitlyAllowedCommand checks the command exactly matches one of the allowed
+// commands, prefixes are deliberately not supported to avoid widening what's allowed
+func isExplicitlyAllowedCommand(command string, allowed []string) bool {
+	for _, allowedCommand := range allowed {
+		if command == allowedCommand {
+			return true
+		}
+	}
+	return false
+}
+
+// readUnsignedAllowlistFile reads glob patterns of commands allowed to run
+// unsigned, one per line. Blank lines and lines starting with # are ignored.
+func readUnsignedAllowlistFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for i, line := range strings.Split(string(b), "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if err := validateUnsignedAllowlistPattern(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid pattern on line %d of %s: %v", i+1, path, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// validateUnsignedAllowlistPattern rejects patterns that can't be parsed or that
+// would match too broadly. The first part of a pattern must be literal up to its
+// last /, so it can only match scripts in a given directory, no part may be only
+// wildcards, and character classes aren't supported as they can match /.
+func validateUnsignedAllowlistPattern(pattern string) error {
+	fields := strings.Fields(pattern)
+	for _, field := range fields {
+		if _, err := path.Match(field, ""); err != nil {
+			return fmt.Errorf("%q isn't a valid glob: %v", pattern, err)
+		}
+		if strings.Trim(field, "*?") == "" {
+			return fmt.Errorf("%q has a part that's only a wildcard, which would allow too many commands", pattern)
+		}
+	}
+	if strings.Contains(pattern, "[") {
+		return fmt.Errorf("%q has a character class, which isn't supported as it can match /", pattern)
+	}
+	dir := fields[0][:strings.LastIndex(fields[0], "/")+1]
+	if !strings.Contains(fields[0], "/") {
+		dir = fields[0]
+	}
+	if strings.ContainsAny(dir, "*?") {
+		return fmt.Errorf("%q has a wildcard before the last / of the command, which would allow too many commands", pattern)
+	}
+	return nil
+}
+
+// matchesUnsignedAllowlist checks the command matches one of the glob patterns.
+// Each whitespace separated part of the command must match the corresponding part
+// of the pattern, and wildcards don't match /, so a wildcard can't add arguments
+// or reach another directory. Commands with special shell characters never match.
+func matchesUnsignedAllowlist(command string, patterns []string) (string, bool) {
+	if hasSpecialShellChars(command) {
+		return "", false
+	}
+	fields := strings.Fields(command)
+	for _, pattern := range patterns {
+		patternFields := strings.Fields(pattern)
+		if len(patternFields) != len(fields) {
+			continue
+		}
+		matched := true
+		for i := range fields {
+			if ok, _ := path.Match(patternFields[i], fields[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
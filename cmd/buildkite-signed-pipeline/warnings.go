@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// warningLog also receives security relevant warnings, such as unsigned commands
+// being allowed, so they can be alerted on separately from routine logs
+var warningLog *log.Logger
+
+// warnf logs a security relevant warning, which is also written to any
+// --warnings-file
+func warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Output(2, message)
+	if warningLog != nil {
+		warningLog.Output(2, message)
+	}
+}
+
+// setWarningsOutput writes warnings to w as well as the standard logger, or
+// stops doing so when w is nil
+func setWarningsOutput(w io.Writer) {
+	if w == nil {
+		warningLog = nil
+		return
+	}
+	warningLog = log.New(w, "", log.LstdFlags)
+}
+
+// openWarningsFile appends warnings to a file, which may be a file descriptor
+// such as /dev/fd/3
+func openWarningsFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open --warnings-file: %v", err)
+	}
+	setWarningsOutput(f)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarningsFile(t *testing.T) {
+	output := captureLog(t)
+
+	path := filepath.Join(t.TempDir(), "warnings.log")
+	assert.Nil(t, openWarningsFile(path))
+	t.Cleanup(func() {
+		setWarningsOutput(nil)
+	})
+
+	signer := NewSharedSecretSigner("secret-llamas")
+	signer.allowedUnsignedCommands = []string{"make lint"}
+	assert.Nil(t, signer.Verify("make lint", "", ""))
+
+	_, err := signer.Sign(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{
+				"command": "make test",
+				"plugins": []interface{}{"docker#v3.8.0"},
+				"env":     map[string]interface{}{"STEP_SIGNATURE": "forged"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	warnings, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(warnings), "⚠️ Command is unsigned, checking if it's allow-listed")
+	assert.Contains(t, string(warnings), "Allowing unsigned command")
+	assert.Contains(t, string(warnings), "⚠️ Overwriting pre-existing STEP_SIGNATURE in step env")
+
+	// routine logs only go to the standard logger
+	assert.Contains(t, output.String(), "Signing canonicalised plugins")
+	assert.NotContains(t, string(warnings), "Signing canonicalised")
+
+	// warnings still go to the standard logger too
+	assert.Contains(t, output.String(), "Allowing unsigned command")
+}
+
+func TestWarningsWithoutFile(t *testing.T) {
+	output := captureLog(t)
+
+	warnf("⚠️ Something to look at %d", 42)
+	assert.Contains(t, output.String(), "⚠️ Something to look at 42")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type whichSecretCommand struct {
+	Signer     *SharedSecretSigner
+	Config     secretConfig
+	Candidates []string
+	Command    string
+	PluginJSON string
+	BuildID    string
+	Signature  string
+}
+
+func (c *whichSecretCommand) run(ctx *kingpin.ParseContext) error {
+	var candidates []secretCandidate
+	for _, source := range c.Candidates {
+		// only the candidate source is used, not a configured secret or map file
+		config := c.Config
+		config.SharedSecret, config.MapFile = "", ""
+		config.Source = source
+		secret, err := config.resolve()
+		if err != nil {
+			return fmt.Errorf("Unable to get the candidate secret from %s: %v", source, err)
+		}
+		candidates = append(candidates, secretCandidate{Source: source, Secret: secret})
+	}
+
+	signer := *c.Signer
+	signer.buildID = c.BuildID
+	matches, err := matchingSecrets(signer, candidates, c.Command, c.PluginJSON, Signature(c.Signature))
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("🚨 None of the %d candidate secrets reproduce the signature for build %q", len(candidates), c.BuildID)
+	}
+	for _, source := range matches {
+		log.Printf("✅ The secret from %s reproduces the signature", source)
+	}
+	return nil
+}
+
+// secretCandidate is a secret that may have produced a signature, along with
+// the source it came from so it can be identified without printing it
+type secretCandidate struct {
+	Source string
+	Secret string
+}
+
+// matchingSecrets returns the sources of the candidate secrets that reproduce
+// the signature of the command and plugins, using the signer's other options
+func matchingSecrets(signer SharedSecretSigner, candidates []secretCandidate, command string, pluginJSON string, signature Signature) ([]string, error) {
+	if signature == "" {
+		return nil, fmt.Errorf("A signature is required to find the secret that produced it")
+	}
+	// malformed plugins would fail verification with every secret
+	if pluginJSON != "" {
+		if _, err := canonicalisePluginJSON(pluginJSON, signer.pluginOrder()); err != nil {
+			return nil, malformedPluginsError(pluginJSON, err)
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		signer.secret = candidate.Secret
+		if err := signer.Verify(command, pluginJSON, signature); err == nil {
+			matches = append(matches, candidate.Source)
+		}
+	}
+	return matches, nil
+}
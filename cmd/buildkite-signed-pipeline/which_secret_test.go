@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchingSecrets(t *testing.T) {
+	const pluginJSON = `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v3.8.0":{"image":"golang"}}]`
+
+	signer := NewSharedSecretSigner("secret-b")
+	signer.buildID = "build-1"
+	signature, err := signer.signData(stepContent{Command: "make test", PluginJSON: pluginJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := []secretCandidate{
+		{Source: "env://SECRET_A", Secret: "secret-a"},
+		{Source: "env://SECRET_B", Secret: "secret-b"},
+	}
+
+	base := NewSharedSecretSigner("")
+	base.buildID = "build-1"
+	matches, err := matchingSecrets(*base, candidates, "make test", pluginJSON, signature)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"env://SECRET_B"}, matches)
+
+	// neither reproduces the signature in another build
+	base.buildID = "build-2"
+	matches, err = matchingSecrets(*base, candidates, "make test", pluginJSON, signature)
+	assert.Nil(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestMatchingSecretsInvalid(t *testing.T) {
+	base := NewSharedSecretSigner("")
+	candidates := []secretCandidate{{Source: "env://SECRET_A", Secret: "secret-a"}}
+
+	_, err := matchingSecrets(*base, candidates, "make test", "", "")
+	assert.EqualError(t, err, "A signature is required to find the secret that produced it")
+
+	_, err = matchingSecrets(*base, candidates, "make test", `[{"docker`, "sha256:abc")
+	assert.NotNil(t, err)
+}
+
+func TestWhichSecretCommand(t *testing.T) {
+	t.Setenv("SECRET_A", "secret-a")
+	t.Setenv("SECRET_B", "secret-b")
+
+	signer := NewSharedSecretSigner("secret-a")
+	signer.buildID = "build-1"
+	signature, err := signer.signData(stepContent{Command: "make test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the configured secret and map file are the ones the candidates replace
+	t.Setenv(buildkitePipelineSlugEnv, "app")
+	mapFile := filepath.Join(t.TempDir(), "secrets.yml")
+	if err := os.WriteFile(mapFile, []byte("app: secret-b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureLog(t)
+	c := &whichSecretCommand{
+		Signer:     NewSharedSecretSigner(""),
+		Config:     secretConfig{SharedSecret: "secret-b", MapFile: mapFile, Encoding: secretEncodingRaw},
+		Candidates: []string{"env://SECRET_A", "env://SECRET_B"},
+		Command:    "make test",
+		BuildID:    "build-1",
+		Signature:  string(signature),
+	}
+	assert.Nil(t, c.run(nil))
+	assert.Contains(t, output.String(), "✅ The secret from env://SECRET_A reproduces the signature")
+	assert.NotContains(t, output.String(), "env://SECRET_B reproduces")
+
+	c.BuildID = "build-2"
+	assert.EqualError(t, c.run(nil), `🚨 None of the 2 candidate secrets reproduce the signature for build "build-2"`)
+}
@@ -5,7 +5,9 @@ go 1.17
 require (
 	github.com/aws/aws-sdk-go v1.41.17
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.14.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v3 v3.0.0
 )
 
 require (
@@ -14,5 +16,5 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )